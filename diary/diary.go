@@ -1,18 +1,21 @@
 package diary
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
+	"math"
+	"mime/multipart"
 	"net/http"
 	"net/url"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	mailgun "gopkg.in/mailgun/mailgun-go.v1"
 
-	"googlemaps.github.io/maps"
-
 	"github.com/asaskevich/govalidator"
 	"github.com/flosch/pongo2"
 	"github.com/go-chi/chi"
@@ -29,19 +32,25 @@ import (
 	"github.com/twpayne/go-polyline"
 
 	"github.com/matematik7/camino-go/diary/models"
+	"github.com/matematik7/camino-go/flash"
+	"github.com/matematik7/camino-go/geocode"
 	"github.com/matematik7/camino-go/strava"
+	"github.com/matematik7/camino-go/tracks"
 )
 
 const PerPage = 10
 
 type Diary struct {
-	DB     *gorm.DB
-	render *render.Render
-	files  *files.Files
-	maps   *maps.Client
-	log    *logrus.Logger
-	mg     mailgun.Mailgun
-	strava *strava.Service
+	DB       *gorm.DB
+	render   *render.Render
+	files    *files.Files
+	geocoder geocode.Geocoder
+	log      *logrus.Logger
+	mg       mailgun.Mailgun
+	strava   *strava.Service
+
+	// searchEnabled is false when the text search configuration could not be created
+	searchEnabled bool
 }
 
 func New() *Diary {
@@ -68,18 +77,28 @@ func (c *Diary) Configure(app gongo.App) error {
 		var years []int
 		// TODO: add error handling
 		c.DB.Model(&models.DiaryEntry{}).
-			Select("DISTINCT date_part('year', created_at) as year").
+			Select("DISTINCT date_part('year', "+models.DateColumn+") as year").
 			Where("published = ? or author_id = ?", true, userID).
 			Order("year desc").
 			Pluck("year", &years)
 		ctx["diaryYears"] = years
+
+		// TODO: add error handling
+		tags, _ := models.TagCloud(c.DB)
+		ctx["diaryTags"] = tags
+
+		ctx["diarySearch"] = c.searchEnabled
 	})
 
-	client, err := maps.NewClient(maps.WithAPIKey(viper.GetString("GMAP_SERVER_KEY")))
-	if err != nil {
-		return errors.Wrap(err, "could not get maps client")
+	// the site works without search, e.g. when the database user cannot
+	// create the unaccent extension
+	if err := MigrateSearch(c.DB, c.log); err != nil {
+		c.log.Error(errors.Wrap(err, "diary search is disabled"))
+	} else {
+		c.searchEnabled = true
 	}
-	c.maps = client
+
+	c.geocoder = app["Geocoder"].(geocode.Geocoder)
 
 	pongo2.RegisterFilter("durationformat", func(in *pongo2.Value, param *pongo2.Value) (out *pongo2.Value, err *pongo2.Error) {
 		output := ""
@@ -98,6 +117,14 @@ func (c *Diary) Configure(app gongo.App) error {
 		return pongo2.AsValue(output), nil
 	})
 
+	c.strava.OnActivityCreate.Add(c.createStravaDraft)
+
+	viper.SetDefault("geocode_retry_interval", 10*time.Minute)
+	go c.retryGeocodingLoop(viper.GetDuration("geocode_retry_interval"))
+
+	viper.SetDefault("publish_interval", time.Minute)
+	go c.publishLoop(viper.GetDuration("publish_interval"))
+
 	app["Authorization"].(*authorization.Authorization).OnNewUser.Add(func(ctx context.Context) error {
 		return c.markAllRead(ctx.Value("DB").(*gorm.DB), ctx.Value("user").(authorization.User).ID)
 	})
@@ -110,6 +137,9 @@ func (c Diary) Resources() []interface{} {
 		&models.DiaryEntry{},
 		&models.Comment{},
 		&models.EntryUserRead{},
+		&models.Revision{},
+		&models.Tag{},
+		&models.StravaImport{},
 	}
 }
 
@@ -133,6 +163,19 @@ func (c Diary) CanSeeUnpublished(userItf interface{}) bool {
 	return user.HasPermissions("update_diary_entries")
 }
 
+// CanSee reports whether the user can see the entry, drafts are only shown to
+// their author and users that can see unpublished entries.
+func (c Diary) CanSee(entry models.DiaryEntry, userItf interface{}) bool {
+	if entry.Published {
+		return true
+	}
+	if userItf == nil {
+		return false
+	}
+	user := userItf.(authorization.User)
+	return entry.AuthorID == user.ID || c.CanSeeUnpublished(user)
+}
+
 func (c Diary) CanCreate(userItf interface{}) bool {
 	if userItf == nil {
 		return false
@@ -142,28 +185,11 @@ func (c Diary) CanCreate(userItf interface{}) bool {
 }
 
 func (c *Diary) getCity(latitude, longitude float64) (string, error) {
-	result, err := c.maps.Geocode(context.Background(), &maps.GeocodingRequest{
-		LatLng: &maps.LatLng{
-			Lat: latitude,
-			Lng: longitude,
-		},
-	})
+	place, err := c.geocoder.Reverse(context.Background(), latitude, longitude)
 	if err != nil {
-		return "", errors.Wrap(err, "could not get geocode result")
+		return "", err
 	}
-
-	if len(result) < 1 {
-		return "", errors.Wrap(err, "no results for geocode")
-	}
-
-	for _, ac := range result[0].AddressComponents {
-		for _, typ := range ac.Types {
-			if typ == "locality" {
-				return ac.LongName, nil
-			}
-		}
-	}
-	return result[0].FormattedAddress, nil
+	return place.Name, nil
 }
 
 func (c *Diary) markAllRead(DB *gorm.DB, userID uint) error {
@@ -207,6 +233,12 @@ func (c *Diary) ServeMux() http.Handler {
 	router.Get("/new", c.EditHandler)
 	router.Post("/new", c.EditHandler)
 
+	router.Get("/workouts.json", c.WorkoutsHandler)
+
+	router.Get("/search", c.SearchHandler)
+
+	router.Get("/tag/{slug}", c.TagHandler)
+
 	router.Route("/{diaryID:[0-9]+}", func(r chi.Router) {
 		r.Get("/", c.ViewHandler)
 		r.Post("/comment", c.CommentHandler)
@@ -216,6 +248,11 @@ func (c *Diary) ServeMux() http.Handler {
 
 		r.Get("/publish", c.PublishHandler)
 
+		r.Get("/history", c.HistoryHandler)
+		r.Post("/history/{revisionID:[0-9]+}/restore", c.RestoreHandler)
+
+		r.Get("/track.gpx", c.TrackHandler)
+
 		r.Route("/pictures", func(r chi.Router) {
 			r.Get("/", c.PicturesHandler)
 			r.Post("/", c.AddPictureHandler)
@@ -253,20 +290,51 @@ func (c *Diary) PublishHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	now := time.Now()
-	updates := models.DiaryEntry{
-		Model: gorm.Model{
-			CreatedAt: now,
-			UpdatedAt: now,
-		},
-		Published: true,
+	if diaryEntry.Published {
+		http.Redirect(w, r, fmt.Sprintf("/diary/%d", diaryEntry.ID), http.StatusFound)
+		return
 	}
 
-	if err := c.DB.Model(&diaryEntry).UpdateColumns(updates).Error; err != nil {
+	now := time.Now()
+	err = c.DB.Model(&diaryEntry).UpdateColumns(map[string]interface{}{
+		"published":    true,
+		"published_at": now,
+		"publish_at":   nil,
+		"updated_at":   now,
+	}).Error
+	if err != nil {
 		c.render.Error(w, r, err)
 		return
 	}
 
+	message := flash.Info("Vnos objavljen!")
+	if err := c.notify(diaryEntry); err != nil {
+		c.log.Error(err)
+		message = flash.Info("Vnos objavljen, obvestilo naročnikom bo poslano kasneje.")
+	}
+
+	if err := c.render.AddFlash(w, r, message); err != nil {
+		c.render.Error(w, r, errors.Wrap(err, "could not set flash"))
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/diary/%d", diaryEntry.ID), http.StatusFound)
+}
+
+// notify emails subscribers about a published entry. The notification is
+// claimed in the database before sending, so scheduler and PublishHandler do
+// not send it at the same time. A claim that was not marked as notified, e.g.
+// because the server stopped while sending, is retried after
+// models.NotifyClaimTimeout, so subscribers may rarely get it twice.
+func (c *Diary) notify(diaryEntry models.DiaryEntry) error {
+	claimed, err := models.ClaimNotification(c.DB, diaryEntry.ID, time.Now())
+	if err != nil {
+		return errors.Wrapf(err, "could not claim notification for entry %d", diaryEntry.ID)
+	}
+	if !claimed {
+		return nil
+	}
+
 	txt := `Živjo,
 %s je na %s spletni strani objavil: %s
 Preberi več: https://%s.ipavec.net/diary/%d
@@ -286,11 +354,223 @@ Odjava od prejemanja teh sporočil:
 		fmt.Sprintf("%s-subscribers@ipavec.net", subdomain),
 	)
 	if _, _, err := c.mg.Send(msg); err != nil {
+		if err := models.ReleaseNotification(c.DB, diaryEntry.ID); err != nil {
+			c.log.Error(errors.Wrapf(err, "could not release notification for entry %d", diaryEntry.ID))
+		}
+		return errors.Wrapf(err, "could not send notification for entry %d", diaryEntry.ID)
+	}
+
+	if err := models.MarkNotified(c.DB, diaryEntry.ID, time.Now()); err != nil {
+		return errors.Wrapf(err, "could not mark entry %d as notified", diaryEntry.ID)
+	}
+
+	return nil
+}
+
+// publishScheduled publishes due drafts and sends notifications that were
+// not sent yet, e.g. because sending failed or the server was restarted. A
+// failed notification is logged and does not stop the others.
+func (c *Diary) publishScheduled() error {
+	published, err := models.PublishDue(c.DB, time.Now())
+	if err != nil {
+		return errors.Wrap(err, "could not publish scheduled entries")
+	}
+	if published > 0 {
+		c.log.Infof("Published %d scheduled diary entries", published)
+	}
+
+	var entries []models.DiaryEntry
+	query := c.DB.Preload("Author").
+		Where("published = ? AND notified_at IS NULL", true).
+		Find(&entries)
+	if query.Error != nil {
+		return errors.Wrap(query.Error, "could not get entries to notify about")
+	}
+
+	for _, entry := range entries {
+		if err := c.notify(entry); err != nil {
+			c.log.Error(err)
+		}
+	}
+
+	return nil
+}
+
+func (c *Diary) publishLoop(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := c.publishScheduled(); err != nil {
+			c.log.Error(err)
+		}
+	}
+}
+
+// MigratePublished sets publication time of entries published before it was
+// stored separately, their creation time was overwritten on publish. They were
+// already announced so they are marked as notified.
+func MigratePublished(DB *gorm.DB, log *logrus.Logger) error {
+	query := DB.Exec(`UPDATE diary_entries SET published_at = created_at, notified_at = created_at
+		WHERE published = true AND published_at IS NULL`)
+	if query.Error != nil {
+		return errors.Wrap(query.Error, "could not migrate published entries")
+	}
+	if query.RowsAffected > 0 {
+		log.Infof("Set publication time of %d diary entries", query.RowsAffected)
+	}
+
+	return nil
+}
+
+// recordRevision stores the saved version of an entry. Entries that were
+// created before revisions were recorded first get their previous version
+// stored, so that the first edit can be reverted too.
+func (c *Diary) recordRevision(previous, entry models.DiaryEntry, editorID uint) error {
+	if previous.ID != 0 {
+		var count int
+		if err := c.DB.Model(&models.Revision{}).Where("diary_entry_id = ?", previous.ID).Count(&count).Error; err != nil {
+			return errors.Wrap(err, "could not count revisions")
+		}
+		if count == 0 {
+			revision := previous.Revision(previous.AuthorID)
+			revision.CreatedAt = previous.UpdatedAt
+			if err := models.SaveRevision(c.DB, revision); err != nil {
+				return errors.Wrap(err, "could not save previous revision")
+			}
+		}
+	}
+
+	if err := models.SaveRevision(c.DB, entry.Revision(editorID)); err != nil {
+		return errors.Wrap(err, "could not save revision")
+	}
+
+	return nil
+}
+
+func (c *Diary) HistoryHandler(w http.ResponseWriter, r *http.Request) {
+	diaryEntry := models.DiaryEntry{}
+
+	id, err := strconv.Atoi(chi.URLParam(r, "diaryID"))
+	if err != nil {
+		c.render.NotFound(w, r)
+		return
+	}
+
+	query := c.DB.First(&diaryEntry, id)
+	if query.RecordNotFound() {
+		c.render.NotFound(w, r)
+		return
+	} else if query.Error != nil {
+		c.render.Error(w, r, query.Error)
+		return
+	}
+
+	if !c.CanEdit(diaryEntry, r.Context().Value("user")) {
+		c.render.Forbidden(w, r)
+		return
+	}
+
+	var revisions []models.Revision
+	query = c.DB.Preload("Editor").
+		Where("diary_entry_id = ?", diaryEntry.ID).
+		Order("id desc").
+		Find(&revisions)
+	if query.Error != nil {
+		c.render.Error(w, r, errors.Wrap(query.Error, "could not get revisions"))
+		return
+	}
+
+	// compare latest two revisions by default
+	var from, to models.Revision
+	if len(revisions) > 0 {
+		to = revisions[0]
+		from = to
+	}
+	if len(revisions) > 1 {
+		from = revisions[1]
+	}
+	for _, revision := range revisions {
+		if strconv.Itoa(int(revision.ID)) == r.URL.Query().Get("from") {
+			from = revision
+		}
+		if strconv.Itoa(int(revision.ID)) == r.URL.Query().Get("to") {
+			to = revision
+		}
+	}
+
+	c.render.Template(w, r, "diary_history.html", render.Context{
+		"entry":      diaryEntry,
+		"subpage":    "Zgodovina",
+		"revisions":  revisions,
+		"from":       from,
+		"to":         to,
+		"title_diff": models.Diff(from.Title, to.Title),
+		"text_diff":  models.Diff(from.Text, to.Text),
+	})
+}
+
+func (c *Diary) RestoreHandler(w http.ResponseWriter, r *http.Request) {
+	diaryEntry := models.DiaryEntry{}
+
+	id, err := strconv.Atoi(chi.URLParam(r, "diaryID"))
+	if err != nil {
+		c.render.NotFound(w, r)
+		return
+	}
+
+	query := c.DB.First(&diaryEntry, id)
+	if query.RecordNotFound() {
+		c.render.NotFound(w, r)
+		return
+	} else if query.Error != nil {
+		c.render.Error(w, r, query.Error)
+		return
+	}
+
+	if !c.CanEdit(diaryEntry, r.Context().Value("user")) {
+		c.render.Forbidden(w, r)
+		return
+	}
+
+	revisionID, err := strconv.Atoi(chi.URLParam(r, "revisionID"))
+	if err != nil {
+		c.render.NotFound(w, r)
+		return
+	}
+
+	revision := models.Revision{}
+	query = c.DB.Where("diary_entry_id = ?", diaryEntry.ID).First(&revision, revisionID)
+	if query.RecordNotFound() {
+		c.render.NotFound(w, r)
+		return
+	} else if query.Error != nil {
+		c.render.Error(w, r, query.Error)
+		return
+	}
+
+	previous := diaryEntry
+	diaryEntry.Title = revision.Title
+	diaryEntry.Text = revision.Text
+	diaryEntry.Format = revision.Format
+	// revisions recorded before text was sanitized on save may be unsafe
+	if diaryEntry.Format != models.FormatMarkdown {
+		diaryEntry.Text = models.Sanitize(diaryEntry.Text)
+	}
+	err = c.DB.Model(&diaryEntry).Updates(map[string]interface{}{
+		"title":  diaryEntry.Title,
+		"text":   diaryEntry.Text,
+		"format": diaryEntry.Format,
+	}).Error
+	if err != nil {
+		c.render.Error(w, r, errors.Wrap(err, "could not restore revision"))
+		return
+	}
+
+	editorID := r.Context().Value("user").(authorization.User).ID
+	if err := c.recordRevision(previous, diaryEntry, editorID); err != nil {
 		c.render.Error(w, r, err)
 		return
 	}
 
-	if err := c.render.AddFlash(w, r, FlashInfo("Vnos objavljen!")); err != nil {
+	if err := c.render.AddFlash(w, r, flash.Info("Različica obnovljena!")); err != nil {
 		c.render.Error(w, r, errors.Wrap(err, "could not set flash"))
 		return
 	}
@@ -298,13 +578,40 @@ Odjava od prejemanja teh sporočil:
 	http.Redirect(w, r, fmt.Sprintf("/diary/%d", diaryEntry.ID), http.StatusFound)
 }
 
+// MigrateSearch creates the text search configuration used by SearchHandler.
+func MigrateSearch(DB *gorm.DB, log *logrus.Logger) error {
+	if err := DB.Exec("CREATE EXTENSION IF NOT EXISTS unaccent").Error; err != nil {
+		return errors.Wrap(err, "could not create unaccent extension")
+	}
+
+	var count int
+	if err := DB.Raw("SELECT COUNT(*) FROM pg_ts_config WHERE cfgname = ?", models.SearchConfig).Row().Scan(&count); err != nil {
+		return errors.Wrap(err, "could not check text search configuration")
+	}
+	if count > 0 {
+		return nil
+	}
+
+	if err := DB.Exec("CREATE TEXT SEARCH CONFIGURATION " + models.SearchConfig + " (COPY = simple)").Error; err != nil {
+		return errors.Wrap(err, "could not create text search configuration")
+	}
+	err := DB.Exec("ALTER TEXT SEARCH CONFIGURATION " + models.SearchConfig +
+		" ALTER MAPPING FOR hword, hword_part, word WITH unaccent, simple").Error
+	if err != nil {
+		return errors.Wrap(err, "could not alter text search configuration")
+	}
+	log.Infof("Created text search configuration %s", models.SearchConfig)
+
+	return nil
+}
+
 func (c *Diary) SubscribeHandler(w http.ResponseWriter, r *http.Request) {
 	subpage := "Naroči se"
 
 	if r.Method == "POST" {
 		email := r.FormValue("email")
 		if !govalidator.IsEmail(email) {
-			c.render.AddFlash(w, r, FlashError("Neveljaven email naslov!"))
+			c.render.AddFlash(w, r, flash.Error("Neveljaven email naslov!"))
 		} else {
 			mailingList := fmt.Sprintf("%s-subscribers@ipavec.net", viper.GetString("subdomain"))
 			err := c.mg.CreateMember(true, mailingList, mailgun.Member{
@@ -313,33 +620,416 @@ func (c *Diary) SubscribeHandler(w http.ResponseWriter, r *http.Request) {
 			})
 			if err != nil {
 				c.log.Error(err.Error())
-				c.render.AddFlash(w, r, FlashError("Nekaj je šlo narobe, poskusite znova!"))
+				c.render.AddFlash(w, r, flash.Error("Nekaj je šlo narobe, poskusite znova!"))
 			} else {
-				c.render.AddFlash(w, r, FlashInfo("Uspešno ste naročeni!"))
+				c.render.AddFlash(w, r, flash.Info("Uspešno ste naročeni!"))
 				http.Redirect(w, r, "/diary", http.StatusFound)
 			}
 		}
 	}
 
-	context := render.Context{
-		"subpage": subpage,
+	context := render.Context{
+		"subpage": subpage,
+	}
+
+	c.render.Template(w, r, "diary_subscribe.html", context)
+}
+
+// setGpsData fills gps data fields that are derived from data entries.
+func (c *Diary) setGpsData(gpsData *models.GpsData, dataEntries []models.DataEntry) error {
+	dataJSON, err := json.Marshal(dataEntries)
+	if err != nil {
+		return err
+	}
+
+	inc := 1
+	mapURL := ""
+	for {
+		coords := [][]float64{}
+		for i := 0; i < len(dataEntries); i += inc {
+			coords = append(coords, []float64{
+				float64(dataEntries[i].Latitude),
+				float64(dataEntries[i].Longitude),
+			})
+		}
+
+		mapURL = url.QueryEscape(string(polyline.EncodeCoords(coords)))
+		if len(mapURL) <= 1800 {
+			break
+		}
+
+		inc *= 2
+	}
+
+	start, err := c.getCity(
+		float64(dataEntries[0].Latitude),
+		float64(dataEntries[0].Longitude),
+	)
+	if err != nil {
+		return err
+	}
+	end, err := c.getCity(
+		float64(dataEntries[len(dataEntries)-1].Latitude),
+		float64(dataEntries[len(dataEntries)-1].Longitude),
+	)
+	if err != nil {
+		return err
+	}
+
+	gpsData.Start = start
+	gpsData.End = end
+	gpsData.Data = string(dataJSON)
+	gpsData.MapURL = mapURL
+
+	return gpsData.Precompute()
+}
+
+// setStravaGpsData fills gps data from a strava activity and its streams.
+func (c *Diary) setStravaGpsData(ctx context.Context, gpsData *models.GpsData, activityID int) (strava.Activity, error) {
+	activity, err := c.strava.Activity(ctx, activityID)
+	if err != nil {
+		return activity, err
+	}
+
+	points, err := c.strava.ActivityPoints(ctx, activityID)
+	if err != nil {
+		return activity, err
+	}
+
+	dataEntries := make([]models.DataEntry, 0, len(points))
+	for _, point := range points {
+		if point.Latitude == 0 || point.Longitude == 0 {
+			continue
+		}
+		dataEntry := models.DataEntry{
+			Time:      activity.StartDate.Add(time.Second * time.Duration(point.TimeOffset)),
+			Latitude:  models.Float(point.Latitude),
+			Longitude: models.Float(point.Longitude),
+			Distance:  models.Float(point.Distance / 1000),
+
+			HeartRate: models.Float(point.HeartRate),
+			Cadence:   models.Float(point.Cadence),
+			Power:     models.Float(point.Watts),
+		}
+		if point.HasAltitude {
+			dataEntry.Elevation = models.NewFloat(point.Altitude)
+		}
+		if point.HasTemperature {
+			dataEntry.Temperature = models.NewFloat(point.Temperature)
+		}
+		dataEntries = append(dataEntries, dataEntry)
+	}
+	if len(dataEntries) == 0 {
+		return activity, errors.Errorf("strava activity %d has no gps points", activityID)
+	}
+
+	if gpsData.Reversed {
+		models.ReverseEntries(dataEntries)
+	}
+
+	if err := c.setGpsData(gpsData, dataEntries); err != nil {
+		return activity, err
+	}
+
+	gpsData.Date = activity.StartDate
+	gpsData.Length = activity.Distance / 1000
+	gpsData.Duration = float64(activity.ElapsedTime)
+	gpsData.AvgSpeed = activity.AverageSpeed * 3.6
+	gpsData.WorkoutID = strconv.Itoa(activityID)
+	gpsData.ActivityType = activity.Type
+	// prefer strava computed metrics when available
+	if activity.TotalEleveationGain > 0 {
+		gpsData.SetRecordedAscent(activity.TotalEleveationGain, dataEntries)
+	}
+	if activity.MovingTime > 0 {
+		gpsData.MovingTime = float64(activity.MovingTime)
+	}
+
+	return activity, nil
+}
+
+// setReversed changes direction of already stored gps data, summary values
+// that do not depend on direction are kept and ascent and descent are swapped.
+func (c *Diary) setReversed(gpsData *models.GpsData, reversed bool) error {
+	if gpsData.Reversed == reversed || gpsData.Data == "" {
+		gpsData.Reversed = reversed
+		return nil
+	}
+
+	dataEntries, err := gpsData.DataEntries()
+	if err != nil {
+		return err
+	}
+	if len(dataEntries) == 0 {
+		return errors.New("gps data has no points")
+	}
+	models.ReverseEntries(dataEntries)
+
+	length, duration, avgSpeed, movingTime := gpsData.Length, gpsData.Duration, gpsData.AvgSpeed, gpsData.MovingTime
+	ascent, descent := gpsData.Descent, gpsData.Ascent
+	if err := c.setGpsData(gpsData, dataEntries); err != nil {
+		return err
+	}
+	gpsData.Length, gpsData.Duration, gpsData.AvgSpeed, gpsData.MovingTime = length, duration, avgSpeed, movingTime
+	gpsData.Ascent, gpsData.Descent = ascent, descent
+	gpsData.Reversed = reversed
+
+	return nil
+}
+
+// parseLocation parses manual coordinates, both empty means location is not
+// set manually.
+func parseLocation(lat, lon string) (float64, float64, bool, error) {
+	lat = strings.TrimSpace(lat)
+	lon = strings.TrimSpace(lon)
+	if lat == "" && lon == "" {
+		return 0, 0, false, nil
+	}
+
+	latitude, err := strconv.ParseFloat(strings.Replace(lat, ",", ".", 1), 64)
+	if err != nil || latitude < -90 || latitude > 90 {
+		return 0, 0, false, errors.Errorf("invalid latitude %q", lat)
+	}
+	longitude, err := strconv.ParseFloat(strings.Replace(lon, ",", ".", 1), 64)
+	if err != nil || longitude < -180 || longitude > 180 {
+		return 0, 0, false, errors.Errorf("invalid longitude %q", lon)
+	}
+
+	return latitude, longitude, true, nil
+}
+
+// locate sets coordinates of map entry, when the geocoder is unavailable the
+// entry is saved with old coordinates and queued for retryGeocoding.
+func (c *Diary) locate(ctx context.Context, mapEntry *models.MapEntry) error {
+	err := mapEntry.Locate(ctx, c.geocoder)
+	if err == nil || errors.Cause(err) == geocode.NoResultsError {
+		return err
+	}
+
+	c.log.Warn(errors.Wrap(err, "geocoding will be retried"))
+	mapEntry.GeocodePending = true
+	return nil
+}
+
+// retryGeocoding locates map entries whose geocoding failed, it returns number
+// of entries that are still pending.
+func (c *Diary) retryGeocoding(ctx context.Context) (int, error) {
+	var mapEntries []models.MapEntry
+	query := c.DB.Preload("Tracks", orderTracks).Where("geocode_pending = ?", true).Find(&mapEntries)
+	if query.Error != nil {
+		return 0, errors.Wrap(query.Error, "could not get pending map entries")
+	}
+
+	pending := 0
+	for _, mapEntry := range mapEntries {
+		err := mapEntry.Locate(ctx, c.geocoder)
+		if errors.Cause(err) == geocode.NoResultsError {
+			// retrying will not help, keep old coordinates
+			c.log.Warn(errors.Wrapf(err, "map entry %d", mapEntry.ID))
+			mapEntry.GeocodePending = false
+		} else if err != nil {
+			pending++
+			continue
+		}
+
+		err = c.DB.Model(&mapEntry).UpdateColumns(map[string]interface{}{
+			"lat":             mapEntry.Lat,
+			"lon":             mapEntry.Lon,
+			"geocode_pending": false,
+		}).Error
+		if err != nil {
+			return pending, errors.Wrapf(err, "could not save map entry %d", mapEntry.ID)
+		}
+	}
+
+	return pending, nil
+}
+
+// retryGeocodingLoop periodically retries failed geocoding until the
+// application exits.
+func (c *Diary) retryGeocodingLoop(interval time.Duration) {
+	for range time.Tick(interval) {
+		pending, err := c.retryGeocoding(context.Background())
+		if err != nil {
+			c.log.Error(err)
+		} else if pending > 0 {
+			c.log.Warnf("Geocoding of %d map entries is still pending", pending)
+		}
+	}
+}
+
+// parseTrack decodes an uploaded track file.
+func parseTrack(header *multipart.FileHeader) ([]models.DataEntry, error) {
+	file, err := header.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return tracks.Parse(header.Filename, file)
+}
+
+// hasWorkout reports whether strava workout is already one of the tracks.
+func hasWorkout(gpsTracks []models.GpsData, workoutID string) bool {
+	for _, gpsData := range gpsTracks {
+		if gpsData.WorkoutID == workoutID {
+			return true
+		}
+	}
+	return false
+}
+
+// orderTracks preloads tracks of a map entry in the order they were recorded.
+func orderTracks(db *gorm.DB) *gorm.DB {
+	return db.Order("gps_data.date, gps_data.id")
+}
+
+// orderTags preloads tags of an entry by name.
+func orderTags(db *gorm.DB) *gorm.DB {
+	return db.Order("tags.name")
+}
+
+// importStravaPhotos appends photos of strava activity to entry images,
+// photos that were already imported are skipped.
+func (c *Diary) importStravaPhotos(ctx context.Context, diaryEntry *models.DiaryEntry, activityID int) error {
+	photos, err := c.strava.ActivityPhotos(ctx, activityID)
+	if err != nil {
+		return err
+	}
+
+	var images []files.Image
+	if err := c.DB.Model(diaryEntry).Association("Images").Find(&images).Error; err != nil {
+		return errors.Wrap(err, "could not get entry images")
+	}
+	imported := map[string]bool{}
+	for _, image := range images {
+		imported[image.Name] = true
+	}
+
+	for _, photo := range photos {
+		if photo.UniqueID == "" {
+			continue
+		}
+		name := fmt.Sprintf("strava-%s.jpg", photo.UniqueID)
+		if imported[name] {
+			continue
+		}
+
+		data, err := c.strava.DownloadPhoto(ctx, photo)
+		if err != nil {
+			return err
+		}
+
+		img, err := c.files.NewImage(bytes.NewReader(data), name, photo.Caption)
+		if err != nil {
+			return err
+		}
+
+		if err := c.DB.Model(diaryEntry).Association("Images").Append(img).Error; err != nil {
+			return errors.Wrap(err, "could not append image")
+		}
+		imported[name] = true
+	}
+
+	return nil
+}
+
+func (c *Diary) latestMapGroupID() (uint, error) {
+	mapGroupIDs := []uint{}
+	if err := c.DB.Model(&models.MapGroup{}).Order("id desc").Limit(1).Pluck("id", &mapGroupIDs).Error; err != nil {
+		return 0, errors.Wrap(err, "could not get map group")
+	}
+	if len(mapGroupIDs) == 0 {
+		return 0, errors.New("no map groups")
+	}
+	return mapGroupIDs[0], nil
+}
+
+// createStravaDraft creates an unpublished entry for a new strava activity,
+// it is called from strava webhook with "user" and "activityID" in context.
+func (c *Diary) createStravaDraft(ctx context.Context) error {
+	user := ctx.Value("user").(authorization.User)
+	activityID := ctx.Value("activityID").(int)
+
+	if !c.CanCreate(user) {
+		return nil
+	}
+
+	// activity could already be added to an entry by hand
+	var count int
+	query := c.DB.Model(&models.GpsData{}).Where("endomondo_id = ?", strconv.Itoa(activityID)).Count(&count)
+	if query.Error != nil {
+		return errors.Wrap(query.Error, "could not check existing gps data")
+	}
+	if count > 0 {
+		return nil
+	}
+
+	// strava can deliver the same event more than once, also concurrently
+	claimed, err := models.ClaimStravaImport(c.DB, activityID, time.Now())
+	if err != nil {
+		return errors.Wrap(err, "could not claim strava import")
+	}
+	if !claimed {
+		return nil
+	}
+
+	diaryEntry, err := c.saveStravaDraft(ctx, user, activityID)
+	if err != nil {
+		// let a later event retry when the entry was not saved
+		if diaryEntry.ID == 0 {
+			if err := models.ReleaseStravaImport(c.DB, activityID); err != nil {
+				c.log.Error(errors.Wrapf(err, "could not release strava import of activity %d", activityID))
+			}
+		}
+		return err
+	}
+
+	if err := c.importStravaPhotos(ctx, &diaryEntry, activityID); err != nil {
+		return errors.Wrap(err, "could not import strava photos")
 	}
 
-	c.render.Template(w, r, "diary_subscribe.html", context)
+	return nil
 }
 
-func reverseEntries(entries []models.DataEntry) {
-	startTime := entries[0].Time
-	for i := len(entries)/2 - 1; i >= 0; i-- {
-		opp := len(entries) - 1 - i
-		entries[i], entries[opp] = entries[opp], entries[i]
+// saveStravaDraft saves an unpublished entry with the track of strava activity.
+func (c *Diary) saveStravaDraft(ctx context.Context, user authorization.User, activityID int) (models.DiaryEntry, error) {
+	diaryEntry := models.DiaryEntry{
+		AuthorID: user.ID,
 	}
-	endTime := entries[0].Time
-	totalDistance := entries[0].Distance
-	for i := range entries {
-		entries[i].Time = startTime.Add(endTime.Sub(entries[i].Time))
-		entries[i].Distance = totalDistance - entries[i].Distance
+	gpsData := models.GpsData{}
+	activity, err := c.setStravaGpsData(ctx, &gpsData, activityID)
+	if err != nil {
+		return diaryEntry, err
+	}
+	diaryEntry.MapEntry.Tracks = []models.GpsData{gpsData}
+
+	mapGroupID, err := c.latestMapGroupID()
+	if err != nil {
+		return diaryEntry, err
+	}
+	diaryEntry.MapEntry.MapGroupID = mapGroupID
+	if err := c.locate(ctx, &diaryEntry.MapEntry); err != nil {
+		return diaryEntry, err
+	}
+
+	diaryEntry.Title = activity.Name
+	// strava description is plain text
+	diaryEntry.Format = models.FormatMarkdown
+	diaryEntry.Text = activity.Description
+	if diaryEntry.Text == "" {
+		diaryEntry.Text = activity.Name
+	}
+
+	if err := c.DB.Save(&diaryEntry).Error; err != nil {
+		return diaryEntry, errors.Wrap(err, "could not save draft entry")
+	}
+
+	if err := c.recordRevision(models.DiaryEntry{}, diaryEntry, user.ID); err != nil {
+		return diaryEntry, err
 	}
+
+	return diaryEntry, nil
 }
 
 func (c *Diary) EditHandler(w http.ResponseWriter, r *http.Request) {
@@ -354,7 +1044,7 @@ func (c *Diary) EditHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		query := c.DB.Preload("MapEntry.GpsData").First(&diaryEntry, id)
+		query := c.DB.Preload("MapEntry.Tracks", orderTracks).Preload("Tags", orderTags).First(&diaryEntry, id)
 		if !query.RecordNotFound() && query.Error != nil {
 			c.render.Error(w, r, query.Error)
 			return
@@ -373,122 +1063,225 @@ func (c *Diary) EditHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if r.Method == "POST" {
+		r.Body = http.MaxBytesReader(w, r.Body, 20*1024*1024)
+
+		previous := diaryEntry
+
 		// TODO: can we use some kind of apply for this (like gobuffalo)
 		diaryEntry.Title = r.FormValue("title")
+		diaryEntry.Format = models.FormatHTML
+		if r.FormValue("format") == models.FormatMarkdown {
+			diaryEntry.Format = models.FormatMarkdown
+		}
 		diaryEntry.Text = r.FormValue("content")
+		if diaryEntry.Format == models.FormatHTML {
+			diaryEntry.Text = models.Sanitize(diaryEntry.Text)
+		}
 		diaryEntry.MapEntry.City = r.FormValue("city")
 
+		latitude, longitude, manualLocation, err := parseLocation(r.FormValue("lat"), r.FormValue("lon"))
+		if err != nil {
+			if err := c.render.AddFlash(w, r, flash.Error(fmt.Sprintf("Neveljavne koordinate: %v", err))); err != nil {
+				c.render.Error(w, r, err)
+				return
+			}
+			c.renderEdit(w, r, diaryEntry, subpage)
+			return
+		}
+		diaryEntry.MapEntry.ManualLocation = manualLocation
+		if manualLocation {
+			diaryEntry.MapEntry.Lat = latitude
+			diaryEntry.MapEntry.Lon = longitude
+		}
+
+		if !diaryEntry.Published {
+			publishAt, err := models.ParsePublishAt(r.FormValue("publish_at"))
+			if err != nil {
+				if err := c.render.AddFlash(w, r, flash.Error("Neveljaven čas objave.")); err != nil {
+					c.render.Error(w, r, err)
+					return
+				}
+				c.renderEdit(w, r, diaryEntry, subpage)
+				return
+			}
+			diaryEntry.PublishAt = publishAt
+		}
+
 		if entryID == "" {
 			diaryEntry.AuthorID = r.Context().Value("user").(authorization.User).ID
 		}
 
 		workout := r.FormValue("workout")
+		reversed := r.FormValue("reversed") != ""
+		activityType := r.FormValue("activity_type")
+		attachedActivityID := 0
+		previousEnd := diaryEntry.MapEntry.LastTrack().End
+
+		// existing tracks can be removed, reversed or get another activity type
+		removeTracks := map[string]bool{}
+		for _, id := range r.Form["remove_track"] {
+			removeTracks[id] = true
+		}
+		reversedTracks := map[string]bool{}
+		for _, id := range r.Form["reversed_track"] {
+			reversedTracks[id] = true
+		}
+
+		removedTrackIDs := []uint{}
+		gpsTracks := make([]models.GpsData, 0, len(diaryEntry.MapEntry.Tracks))
+		for _, gpsData := range diaryEntry.MapEntry.Tracks {
+			id := strconv.Itoa(int(gpsData.ID))
+			if removeTracks[id] {
+				removedTrackIDs = append(removedTrackIDs, gpsData.ID)
+				continue
+			}
 
-		if (diaryEntry.MapEntry.City != "" || workout != "") && diaryEntry.MapEntry.MapGroupID == 0 {
-			mapGroupIDs := []uint{}
-			if err := c.DB.Model(&models.MapGroup{}).Order("id desc").Limit(1).Pluck("id", &mapGroupIDs).Error; err != nil {
+			if err := c.setReversed(&gpsData, reversedTracks[id]); err != nil {
 				c.render.Error(w, r, err)
 				return
 			}
-			diaryEntry.MapEntry.MapGroupID = mapGroupIDs[0]
+			if value := r.FormValue("activity_type_" + id); value != "" {
+				gpsData.ActivityType = value
+			}
+			gpsTracks = append(gpsTracks, gpsData)
 		}
 
-		if workout != "" && workout != diaryEntry.MapEntry.GpsData.WorkoutID {
-			activityID, err := strconv.Atoi(workout)
+		var trackHeaders []*multipart.FileHeader
+		if r.MultipartForm != nil {
+			trackHeaders = r.MultipartForm.File["track"]
+		}
+		for _, trackHeader := range trackHeaders {
+			trackEntries, err := parseTrack(trackHeader)
 			if err != nil {
-				c.render.Error(w, r, err)
+				if err := c.render.AddFlash(w, r, flash.Error(fmt.Sprintf("Neveljavna datoteka s sledjo %s: %v", trackHeader.Filename, err))); err != nil {
+					c.render.Error(w, r, err)
+					return
+				}
+				c.renderEdit(w, r, diaryEntry, subpage)
 				return
 			}
 
-			activity, err := c.strava.Activity(r.Context(), activityID)
-			if err != nil {
+			if reversed {
+				models.ReverseEntries(trackEntries)
+			}
+			gpsData := models.GpsData{
+				Reversed:     reversed,
+				ActivityType: activityType,
+			}
+			if err := c.setGpsData(&gpsData, trackEntries); err != nil {
 				c.render.Error(w, r, err)
 				return
 			}
 
-			points, err := c.strava.ActivityPoints(r.Context(), activityID)
+			gpsData.Date = trackEntries[0].Time
+			if gpsData.Date.IsZero() {
+				gpsData.Date = time.Now()
+			}
+			gpsData.Length, gpsData.Duration, gpsData.AvgSpeed = tracks.Summary(trackEntries)
+			gpsTracks = append(gpsTracks, gpsData)
+		}
+
+		if workout != "" && !hasWorkout(gpsTracks, workout) {
+			activityID, err := strconv.Atoi(workout)
 			if err != nil {
 				c.render.Error(w, r, err)
 				return
 			}
 
-			dataEntries := make([]models.DataEntry, 0, len(points))
-			for _, point := range points {
-				if point.Latitude == 0 || point.Longitude == 0 {
-					continue
-				}
-				dataEntries = append(dataEntries, models.DataEntry{
-					Time:      activity.StartDate.Add(time.Second * time.Duration(point.TimeOffset)),
-					Latitude:  models.Float(point.Latitude),
-					Longitude: models.Float(point.Longitude),
-					Elevation: models.Float(point.Altitude),
-					Distance:  models.Float(point.Distance / 1000),
-				})
-			}
-			// Reverse for biking (going down)
-			if activity.Type == "Ride" {
-				reverseEntries(dataEntries)
+			gpsData := models.GpsData{
+				Reversed: reversed,
 			}
-			dataJSON, err := json.Marshal(dataEntries)
-			if err != nil {
+			if _, err := c.setStravaGpsData(r.Context(), &gpsData, activityID); err != nil {
 				c.render.Error(w, r, err)
 				return
 			}
+			if activityType != "" {
+				gpsData.ActivityType = activityType
+			}
+			gpsTracks = append(gpsTracks, gpsData)
+			attachedActivityID = activityID
+		}
 
-			inc := 1
-			mapURL := ""
-			for {
-				coords := [][]float64{}
-				for i := 0; i < len(dataEntries); i += inc {
-					coords = append(coords, []float64{
-						float64(dataEntries[i].Latitude),
-						float64(dataEntries[i].Longitude),
-					})
-				}
-
-				mapURL = url.QueryEscape(string(polyline.EncodeCoords(coords)))
-				if len(mapURL) <= 1800 {
-					break
-				}
+		sort.SliceStable(gpsTracks, func(i, j int) bool {
+			return gpsTracks[i].Date.Before(gpsTracks[j].Date)
+		})
+		diaryEntry.MapEntry.Tracks = gpsTracks
 
-				inc *= 2
-			}
+		// city that was taken from the last track follows the new last track,
+		// without tracks it is kept and located again
+		if previousEnd != "" && diaryEntry.MapEntry.City == previousEnd && len(gpsTracks) > 0 {
+			diaryEntry.MapEntry.City = ""
+		}
 
-			start, err := c.getCity(
-				float64(dataEntries[0].Latitude),
-				float64(dataEntries[0].Longitude),
-			)
+		if (diaryEntry.MapEntry.City != "" || len(gpsTracks) > 0) && diaryEntry.MapEntry.MapGroupID == 0 {
+			mapGroupID, err := c.latestMapGroupID()
 			if err != nil {
 				c.render.Error(w, r, err)
 				return
 			}
-			end, err := c.getCity(
-				float64(dataEntries[len(dataEntries)-1].Latitude),
-				float64(dataEntries[len(dataEntries)-1].Longitude),
-			)
-			if err != nil {
+			diaryEntry.MapEntry.MapGroupID = mapGroupID
+		}
+
+		if err := c.locate(r.Context(), &diaryEntry.MapEntry); errors.Cause(err) == geocode.NoResultsError {
+			if err := c.render.AddFlash(w, r, flash.Error(fmt.Sprintf("Kraja %s ni mogoče najti, vnesite koordinate.", diaryEntry.MapEntry.City))); err != nil {
 				c.render.Error(w, r, err)
 				return
 			}
+			c.renderEdit(w, r, diaryEntry, subpage)
+			return
+		} else if err != nil {
+			c.render.Error(w, r, err)
+			return
+		}
 
-			diaryEntry.MapEntry.GpsData.Start = start
-			diaryEntry.MapEntry.GpsData.End = end
-			diaryEntry.MapEntry.GpsData.Date = activity.StartDate
-			diaryEntry.MapEntry.GpsData.Length = activity.Distance / 1000
-			diaryEntry.MapEntry.GpsData.Duration = float64(activity.ElapsedTime)
-			diaryEntry.MapEntry.GpsData.AvgSpeed = activity.AverageSpeed * 3.6
-			diaryEntry.MapEntry.GpsData.WorkoutID = workout
-			diaryEntry.MapEntry.GpsData.Data = string(dataJSON)
-			diaryEntry.MapEntry.GpsData.MapURL = mapURL
+		tags, err := models.FindOrCreateTags(c.DB, models.ParseTags(r.FormValue("tags")))
+		if err != nil {
+			c.render.Error(w, r, errors.Wrap(err, "could not save tags"))
+			return
 		}
+		diaryEntry.Tags = tags
 
-		if err := c.DB.Save(&diaryEntry).Error; err != nil {
-			if err := c.render.AddFlash(w, r, FlashError(err.Error())); err != nil {
+		db := c.DB
+		if diaryEntry.ID != 0 {
+			// publication is changed only by PublishHandler and the scheduler
+			db = db.Omit("published", "published_at", "notified_at", "notify_claimed_at")
+		}
+		if err := db.Save(&diaryEntry).Error; err != nil {
+			if err := c.render.AddFlash(w, r, flash.Error(err.Error())); err != nil {
 				c.render.Error(w, r, err)
 				return
 			}
 		} else {
-			if err := c.render.AddFlash(w, r, FlashInfo("Vnos shranjen!")); err != nil {
+			editorID := r.Context().Value("user").(authorization.User).ID
+			if err := c.recordRevision(previous, diaryEntry, editorID); err != nil {
+				c.render.Error(w, r, err)
+				return
+			}
+
+			// save only adds tags, removed ones are unlinked here
+			if err := c.DB.Model(&diaryEntry).Association("Tags").Replace(tags).Error; err != nil {
+				c.render.Error(w, r, errors.Wrap(err, "could not update tags"))
+				return
+			}
+
+			if len(removedTrackIDs) > 0 {
+				if err := c.DB.Where("id IN (?)", removedTrackIDs).Delete(&models.GpsData{}).Error; err != nil {
+					c.render.Error(w, r, errors.Wrap(err, "could not remove tracks"))
+					return
+				}
+			}
+
+			if attachedActivityID != 0 {
+				if err := c.importStravaPhotos(r.Context(), &diaryEntry, attachedActivityID); err != nil {
+					c.log.Error(errors.Wrap(err, "could not import strava photos"))
+					if err := c.render.AddFlash(w, r, flash.Error("Slik s Strave ni bilo mogoče uvoziti!")); err != nil {
+						c.render.Error(w, r, err)
+						return
+					}
+				}
+			}
+
+			if err := c.render.AddFlash(w, r, flash.Info("Vnos shranjen!")); err != nil {
 				c.render.Error(w, r, err)
 				return
 			}
@@ -498,16 +1291,59 @@ func (c *Diary) EditHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	activities, err := c.strava.RecentActivities(r.Context())
-	if err != nil && err != strava.NoTokenError {
-		c.render.Error(w, r, err)
-		return
+	c.renderEdit(w, r, diaryEntry, subpage)
+}
+
+// workouts returns a page of strava activities that are not linked to any
+// diary entry yet, options are read from page, type, before and after query
+// parameters.
+func (c *Diary) workouts(r *http.Request) ([]models.Workout, bool, error) {
+	query := r.URL.Query()
+	options := strava.ActivitiesOptions{
+		Type: query.Get("type"),
+	}
+	if page, err := strconv.Atoi(query.Get("page")); err == nil && page > 0 {
+		options.Page = page
+	}
+	if before, err := time.Parse("2006-01-02", query.Get("before")); err == nil {
+		// before day is included
+		options.Before = before.Add(24 * time.Hour)
+	}
+	if after, err := time.Parse("2006-01-02", query.Get("after")); err == nil {
+		options.After = after
+	}
+
+	activities, more, err := c.strava.Activities(r.Context(), options)
+	if err != nil {
+		return nil, false, err
+	}
+
+	ids := make([]string, 0, len(activities))
+	for _, activity := range activities {
+		ids = append(ids, strconv.Itoa(activity.ID))
+	}
+	linked := []string{}
+	if len(ids) > 0 {
+		err := c.DB.Model(&models.GpsData{}).
+			Where("endomondo_id IN (?)", ids).
+			Pluck("endomondo_id", &linked).Error
+		if err != nil {
+			return nil, false, errors.Wrap(err, "could not get linked workouts")
+		}
+	}
+	isLinked := map[string]bool{}
+	for _, id := range linked {
+		isLinked[id] = true
 	}
 
 	workouts := []models.Workout{}
 	for _, activity := range activities {
+		id := strconv.Itoa(activity.ID)
+		if isLinked[id] {
+			continue
+		}
 		workouts = append(workouts, models.Workout{
-			ID: strconv.Itoa(activity.ID),
+			ID: id,
 			Description: fmt.Sprintf("%s: %s %.1f km v %.1f urah",
 				activity.Name,
 				activity.StartDate.Format("2. 1. 2006"),
@@ -517,11 +1353,66 @@ func (c *Diary) EditHandler(w http.ResponseWriter, r *http.Request) {
 		})
 	}
 
+	return workouts, more, nil
+}
+
+func (c *Diary) WorkoutsHandler(w http.ResponseWriter, r *http.Request) {
+	if !c.CanCreate(r.Context().Value("user")) {
+		c.render.Forbidden(w, r)
+		return
+	}
+
+	workouts, more, err := c.workouts(r)
+	if rateLimitedErr, ok := errors.Cause(err).(*strava.RateLimitedError); ok {
+		w.Header().Set("Content-Type", "application/json")
+		retryAfter := int(math.Ceil(time.Until(rateLimitedErr.Until).Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		w.WriteHeader(http.StatusTooManyRequests)
+		json.NewEncoder(w).Encode(map[string]string{
+			"error": "Strava trenutno ne sprejema zahtev, poskusite znova čez nekaj minut.",
+		})
+		return
+	} else if err != nil && err != strava.NoTokenError {
+		c.render.Error(w, r, err)
+		return
+	}
+
+	response := struct {
+		Workouts []models.Workout `json:"workouts"`
+		More     bool             `json:"more"`
+	}{
+		Workouts: workouts,
+		More:     more,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		c.render.Error(w, r, err)
+		return
+	}
+}
+
+func (c *Diary) renderEdit(w http.ResponseWriter, r *http.Request, diaryEntry models.DiaryEntry, subpage string) {
+	stravaRateLimited := false
+	workouts, moreWorkouts, err := c.workouts(r)
+	if _, ok := errors.Cause(err).(*strava.RateLimitedError); ok {
+		stravaRateLimited = true
+	} else if err != nil && err != strava.NoTokenError {
+		c.render.Error(w, r, err)
+		return
+	}
+	stravaConnected := err != strava.NoTokenError
+
 	context := render.Context{
-		"entry":       diaryEntry,
-		"subpage":     subpage,
-		"workouts":    workouts,
-		"browser_key": viper.GetString("GMAP_BROWSER_KEY"),
+		"entry":         diaryEntry,
+		"subpage":       subpage,
+		"workouts":      workouts,
+		"more_workouts": moreWorkouts,
+		"types":         models.ActivityTypes,
+		"browser_key":   viper.GetString("GMAP_BROWSER_KEY"),
+
+		"strava_connected":    stravaConnected,
+		"strava_rate_limited": stravaRateLimited,
 	}
 
 	c.render.Template(w, r, "diary_edit.html", context)
@@ -570,7 +1461,7 @@ func (c *Diary) DeletePictureHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := c.render.AddFlash(w, r, FlashInfo("Slike izbrisana!")); err != nil {
+	if err := c.render.AddFlash(w, r, flash.Info("Slike izbrisana!")); err != nil {
 		c.render.Error(w, r, err)
 		return
 	}
@@ -622,7 +1513,7 @@ func (c *Diary) AddPictureHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := c.render.AddFlash(w, r, FlashInfo("Slika dodana!")); err != nil {
+	if err := c.render.AddFlash(w, r, flash.Info("Slika dodana!")); err != nil {
 		c.render.Error(w, r, err)
 		return
 	}
@@ -699,7 +1590,7 @@ func (c *Diary) CommentHandler(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		// TODO: figure better way for handling validation errors for bigger forms
 		if _, ok := err.(govalidator.Errors); ok {
-			if err := c.render.AddFlash(w, r, FlashError("Vpisati morate vaš komentar!")); err != nil {
+			if err := c.render.AddFlash(w, r, flash.Error("Vpisati morate vaš komentar!")); err != nil {
 				c.render.Error(w, r, err)
 				return
 			}
@@ -709,7 +1600,7 @@ func (c *Diary) CommentHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := c.render.AddFlash(w, r, FlashInfo("Komentar objavljen!")); err != nil {
+	if err := c.render.AddFlash(w, r, flash.Info("Komentar objavljen!")); err != nil {
 		c.render.Error(w, r, err)
 		return
 	}
@@ -730,7 +1621,7 @@ func (c *Diary) ReadHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := c.render.AddFlash(w, r, FlashInfo("Vsi vnosi označeni kot prebrani!")); err != nil {
+	if err := c.render.AddFlash(w, r, flash.Info("Vsi vnosi označeni kot prebrani!")); err != nil {
 		c.render.Error(w, r, err)
 		return
 	}
@@ -752,7 +1643,8 @@ func (c *Diary) ViewHandler(w http.ResponseWriter, r *http.Request) {
 			return db.Order("comments.created_at desc")
 		}).
 		Preload("Comments.Author").
-		Preload("MapEntry.GpsData").
+		Preload("MapEntry.Tracks", orderTracks).
+		Preload("Tags", orderTags).
 		Preload("Images", func(db *gorm.DB) *gorm.DB {
 			return db.Order("images.created_at")
 		}).
@@ -769,10 +1661,10 @@ func (c *Diary) ViewHandler(w http.ResponseWriter, r *http.Request) {
 	var totalDistance []float64
 	query = c.DB.Model(&models.DiaryEntry{}).
 		Select("COALESCE(SUM(gd1.length), 0) as total_distance").
-		Where("date_part('year', diary_entries.created_at) = ?", entry.CreatedAt.Year()).
-		Where("diary_entries.created_at <= ?", entry.CreatedAt).
+		Where("date_part('year', "+models.DateColumn+") = ?", entry.Date().Year()).
+		Where(models.DateColumn+" <= ?", entry.Date()).
 		Joins("LEFT JOIN map_entries me1 ON diary_entries.map_entry_id = me1.id").
-		Joins("LEFT JOIN gps_data gd1 ON me1.gps_data_id = gd1.id").
+		Joins("LEFT JOIN gps_data gd1 ON gd1.map_entry_id = me1.id AND gd1.deleted_at IS NULL").
 		Pluck("total_distance", &totalDistance)
 
 	if err := query.Error; err != nil {
@@ -823,6 +1715,49 @@ func (c *Diary) ViewHandler(w http.ResponseWriter, r *http.Request) {
 	c.render.Template(w, r, "diary_one.html", context)
 }
 
+func (c *Diary) TrackHandler(w http.ResponseWriter, r *http.Request) {
+	var entry models.DiaryEntry
+
+	id, err := strconv.Atoi(chi.URLParam(r, "diaryID"))
+	if err != nil {
+		c.render.NotFound(w, r)
+		return
+	}
+
+	query := c.DB.Preload("MapEntry.Tracks", orderTracks).First(&entry, id)
+	if query.RecordNotFound() {
+		c.render.NotFound(w, r)
+		return
+	} else if err := query.Error; err != nil {
+		c.render.Error(w, r, errors.Wrap(err, "could not get diary entry"))
+		return
+	} else if len(entry.MapEntry.Tracks) == 0 || !c.CanSee(entry, r.Context().Value("user")) {
+		c.render.NotFound(w, r)
+		return
+	}
+
+	gpsTracks := make([]tracks.Track, 0, len(entry.MapEntry.Tracks))
+	for _, gpsData := range entry.MapEntry.Tracks {
+		dataEntries, err := gpsData.DataEntries()
+		if err != nil {
+			c.render.Error(w, r, err)
+			return
+		}
+		gpsTracks = append(gpsTracks, tracks.Track{
+			Name:    fmt.Sprintf("%s - %s", gpsData.Start, gpsData.End),
+			Entries: dataEntries,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/gpx+xml")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"diary-%d.gpx\"", entry.ID))
+	err = tracks.WriteGPX(w, entry.Title, nil, gpsTracks)
+	if err != nil {
+		c.render.Error(w, r, err)
+		return
+	}
+}
+
 func (c *Diary) ListHandler(w http.ResponseWriter, r *http.Request) {
 	yearStr := r.URL.Query().Get("year")
 
@@ -835,7 +1770,7 @@ func (c *Diary) ListHandler(w http.ResponseWriter, r *http.Request) {
 	if r.URL.Path == "/" {
 		var year []int
 		query := c.DB.Model(&models.DiaryEntry{}).
-			Select("DISTINCT date_part('year', created_at) as year").
+			Select("DISTINCT date_part('year', "+models.DateColumn+") as year").
 			Where("published = ? or author_id = ?", true, userID).
 			Order("year desc").
 			Limit(1).
@@ -849,29 +1784,73 @@ func (c *Diary) ListHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	query := c.listQuery(r)
+
+	var yearItf interface{}
+	pageURL := "/diary?"
+	if yearStr != "" {
+		year, err := strconv.Atoi(yearStr)
+		if err != nil {
+			c.render.Error(w, r, errors.Wrap(err, "invalid year"))
+			return
+		}
+		query = query.Where("date_part('year', "+models.DateColumn+") = ?", year)
+		yearItf = year
+		pageURL = fmt.Sprintf("/diary?year=%d&", year)
+	}
+
+	c.renderList(w, r, query, render.Context{
+		"year":    yearItf,
+		"pageURL": pageURL,
+	})
+}
+
+func (c *Diary) TagHandler(w http.ResponseWriter, r *http.Request) {
+	var tag models.Tag
+	query := c.DB.Where("slug = ?", chi.URLParam(r, "slug")).First(&tag)
+	if query.RecordNotFound() {
+		c.render.NotFound(w, r)
+		return
+	} else if query.Error != nil {
+		c.render.Error(w, r, query.Error)
+		return
+	}
+
+	query = c.listQuery(r).
+		Where("diary_entries.id IN (SELECT diary_entry_id FROM diary_entry_tags WHERE tag_id = ?)", tag.ID)
+
+	c.renderList(w, r, query, render.Context{
+		"subpage": tag.Name,
+		"tag":     tag,
+		"pageURL": fmt.Sprintf("/diary/tag/%s?", tag.Slug),
+	})
+}
+
+// listQuery returns query over diary entries the user can see, newest first.
+func (c *Diary) listQuery(r *http.Request) *gorm.DB {
 	query := c.DB.Model(&models.DiaryEntry{}).
 		Select("*").
 		Preload("Author").
+		Preload("Tags", orderTags).
 		Preload("Images", func(db *gorm.DB) *gorm.DB {
 			return db.Order("diary_entry_id, RANDOM()").Select("distinct on (diary_entry_id) *")
 		}).
-		Order("created_at desc")
+		Order(models.DateColumn + " desc")
 
 	if !c.CanSeeUnpublished(r.Context().Value("user")) {
+		userID := -1
+		if r.Context().Value("user") != nil {
+			userID = int(r.Context().Value("user").(authorization.User).ID)
+		}
 		query = query.Where("published = ? or author_id = ?", true, userID)
 	}
 
-	var yearItf interface{}
-	if yearStr != "" {
-		year, err := strconv.Atoi(yearStr)
-		if err != nil {
-			c.render.Error(w, r, errors.Wrap(err, "invalid year"))
-			return
-		}
-		query = query.Where("date_part('year', created_at) = ?", year)
-		yearItf = year
-	}
+	return query
+}
 
+// renderList renders a page of entries from query with comment counts and
+// unread markers, context is extended with entries and paging.
+func (c *Diary) renderList(w http.ResponseWriter, r *http.Request, query *gorm.DB, context render.Context) {
 	// paging
 	var count int
 	if err := query.Count(&count).Error; err != nil {
@@ -943,16 +1922,80 @@ func (c *Diary) ListHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	context["multiView"] = true
+	context["entries"] = entries
+	context["hasUnread"] = hasUnread
+	context["offset"] = offset
+	context["pages"] = pages
+	context["prevOffset"] = prevOffset
+	context["nextOffset"] = nextOffset
+
+	c.render.Template(w, r, "diary_all.html", context)
+}
+
+func (c *Diary) SearchHandler(w http.ResponseWriter, r *http.Request) {
+	if !c.searchEnabled {
+		c.render.NotFound(w, r)
+		return
+	}
+
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
 	context := render.Context{
-		"multiView":  true,
-		"entries":    entries,
-		"hasUnread":  hasUnread,
-		"offset":     offset,
-		"pages":      pages,
-		"prevOffset": prevOffset,
-		"nextOffset": nextOffset,
-		"year":       yearItf,
+		"subpage": "Iskanje",
+		"q":       q,
+	}
+	if q == "" {
+		c.render.Template(w, r, "diary_search.html", context)
+		return
 	}
 
-	c.render.Template(w, r, "diary_all.html", context)
+	userID := -1
+	if r.Context().Value("user") != nil {
+		userID = int(r.Context().Value("user").(authorization.User).ID)
+	}
+
+	query := models.Search(c.DB, q).Preload("Author")
+	if !c.CanSeeUnpublished(r.Context().Value("user")) {
+		query = query.Where("diary_entries.published = ? or diary_entries.author_id = ?", true, userID)
+	}
+
+	// paging
+	var count int
+	if err := query.Count(&count).Error; err != nil {
+		c.render.Error(w, r, errors.Wrap(err, "could not count search results"))
+		return
+	}
+	pages := make([]int, (count+PerPage-1)/PerPage)
+	for i := range pages {
+		pages[i] = PerPage * i
+	}
+
+	offset := 0
+	if r.URL.Query().Get("offset") != "" {
+		var err error
+		offset, err = strconv.Atoi(r.URL.Query().Get("offset"))
+		if err != nil {
+			c.render.Error(w, r, errors.Wrap(err, "invalid offset"))
+			return
+		}
+		query = query.Offset(offset)
+	}
+
+	var entries []models.DiaryEntry
+	if err := query.Limit(PerPage).Find(&entries).Error; err != nil {
+		c.render.Error(w, r, errors.Wrap(err, "could not search diary entries"))
+		return
+	}
+	for i := range entries {
+		entries[i].Snippet = models.Highlight(entries[i].Snippet)
+	}
+
+	context["entries"] = entries
+	context["count"] = count
+	context["offset"] = offset
+	context["pages"] = pages
+	context["prevOffset"] = offset - PerPage
+	context["nextOffset"] = offset + PerPage
+
+	c.render.Template(w, r, "diary_search.html", context)
 }
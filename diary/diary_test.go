@@ -0,0 +1,390 @@
+package diary
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/gorilla/sessions"
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"github.com/matematik7/gongo"
+	"github.com/matematik7/gongo/authorization"
+	"github.com/matematik7/gongo/files"
+	"github.com/matematik7/gongo/render"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/matematik7/camino-go/diary/models"
+	"github.com/matematik7/camino-go/geocode"
+	"github.com/matematik7/camino-go/strava"
+)
+
+// stubGeocoder names every place Leon, searches fail while err is set.
+type stubGeocoder struct {
+	err      error
+	searches int
+}
+
+func (g *stubGeocoder) Reverse(ctx context.Context, latitude, longitude float64) (geocode.Place, error) {
+	return geocode.Place{Name: "Leon", Latitude: latitude, Longitude: longitude}, nil
+}
+
+func (g *stubGeocoder) Search(ctx context.Context, address string) (geocode.Place, error) {
+	g.searches++
+	if g.err != nil {
+		return geocode.Place{}, g.err
+	}
+	return geocode.Place{Name: address, Latitude: 42.5987, Longitude: -5.5671}, nil
+}
+
+// newTestDiary returns diary with a sqlite database in a temporary directory
+// and a map group for new entries.
+func newTestDiary(t *testing.T) (*Diary, *stubGeocoder) {
+	DB, err := gorm.Open("sqlite3", filepath.Join(t.TempDir(), "diary.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { DB.Close() })
+
+	c := New()
+	resources := append(c.Resources(),
+		&authorization.User{},
+		&authorization.Group{},
+		&authorization.Permission{},
+		&files.Image{},
+		&models.MapEntry{},
+		&models.MapGroup{},
+		&models.GpsData{},
+		&strava.StravaUserTokens{},
+	)
+	if err := DB.AutoMigrate(resources...).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := DB.Save(&models.MapGroup{Name: "Camino"}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	log := logrus.New()
+	log.Out = ioutil.Discard
+
+	// handlers render only the error page in tests
+	templates := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(templates, "error.html"), []byte("{{ title }}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c.render = render.New(false)
+	c.render.AddTemplates(http.Dir(templates))
+	err = c.render.Configure(gongo.App{
+		"Log":   log,
+		"Store": sessions.NewCookieStore([]byte("test")),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	geocoder := &stubGeocoder{}
+	c.DB = DB
+	c.log = log
+	c.geocoder = geocoder
+
+	return c, geocoder
+}
+
+// connectStrava returns user allowed to create entries with strava tokens,
+// strava api is served by handler.
+func connectStrava(t *testing.T, c *Diary, handler http.Handler) authorization.User {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	user := authorization.User{
+		Name:        "Test",
+		Permissions: []authorization.Permission{{Name: "Create", Code: "create_diary_entries"}},
+	}
+	if err := c.DB.Save(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	tokens := strava.StravaUserTokens{
+		UserID:      user.ID,
+		AthleteID:   1234,
+		AccessToken: "access",
+		ExpiresAt:   time.Now().Add(time.Hour),
+	}
+	if err := c.DB.Save(&tokens).Error; err != nil {
+		t.Fatal(err)
+	}
+	c.strava = &strava.Service{
+		DB:      c.DB,
+		Client:  server.Client(),
+		BaseURL: server.URL + "/",
+	}
+
+	return user
+}
+
+func TestCreateStravaDraft(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v3/activities/42", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"id": 42, "name": "Leon - Mazarife", "distance": 22000, "total_elevation_gain": 120, "start_date": "2021-09-09T08:00:00Z"}`)
+	})
+	mux.HandleFunc("/v3/activities/42/streams", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[
+			{"type": "time", "resolution": "high", "data": [0, 3600]},
+			{"type": "latlng", "resolution": "high", "data": [[42.5987, -5.5671], [42.5800, -5.6000]]},
+			{"type": "distance", "resolution": "high", "data": [0, 22000]},
+			{"type": "altitude", "resolution": "high", "data": [840, 870]}
+		]`)
+	})
+	mux.HandleFunc("/v3/activities/42/photos", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[]`)
+	})
+
+	c, _ := newTestDiary(t)
+	user := connectStrava(t, c, mux)
+
+	ctx := context.WithValue(context.Background(), "user", user)
+	ctx = context.WithValue(ctx, "activityID", 42)
+	// second call is a repeated delivery of the same event
+	for i := 0; i < 2; i++ {
+		if err := c.createStravaDraft(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var entries []models.DiaryEntry
+	if err := c.DB.Preload("MapEntry.Tracks").Find(&entries).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 draft, got %d", len(entries))
+	}
+	entry := entries[0]
+	if entry.Title != "Leon - Mazarife" || entry.Published || entry.AuthorID != user.ID {
+		t.Errorf("unexpected draft %+v", entry)
+	}
+	if entry.MapEntry.City != "Leon" || entry.MapEntry.Lat != 42.58 {
+		t.Errorf("unexpected map entry %+v", entry.MapEntry)
+	}
+	if len(entry.MapEntry.Tracks) != 1 {
+		t.Fatalf("expected 1 track, got %d", len(entry.MapEntry.Tracks))
+	}
+	track := entry.MapEntry.Tracks[0]
+	if track.WorkoutID != "42" || track.Length != 22 {
+		t.Errorf("unexpected track %+v", track)
+	}
+	if track.Ascent != 120 || track.Descent != 90 {
+		t.Errorf("expected ascent 120 and descent 90, got %v and %v", track.Ascent, track.Descent)
+	}
+
+	var revisions int
+	if err := c.DB.Model(&models.Revision{}).Where("diary_entry_id = ?", entry.ID).Count(&revisions).Error; err != nil {
+		t.Fatal(err)
+	}
+	if revisions != 1 {
+		t.Errorf("expected 1 revision, got %d", revisions)
+	}
+}
+
+func TestWorkoutsHandler(t *testing.T) {
+	var before string
+	rateLimited := false
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v3/athlete/activities", func(w http.ResponseWriter, r *http.Request) {
+		if rateLimited {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		before = r.URL.Query().Get("before")
+		fmt.Fprint(w, `[{"id": 42, "name": "Leon - Mazarife", "distance": 22000, "start_date": "2021-09-09T08:00:00Z"}]`)
+	})
+
+	c, _ := newTestDiary(t)
+	user := connectStrava(t, c, mux)
+
+	get := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/diary/workouts.json?before=2021-09-09", nil)
+		r = r.WithContext(context.WithValue(r.Context(), "user", user))
+		w := httptest.NewRecorder()
+		c.WorkoutsHandler(w, r)
+		return w
+	}
+
+	w := get()
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	// activities of the before day are included
+	if want := strconv.FormatInt(time.Date(2021, 9, 10, 0, 0, 0, 0, time.UTC).Unix(), 10); before != want {
+		t.Errorf("expected before %s, got %s", want, before)
+	}
+
+	rateLimited = true
+	for i := 0; i < 2; i++ {
+		w = get()
+		if w.Code != http.StatusTooManyRequests {
+			t.Fatalf("expected status %d, got %d", http.StatusTooManyRequests, w.Code)
+		}
+		var response map[string]string
+		if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		if response["error"] == "" || w.Header().Get("Retry-After") == "" {
+			t.Errorf("expected error and Retry-After, got %v %v", response, w.Header())
+		}
+	}
+}
+
+func TestRetryGeocoding(t *testing.T) {
+	c, geocoder := newTestDiary(t)
+	geocoder.err = errors.New("nominatim unavailable")
+
+	mapEntry := models.MapEntry{City: "Mazarife", MapGroupID: 1}
+	if err := c.locate(context.Background(), &mapEntry); err != nil {
+		t.Fatal(err)
+	}
+	if !mapEntry.GeocodePending {
+		t.Fatal("expected geocoding to be pending")
+	}
+	if err := c.DB.Save(&mapEntry).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	pending, err := c.retryGeocoding(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pending != 1 {
+		t.Errorf("expected 1 pending entry while geocoder fails, got %d", pending)
+	}
+	var stored models.MapEntry
+	if err := c.DB.First(&stored, mapEntry.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if !stored.GeocodePending {
+		t.Error("expected pending flag to be stored")
+	}
+
+	geocoder.err = nil
+	pending, err = c.retryGeocoding(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pending != 0 {
+		t.Errorf("expected no pending entries, got %d", pending)
+	}
+
+	if err := c.DB.First(&mapEntry, mapEntry.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if mapEntry.GeocodePending || mapEntry.Lat != 42.5987 || mapEntry.Lon != -5.5671 {
+		t.Errorf("expected located entry, got %+v", mapEntry)
+	}
+	if geocoder.searches != 3 {
+		t.Errorf("expected 3 searches, got %d", geocoder.searches)
+	}
+}
+
+func TestTrackHandler(t *testing.T) {
+	c, _ := newTestDiary(t)
+
+	data, err := json.Marshal([]models.DataEntry{
+		{Latitude: 42.5987, Longitude: -5.5671},
+		{Latitude: 42.58, Longitude: -5.6, Distance: 3},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	draft := models.DiaryEntry{
+		Title:    "Leon - Mazarife",
+		Text:     "Leon - Mazarife",
+		AuthorID: 1,
+		MapEntry: models.MapEntry{
+			City:       "Mazarife",
+			MapGroupID: 1,
+			Tracks:     []models.GpsData{{Data: string(data)}},
+		},
+	}
+	if err := c.DB.Save(&draft).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		user   interface{}
+		status int
+	}{
+		{"anonymous", nil, http.StatusNotFound},
+		{"other user", authorization.User{Model: gorm.Model{ID: 2}}, http.StatusNotFound},
+		{"author", authorization.User{Model: gorm.Model{ID: 1}}, http.StatusOK},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", fmt.Sprintf("/diary/%d/track.gpx", draft.ID), nil)
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("diaryID", strconv.Itoa(int(draft.ID)))
+		ctx := context.WithValue(r.Context(), chi.RouteCtxKey, rctx)
+		if test.user != nil {
+			ctx = context.WithValue(ctx, "user", test.user)
+		}
+		w := httptest.NewRecorder()
+		c.TrackHandler(w, r.WithContext(ctx))
+
+		if w.Code != test.status {
+			t.Errorf("%s: expected status %d, got %d", test.name, test.status, w.Code)
+		}
+	}
+}
+
+func TestRestoreHandler(t *testing.T) {
+	c, _ := newTestDiary(t)
+
+	user := authorization.User{
+		Name:        "Test",
+		Permissions: []authorization.Permission{{Name: "Create", Code: "create_diary_entries"}},
+	}
+	if err := c.DB.Save(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	// text saved before it was sanitized on save
+	entry := models.DiaryEntry{
+		Title:    "Leon",
+		Text:     `<p>Leon</p><script>alert(1)</script>`,
+		AuthorID: user.ID,
+	}
+	if err := c.DB.Save(&entry).Error; err != nil {
+		t.Fatal(err)
+	}
+	revision := entry.Revision(user.ID)
+	if err := models.SaveRevision(c.DB, revision); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.DB.Where("diary_entry_id = ?", entry.ID).First(&revision).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("POST", fmt.Sprintf("/diary/%d/history/%d/restore", entry.ID, revision.ID), nil)
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("diaryID", strconv.Itoa(int(entry.ID)))
+	rctx.URLParams.Add("revisionID", strconv.Itoa(int(revision.ID)))
+	ctx := context.WithValue(r.Context(), chi.RouteCtxKey, rctx)
+	ctx = context.WithValue(ctx, "user", user)
+	w := httptest.NewRecorder()
+	c.RestoreHandler(w, r.WithContext(ctx))
+	if w.Code != http.StatusFound {
+		t.Fatalf("expected status %d, got %d", http.StatusFound, w.Code)
+	}
+
+	if err := c.DB.First(&entry, entry.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if entry.Text != "<p>Leon</p>" {
+		t.Errorf("expected sanitized text, got %q", entry.Text)
+	}
+}
@@ -21,29 +21,77 @@ func init() {
 
 type DiaryEntry struct {
 	gorm.Model
-	Title      string             `valid:"required"`
-	Text       string             `gorm:"type:text" valid:"required"`
+	Title string `valid:"required"`
+	Text  string `gorm:"type:text" valid:"required"`
+	// Format of the text, FormatHTML when empty.
+	Format     string
 	Author     authorization.User `valid:"-"`
 	AuthorID   uint               `valid:"required"`
 	Comments   []Comment          `valid:"-"`
 	MapEntry   MapEntry           `valid:"-"`
 	MapEntryID uint
 	Images     []files.Image `gorm:"many2many:diary_image"`
+	Tags       []Tag         `gorm:"many2many:diary_entry_tags" valid:"-"`
 	Published  bool
+	// PublishAt is when a draft is scheduled to be published.
+	PublishAt *time.Time
+	// PublishedAt is when the entry was published, CreatedAt stays the time
+	// the draft was written.
+	PublishedAt *time.Time
+	// NotifiedAt is set once subscribers were emailed about the entry.
+	NotifiedAt *time.Time
+	// NotifyClaimedAt is when sending of the notification started, a claim
+	// older than NotifyClaimTimeout is treated as failed.
+	NotifyClaimedAt *time.Time
 
-	NumComments uint `gorm:"-"`
-	Viewed      bool `gorm:"-"`
-	NewComments bool `gorm:"-"`
+	NumComments uint   `gorm:"-"`
+	Viewed      bool   `gorm:"-"`
+	NewComments bool   `gorm:"-"`
+	Snippet     string `gorm:"-"`
 }
 
 // TODO: handle timezone nicer
 func (de *DiaryEntry) AfterFind() error {
 	de.CreatedAt = de.CreatedAt.In(location)
 	de.UpdatedAt = de.UpdatedAt.In(location)
+	for _, t := range []*time.Time{de.PublishAt, de.PublishedAt, de.NotifiedAt, de.NotifyClaimedAt} {
+		if t != nil {
+			*t = t.In(location)
+		}
+	}
 
 	return nil
 }
 
+// Date returns the publication date of the entry or the creation date for drafts.
+func (de DiaryEntry) Date() time.Time {
+	if de.PublishedAt != nil {
+		return *de.PublishedAt
+	}
+	return de.CreatedAt
+}
+
+// Scheduled reports whether the entry is a draft waiting to be published.
+func (de DiaryEntry) Scheduled() bool {
+	return !de.Published && de.PublishAt != nil
+}
+
+// DateColumn is SQL expression for DiaryEntry.Date.
+const DateColumn = "COALESCE(diary_entries.published_at, diary_entries.created_at)"
+
+// ParsePublishAt parses the publish time entered in the edit form, empty
+// value means the entry is not scheduled.
+func ParsePublishAt(value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02T15:04", value, location)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
 type Comment struct {
 	gorm.Model
 	DiaryEntryID uint
@@ -64,7 +112,59 @@ type EntryUserRead struct {
 	UserID       uint
 }
 
+type ActivityType struct {
+	ID   string
+	Name string
+}
+
+var ActivityTypes = []ActivityType{
+	{ID: "Walk", Name: "Hoja"},
+	{ID: "Hike", Name: "Pohod"},
+	{ID: "Ride", Name: "Kolesarjenje"},
+}
+
 type Workout struct {
 	ID          string
 	Description string
 }
+
+// PublishDue publishes drafts whose scheduled time has passed, publication
+// time is set to the scheduled one.
+func PublishDue(db *gorm.DB, now time.Time) (int64, error) {
+	query := db.Model(&DiaryEntry{}).
+		Where("published = ? AND publish_at <= ?", false, now).
+		UpdateColumns(map[string]interface{}{
+			"published":    true,
+			"published_at": gorm.Expr("publish_at"),
+		})
+	return query.RowsAffected, query.Error
+}
+
+// NotifyClaimTimeout is how long a notification claim is held, after that
+// sending is assumed to have failed and the notification can be claimed again.
+const NotifyClaimTimeout = 10 * time.Minute
+
+// ClaimNotification marks that subscribers are being notified about the
+// entry, it returns false when the entry was already notified or the
+// notification is being sent.
+func ClaimNotification(db *gorm.DB, id uint, now time.Time) (bool, error) {
+	query := db.Model(&DiaryEntry{}).
+		Where("id = ? AND published = ? AND notified_at IS NULL", id, true).
+		Where("notify_claimed_at IS NULL OR notify_claimed_at <= ?", now.Add(-NotifyClaimTimeout)).
+		UpdateColumn("notify_claimed_at", now)
+	return query.RowsAffected == 1, query.Error
+}
+
+// MarkNotified records that subscribers were notified about the entry.
+func MarkNotified(db *gorm.DB, id uint, now time.Time) error {
+	return db.Model(&DiaryEntry{}).
+		Where("id = ?", id).
+		UpdateColumn("notified_at", now).Error
+}
+
+// ReleaseNotification clears the claim so that notification is retried.
+func ReleaseNotification(db *gorm.DB, id uint) error {
+	return db.Model(&DiaryEntry{}).
+		Where("id = ?", id).
+		UpdateColumn("notify_claimed_at", nil).Error
+}
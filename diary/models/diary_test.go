@@ -0,0 +1,144 @@
+package models
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+)
+
+func newTestDB(t *testing.T) *gorm.DB {
+	DB, err := gorm.Open("sqlite3", filepath.Join(t.TempDir(), "models.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { DB.Close() })
+
+	if err := DB.AutoMigrate(&DiaryEntry{}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	return DB
+}
+
+func TestPublishDue(t *testing.T) {
+	DB := newTestDB(t)
+	now := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	due := now.Add(-time.Hour)
+	later := now.Add(time.Hour)
+
+	entries := []DiaryEntry{
+		{Title: "due", PublishAt: &due},
+		{Title: "later", PublishAt: &later},
+		{Title: "draft"},
+	}
+	for i := range entries {
+		if err := DB.Create(&entries[i]).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	published, err := PublishDue(DB, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if published != 1 {
+		t.Fatalf("published %d entries, want 1", published)
+	}
+
+	for i, want := range []bool{true, false, false} {
+		var entry DiaryEntry
+		if err := DB.First(&entry, entries[i].ID).Error; err != nil {
+			t.Fatal(err)
+		}
+		if entry.Published != want {
+			t.Errorf("%s: published %v, want %v", entry.Title, entry.Published, want)
+		}
+		if want && (entry.PublishedAt == nil || !entry.PublishedAt.Equal(due)) {
+			t.Errorf("%s: published at %v, want %v", entry.Title, entry.PublishedAt, due)
+		}
+		if want && !entry.Date().Equal(due) {
+			t.Errorf("%s: date %v, want %v", entry.Title, entry.Date(), due)
+		}
+		if !want && !entry.Date().Equal(entry.CreatedAt) {
+			t.Errorf("%s: date %v, want creation time %v", entry.Title, entry.Date(), entry.CreatedAt)
+		}
+	}
+
+	published, err = PublishDue(DB, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if published != 0 {
+		t.Errorf("published %d entries again", published)
+	}
+}
+
+func TestClaimNotification(t *testing.T) {
+	DB := newTestDB(t)
+	now := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	draft := DiaryEntry{Title: "draft"}
+	entry := DiaryEntry{Title: "published", Published: true, PublishedAt: &now}
+	for _, e := range []*DiaryEntry{&draft, &entry} {
+		if err := DB.Create(e).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if claimed, err := ClaimNotification(DB, draft.ID, now); err != nil || claimed {
+		t.Errorf("claimed draft = %v, %v", claimed, err)
+	}
+
+	if claimed, err := ClaimNotification(DB, entry.ID, now); err != nil || !claimed {
+		t.Fatalf("first claim = %v, %v", claimed, err)
+	}
+	if claimed, err := ClaimNotification(DB, entry.ID, now); err != nil || claimed {
+		t.Fatalf("second claim = %v, %v", claimed, err)
+	}
+
+	if err := ReleaseNotification(DB, entry.ID); err != nil {
+		t.Fatal(err)
+	}
+	if claimed, err := ClaimNotification(DB, entry.ID, now); err != nil || !claimed {
+		t.Errorf("claim after release = %v, %v", claimed, err)
+	}
+
+	// sending did not finish, e.g. the server was restarted
+	stale := now.Add(NotifyClaimTimeout)
+	if claimed, err := ClaimNotification(DB, entry.ID, stale.Add(-time.Second)); err != nil || claimed {
+		t.Errorf("claim before timeout = %v, %v", claimed, err)
+	}
+	if claimed, err := ClaimNotification(DB, entry.ID, stale); err != nil || !claimed {
+		t.Fatalf("claim after timeout = %v, %v", claimed, err)
+	}
+
+	if err := MarkNotified(DB, entry.ID, stale); err != nil {
+		t.Fatal(err)
+	}
+	if claimed, err := ClaimNotification(DB, entry.ID, stale.Add(2*NotifyClaimTimeout)); err != nil || claimed {
+		t.Errorf("claim of notified entry = %v, %v", claimed, err)
+	}
+}
+
+func TestParsePublishAt(t *testing.T) {
+	publishAt, err := ParsePublishAt("")
+	if err != nil || publishAt != nil {
+		t.Errorf("empty value = %v, %v", publishAt, err)
+	}
+
+	publishAt, err = ParsePublishAt("2019-06-01T08:30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := time.Date(2019, 6, 1, 8, 30, 0, 0, location)
+	if !publishAt.Equal(want) {
+		t.Errorf("got %v, want %v", publishAt, want)
+	}
+
+	if _, err := ParsePublishAt("1. 6. 2019"); err == nil {
+		t.Error("expected error for invalid value")
+	}
+}
@@ -3,15 +3,17 @@ package models
 import (
 	"context"
 	"encoding/json"
+	"math"
 	"strconv"
+	"sync"
 	"time"
 
-	"googlemaps.github.io/maps"
-
 	"github.com/jinzhu/gorm"
 	jsoniter "github.com/json-iterator/go"
 	"github.com/pkg/errors"
-	"github.com/spf13/viper"
+	"github.com/twpayne/go-polyline"
+
+	"github.com/matematik7/camino-go/geocode"
 )
 
 type MapEntry struct {
@@ -22,45 +24,156 @@ type MapEntry struct {
 	MapGroupID  uint
 	Lon         float64
 	Lat         float64
-	GpsData     GpsData
-	GpsDataID   uint
+	Tracks      []GpsData
+
+	// ManualLocation keeps Lat and Lon as entered instead of locating City
+	ManualLocation bool
+	// GeocodePending is set when City could not be located yet and should be retried
+	GeocodePending bool
 
 	DiaryEntry *DiaryEntry
 }
 
-func (me *MapEntry) BeforeSave() error {
-	if len(me.GpsData.Data) > 0 && me.City == "" {
-		dataEntries := []DataEntry{}
-		err := json.Unmarshal([]byte(me.GpsData.Data), &dataEntries)
-		if err != nil {
-			return errors.Wrap(err, "could not unmarshal gps data")
+// LastTrack returns the track that ends the day, marker is placed at its end.
+func (me MapEntry) LastTrack() GpsData {
+	if len(me.Tracks) == 0 {
+		return GpsData{}
+	}
+	return me.Tracks[len(me.Tracks)-1]
+}
+
+// TrackIDs returns ids of all tracks in order.
+func (me MapEntry) TrackIDs() []uint {
+	ids := make([]uint, 0, len(me.Tracks))
+	for _, track := range me.Tracks {
+		ids = append(ids, track.ID)
+	}
+	return ids
+}
+
+// Summary combines all tracks into one, Start is taken from the first and End
+// from the last track, other values are summed or merged.
+func (me MapEntry) Summary() GpsData {
+	summary := GpsData{}
+	if len(me.Tracks) == 0 {
+		return summary
+	}
+
+	heartRateDuration := 0.0
+	for i, track := range me.Tracks {
+		if i == 0 {
+			summary.Start = track.Start
+			summary.Date = track.Date
 		}
+		summary.End = track.End
 
-		me.Lat = float64(dataEntries[len(dataEntries)-1].Latitude)
-		me.Lon = float64(dataEntries[len(dataEntries)-1].Longitude)
-		me.City = me.GpsData.End
+		summary.Length += track.Length
+		summary.Duration += track.Duration
+		summary.MovingTime += track.MovingTime
+		summary.Ascent += track.Ascent
+		summary.Descent += track.Descent
+
+		if track.MaxElevation != nil && (summary.MaxElevation == nil || *track.MaxElevation > *summary.MaxElevation) {
+			summary.MaxElevation = track.MaxElevation
+		}
+		if track.MinElevation != nil && (summary.MinElevation == nil || *track.MinElevation < *summary.MinElevation) {
+			summary.MinElevation = track.MinElevation
+		}
+
+		// average heart rate is weighted by duration of tracks that have it
+		if track.AvgHeartRate > 0 {
+			summary.AvgHeartRate += track.AvgHeartRate * track.Duration
+			heartRateDuration += track.Duration
+		}
+		if track.MaxHeartRate > summary.MaxHeartRate {
+			summary.MaxHeartRate = track.MaxHeartRate
+		}
 	}
-	if me.City != "" && me.City != me.GpsData.End {
-		c, err := maps.NewClient(maps.WithAPIKey(viper.GetString("GMAP_SERVER_KEY")))
+
+	if heartRateDuration > 0 {
+		summary.AvgHeartRate /= heartRateDuration
+	} else {
+		summary.AvgHeartRate = 0
+	}
+	if summary.Duration > 0 {
+		summary.AvgSpeed = summary.Length / (summary.Duration / 3600)
+	}
+
+	return summary
+}
+
+// ElevationProfile returns profiles of all tracks joined into one, distances
+// of later tracks are offset by the length of previous ones.
+func (me MapEntry) ElevationProfile() (string, error) {
+	profile := [][]float64{}
+	offset := 0.0
+	for _, track := range me.Tracks {
+		value, err := track.ElevationProfile()
 		if err != nil {
-			return errors.Wrap(err, "could not get maps client")
+			return "", err
 		}
 
-		result, err := c.Geocode(context.Background(), &maps.GeocodingRequest{
-			Address: me.City,
-		})
-		if err != nil {
-			return errors.Wrap(err, "could not get geocode result")
+		trackProfile := [][]float64{}
+		if err := json.Unmarshal([]byte(value), &trackProfile); err != nil {
+			return "", errors.Wrap(err, "could not unmarshal elevation profile")
+		}
+		for _, point := range trackProfile {
+			if len(point) > 0 {
+				point[0] += offset
+			}
+			profile = append(profile, point)
 		}
+		if len(trackProfile) > 0 && len(trackProfile[len(trackProfile)-1]) > 0 {
+			offset = trackProfile[len(trackProfile)-1][0]
+		}
+	}
+
+	result, err := json.Marshal(profile)
+	if err != nil {
+		return "", errors.Wrap(err, "could not marshal elevation profile")
+	}
+	return string(result), nil
+}
+
+// Locate sets coordinates of the map entry before it is saved. Entries with
+// tracks are placed at the end of the last track and named after it unless
+// another city is set, other cities are geocoded. Manual coordinates are kept.
+func (me *MapEntry) Locate(ctx context.Context, geocoder geocode.Geocoder) error {
+	if me.ManualLocation {
+		me.GeocodePending = false
+		return nil
+	}
 
-		if len(result) < 1 {
-			return errors.Wrap(err, "no results for geocode")
+	lastTrack := me.LastTrack()
+	if len(lastTrack.Data) > 0 && (me.City == "" || me.City == lastTrack.End) {
+		dataEntries, err := lastTrack.DataEntries()
+		if err != nil {
+			return err
+		}
+		if len(dataEntries) == 0 {
+			return errors.New("last track has no points")
 		}
 
-		me.Lat = result[0].Geometry.Location.Lat
-		me.Lon = result[0].Geometry.Location.Lng
+		me.Lat = float64(dataEntries[len(dataEntries)-1].Latitude)
+		me.Lon = float64(dataEntries[len(dataEntries)-1].Longitude)
+		me.City = lastTrack.End
+		me.GeocodePending = false
+		return nil
+	}
+
+	if me.City == "" {
+		me.GeocodePending = false
+		return nil
+	}
+
+	place, err := geocoder.Search(ctx, me.City)
+	if err != nil {
+		return errors.Wrapf(err, "could not geocode %q", me.City)
 	}
 
+	me.Lat = place.Latitude
+	me.Lon = place.Longitude
+	me.GeocodePending = false
 	return nil
 }
 
@@ -74,23 +187,58 @@ type MapGroup struct {
 
 type GpsData struct {
 	gorm.Model
-	Start     string
-	End       string
-	Date      time.Time
-	Length    float64
-	Duration  float64
-	AvgSpeed  float64
-	WorkoutID string `gorm:"column:endomondo_id"`
-	Data      string `gorm:"type:text"`
-	MapURL    string
+	MapEntryID uint `gorm:"index"`
+	Start      string
+	End        string
+	Date       time.Time
+	Length     float64
+	Duration   float64
+	AvgSpeed   float64
+	WorkoutID  string `gorm:"column:endomondo_id"`
+	Data       string `gorm:"type:text"`
+	MapURL     string
+
+	// Walk, Hike or Ride, empty when unknown
+	ActivityType string
+
+	// Reversed is set when Data was stored in reverse of recorded direction
+	Reversed bool
+
+	// Metrics computed from Data, elevations in m and moving time in seconds.
+	// Elevation range is nil when no entry has elevation.
+	Ascent       float64
+	Descent      float64
+	MaxElevation *float64
+	MinElevation *float64
+	MovingTime   float64
+	AvgHeartRate float64
+	MaxHeartRate float64
+
+	// Simplified track precomputed from Data on save
+	Polyline string `gorm:"type:text"`
+	Profile  string `gorm:"type:text"`
+}
+
+// HasElevation reports whether any data entry has elevation.
+func (g GpsData) HasElevation() bool {
+	return g.MaxElevation != nil
 }
 
 type DataEntry struct {
 	Time      time.Time `json:"time.Time"`
 	Latitude  Float     `json:"lat"`
 	Longitude Float     `json:"lon"`
-	Elevation Float     `json:"elevation"`
 	Distance  Float     `json:"dist"`
+
+	// Elevation is nil when not recorded
+	Elevation *Float `json:"elevation,omitempty"`
+
+	// Optional sensor data, zero when not recorded
+	HeartRate Float `json:"hr,omitempty"`
+	Cadence   Float `json:"cad,omitempty"`
+	Power     Float `json:"watts,omitempty"`
+	// Temperature is nil when not recorded, 0 °C is a valid reading
+	Temperature *Float `json:"temp,omitempty"`
 }
 
 // Old data in db sometimes has strings instead of floats, this accepts string when json unmarshaling
@@ -117,6 +265,12 @@ func (f *Float) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+// NewFloat returns a pointer to value for optional data entry fields.
+func NewFloat(value float64) *Float {
+	f := Float(value)
+	return &f
+}
+
 func readFloat(value *jsoniter.Iterator) Float {
 	switch value.WhatIsNext() {
 	case jsoniter.StringValue:
@@ -134,18 +288,206 @@ func readFloat(value *jsoniter.Iterator) Float {
 	return Float(0)
 }
 
+func (g GpsData) DataEntries() ([]DataEntry, error) {
+	dataEntries := []DataEntry{}
+	if err := json.Unmarshal([]byte(g.Data), &dataEntries); err != nil {
+		return nil, errors.Wrap(err, "could not unmarshal gps data")
+	}
+	return dataEntries, nil
+}
+
+// ReverseEntries reverses order of data entries in place. Times and distances
+// are rebased so the track still starts at the original start time and zero
+// distance.
+func ReverseEntries(entries []DataEntry) {
+	if len(entries) == 0 {
+		return
+	}
+
+	startTime := entries[0].Time
+	for i := len(entries)/2 - 1; i >= 0; i-- {
+		opp := len(entries) - 1 - i
+		entries[i], entries[opp] = entries[opp], entries[i]
+	}
+	endTime := entries[0].Time
+	totalDistance := entries[0].Distance
+	for i := range entries {
+		if !entries[i].Time.IsZero() {
+			entries[i].Time = startTime.Add(endTime.Sub(entries[i].Time))
+		}
+		entries[i].Distance = totalDistance - entries[i].Distance
+	}
+}
+
+// DefaultTolerance is the simplification tolerance in meters used by OptimizedData.
+const DefaultTolerance = 5.0
+
+// ToleranceForZoom returns the size of one web mercator pixel in meters at the given zoom level.
+func ToleranceForZoom(zoom int) float64 {
+	return 156543.03392 / math.Pow(2, float64(zoom))
+}
+
+type simplifyBuffers struct {
+	entries []DataEntry
+	keep    []bool
+	stack   [][2]int
+}
+
+var simplifyPool = sync.Pool{
+	New: func() interface{} {
+		return &simplifyBuffers{}
+	},
+}
+
 func (g GpsData) OptimizedData() (string, error) {
+	return g.SimplifiedData(DefaultTolerance)
+}
+
+// SimplifiedData returns gps data json with points removed by Douglas-Peucker
+// simplification, tolerance is in meters and also applies to elevation.
+func (g GpsData) SimplifiedData(tolerance float64) (string, error) {
+	var result string
+	err := g.withSimplified(tolerance, func(entries []DataEntry, keep []bool) error {
+		stream := jsoniter.ConfigFastest.BorrowStream(nil)
+		defer jsoniter.ConfigFastest.ReturnStream(stream)
+		stream.WriteArrayStart()
+
+		first := true
+		for i := range entries {
+			if !keep[i] {
+				continue
+			}
+			if !first {
+				stream.WriteMore()
+			}
+			stream.WriteVal(entries[i])
+			first = false
+		}
+
+		stream.WriteArrayEnd()
+		if err := stream.Error; err != nil {
+			return err
+		}
+
+		result = string(stream.Buffer())
+		return nil
+	})
+	return result, err
+}
+
+// SimplifiedPolyline returns simplified track as an encoded polyline.
+func (g GpsData) SimplifiedPolyline(tolerance float64) (string, error) {
+	var result string
+	err := g.withSimplified(tolerance, func(entries []DataEntry, keep []bool) error {
+		result = encodePolyline(entries, keep)
+		return nil
+	})
+	return result, err
+}
+
+// ElevationProfile returns [distance, elevation] pairs of the simplified track as json,
+// the precomputed profile is used when available.
+func (g GpsData) ElevationProfile() (string, error) {
+	if g.Profile != "" {
+		return g.Profile, nil
+	}
+
+	var result string
+	err := g.withSimplified(DefaultTolerance, func(entries []DataEntry, keep []bool) error {
+		result = encodeProfile(entries, keep)
+		return nil
+	})
+	return result, err
+}
+
+// Precompute stores metrics, simplified polyline and elevation profile, so map
+// and diary pages do not need to parse the full data.
+func (g *GpsData) Precompute() error {
+	return g.withSimplified(DefaultTolerance, func(entries []DataEntry, keep []bool) error {
+		g.ComputeMetrics(entries)
+		g.Polyline = encodePolyline(entries, keep)
+		g.Profile = encodeProfile(entries, keep)
+		return nil
+	})
+}
+
+func (g *GpsData) BeforeSave() error {
+	if g.Data != "" && g.Polyline == "" {
+		if err := g.Precompute(); err != nil {
+			return errors.Wrap(err, "could not precompute gps data")
+		}
+	}
+	return nil
+}
+
+func encodePolyline(entries []DataEntry, keep []bool) string {
+	coords := make([][]float64, 0, len(entries))
+	for i := range entries {
+		if keep[i] {
+			coords = append(coords, []float64{float64(entries[i].Latitude), float64(entries[i].Longitude)})
+		}
+	}
+	return string(polyline.EncodeCoords(coords))
+}
+
+// encodeProfile returns [distance, elevation, speed, heart rate] of kept
+// entries, speed and average heart rate are computed since previous kept entry.
+// Elevation is null when not recorded.
+func encodeProfile(entries []DataEntry, keep []bool) string {
+	buf := []byte{'['}
+	previous := -1
+	for i := range entries {
+		if !keep[i] {
+			continue
+		}
+
+		speed := 0.0
+		heartRate := 0.0
+		if previous >= 0 {
+			hours := entries[i].Time.Sub(entries[previous].Time).Hours()
+			if !entries[i].Time.IsZero() && !entries[previous].Time.IsZero() && hours > 0 {
+				speed = float64(entries[i].Distance-entries[previous].Distance) / hours
+			}
+			heartRate = averageHeartRate(entries[previous+1 : i+1])
+		} else {
+			heartRate = float64(entries[i].HeartRate)
+		}
+
+		if previous >= 0 {
+			buf = append(buf, ',')
+		}
+		buf = append(buf, '[')
+		buf = strconv.AppendFloat(buf, float64(entries[i].Distance), 'f', 3, 64)
+		buf = append(buf, ',')
+		if entries[i].Elevation != nil {
+			buf = strconv.AppendFloat(buf, float64(*entries[i].Elevation), 'f', 1, 64)
+		} else {
+			buf = append(buf, "null"...)
+		}
+		buf = append(buf, ',')
+		buf = strconv.AppendFloat(buf, speed, 'f', 1, 64)
+		buf = append(buf, ',')
+		buf = strconv.AppendFloat(buf, heartRate, 'f', 0, 64)
+		buf = append(buf, ']')
+		previous = i
+	}
+	buf = append(buf, ']')
+	return string(buf)
+}
+
+// withSimplified parses data into pooled buffers and marks points kept by simplification.
+func (g GpsData) withSimplified(tolerance float64, fn func(entries []DataEntry, keep []bool) error) error {
+	buffers := simplifyPool.Get().(*simplifyBuffers)
+	defer simplifyPool.Put(buffers)
+
 	var entry DataEntry
+	entries := buffers.entries[:0]
+
 	iter := jsoniter.ConfigFastest.BorrowIterator([]byte(g.Data))
 	defer jsoniter.ConfigFastest.ReturnIterator(iter)
 
-	stream := jsoniter.ConfigFastest.BorrowStream(nil)
-	defer jsoniter.ConfigFastest.ReturnStream(stream)
-	stream.WriteArrayStart()
-
-	previousDistance := -1.0
-	first := true
 	iter.ReadArrayCB(func(item *jsoniter.Iterator) bool {
+		entry = DataEntry{}
 		item.ReadMapCB(func(value *jsoniter.Iterator, key string) bool {
 			switch key {
 			case "lat":
@@ -155,7 +497,19 @@ func (g GpsData) OptimizedData() (string, error) {
 			case "dist":
 				entry.Distance = readFloat(value)
 			case "elevation":
-				entry.Elevation = readFloat(value)
+				if !value.ReadNil() {
+					entry.Elevation = NewFloat(float64(readFloat(value)))
+				}
+			case "hr":
+				entry.HeartRate = readFloat(value)
+			case "cad":
+				entry.Cadence = readFloat(value)
+			case "watts":
+				entry.Power = readFloat(value)
+			case "temp":
+				if !value.ReadNil() {
+					entry.Temperature = NewFloat(float64(readFloat(value)))
+				}
 			case "time.Time", "time":
 				t, err := time.Parse(time.RFC3339, value.ReadString())
 				if err != nil {
@@ -169,24 +523,81 @@ func (g GpsData) OptimizedData() (string, error) {
 			return true
 		})
 
-		if float64(entry.Distance)-previousDistance > 0.01 {
-			previousDistance = float64(entry.Distance)
-			if !first {
-				stream.WriteMore()
-			}
-			stream.WriteVal(entry)
-			first = false
-		}
+		entries = append(entries, entry)
 		return true
 	})
+	buffers.entries = entries
 	if err := iter.Error; err != nil {
-		return "", err
+		return err
+	}
+
+	buffers.simplify(tolerance)
+
+	return fn(entries, buffers.keep)
+}
+
+// simplify marks entries to keep using iterative Douglas-Peucker on a local
+// equirectangular projection, elevation is used as the third dimension.
+func (b *simplifyBuffers) simplify(tolerance float64) {
+	n := len(b.entries)
+	if cap(b.keep) < n {
+		b.keep = make([]bool, n)
+	}
+	b.keep = b.keep[:n]
+	for i := range b.keep {
+		b.keep[i] = n <= 2
+	}
+	if n <= 2 {
+		return
 	}
 
-	stream.WriteArrayEnd()
-	if err := stream.Error; err != nil {
-		return "", err
+	const metersPerDegree = 111320.0
+	lat0 := float64(b.entries[0].Latitude)
+	lonScale := metersPerDegree * math.Cos(lat0*math.Pi/180)
+	project := func(e DataEntry) (float64, float64, float64) {
+		elevation := 0.0
+		if e.Elevation != nil {
+			elevation = float64(*e.Elevation)
+		}
+		return float64(e.Longitude) * lonScale, float64(e.Latitude) * metersPerDegree, elevation
 	}
 
-	return string(stream.Buffer()), nil
+	b.keep[0] = true
+	b.keep[n-1] = true
+	b.stack = append(b.stack[:0], [2]int{0, n - 1})
+	for len(b.stack) > 0 {
+		segment := b.stack[len(b.stack)-1]
+		b.stack = b.stack[:len(b.stack)-1]
+		start, end := segment[0], segment[1]
+		if end-start < 2 {
+			continue
+		}
+
+		ax, ay, az := project(b.entries[start])
+		bx, by, bz := project(b.entries[end])
+		dx, dy, dz := bx-ax, by-ay, bz-az
+		length2 := dx*dx + dy*dy + dz*dz
+
+		maxDistance2 := -1.0
+		index := start
+		for i := start + 1; i < end; i++ {
+			px, py, pz := project(b.entries[i])
+			t := 0.0
+			if length2 > 0 {
+				t = ((px-ax)*dx + (py-ay)*dy + (pz-az)*dz) / length2
+				t = math.Max(0, math.Min(1, t))
+			}
+			ex, ey, ez := ax+t*dx-px, ay+t*dy-py, az+t*dz-pz
+			distance2 := ex*ex + ey*ey + ez*ez
+			if distance2 > maxDistance2 {
+				maxDistance2 = distance2
+				index = i
+			}
+		}
+
+		if maxDistance2 > tolerance*tolerance {
+			b.keep[index] = true
+			b.stack = append(b.stack, [2]int{start, index}, [2]int{index, end})
+		}
+	}
 }
@@ -0,0 +1,382 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/pkg/errors"
+
+	"github.com/matematik7/camino-go/geocode"
+)
+
+func testGpsData(tb testing.TB, n int) GpsData {
+	start := time.Date(2021, time.June, 1, 8, 0, 0, 0, time.UTC)
+	entries := make([]DataEntry, n)
+	for i := range entries {
+		// gently winding track with a climb, roughly 5 m between points
+		entries[i] = DataEntry{
+			Time:      start.Add(time.Duration(i) * 2 * time.Second),
+			Latitude:  Float(46 + float64(i)*0.00004),
+			Longitude: Float(14 + 0.002*math.Sin(float64(i)/200)),
+			Elevation: NewFloat(300 + 100*math.Sin(float64(i)/1000)),
+			Distance:  Float(float64(i) * 0.005),
+		}
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return GpsData{Data: string(data)}
+}
+
+// distanceThinnedData is the previous OptimizedData implementation, kept for comparison.
+func distanceThinnedData(g GpsData) (string, error) {
+	var entry DataEntry
+	iter := jsoniter.ConfigFastest.BorrowIterator([]byte(g.Data))
+	defer jsoniter.ConfigFastest.ReturnIterator(iter)
+
+	stream := jsoniter.ConfigFastest.BorrowStream(nil)
+	defer jsoniter.ConfigFastest.ReturnStream(stream)
+	stream.WriteArrayStart()
+
+	previousDistance := -1.0
+	first := true
+	iter.ReadArrayCB(func(item *jsoniter.Iterator) bool {
+		item.ReadMapCB(func(value *jsoniter.Iterator, key string) bool {
+			switch key {
+			case "lat":
+				entry.Latitude = readFloat(value)
+			case "lon":
+				entry.Longitude = readFloat(value)
+			case "dist":
+				entry.Distance = readFloat(value)
+			case "elevation":
+				entry.Elevation = NewFloat(float64(readFloat(value)))
+			case "time.Time", "time":
+				t, err := time.Parse(time.RFC3339, value.ReadString())
+				if err != nil {
+					value.ReportError("time.Parse", err.Error())
+					return false
+				}
+				entry.Time = t
+			default:
+				value.Skip()
+			}
+			return true
+		})
+
+		if float64(entry.Distance)-previousDistance > 0.01 {
+			previousDistance = float64(entry.Distance)
+			if !first {
+				stream.WriteMore()
+			}
+			stream.WriteVal(entry)
+			first = false
+		}
+		return true
+	})
+	if err := iter.Error; err != nil {
+		return "", err
+	}
+
+	stream.WriteArrayEnd()
+	if err := stream.Error; err != nil {
+		return "", err
+	}
+
+	return string(stream.Buffer()), nil
+}
+
+func TestSimplifiedData(t *testing.T) {
+	entries := []DataEntry{
+		{Latitude: 46, Longitude: 14},
+		{Latitude: 46.001, Longitude: 14},
+		{Latitude: 46.002, Longitude: 14},
+		{Latitude: 46.002, Longitude: 14.001},
+		{Latitude: 46.002, Longitude: 14.002},
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	simplified, err := GpsData{Data: string(data)}.SimplifiedData(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := []DataEntry{}
+	if err := json.Unmarshal([]byte(simplified), &result); err != nil {
+		t.Fatal(err)
+	}
+
+	// only the corner is kept between endpoints
+	if len(result) != 3 {
+		t.Fatalf("expected 3 points, got %d", len(result))
+	}
+	if result[1].Latitude != 46.002 || result[1].Longitude != 14 {
+		t.Errorf("expected corner point, got %v, %v", result[1].Latitude, result[1].Longitude)
+	}
+}
+
+func TestSimplifiedDataSensors(t *testing.T) {
+	entries := []DataEntry{
+		{Latitude: 46, Longitude: 14, HeartRate: 100, Cadence: 80, Power: 150, Temperature: NewFloat(20)},
+		{Latitude: 46.001, Longitude: 14},
+		{Latitude: 46.002, Longitude: 14, HeartRate: 140, Temperature: NewFloat(0)},
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	simplified, err := GpsData{Data: string(data)}.SimplifiedData(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := []DataEntry{}
+	if err := json.Unmarshal([]byte(simplified), &result); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(result) != 2 {
+		t.Fatalf("expected 2 points, got %d", len(result))
+	}
+	if result[0].HeartRate != 100 || result[0].Cadence != 80 || result[0].Power != 150 || result[0].Temperature == nil || *result[0].Temperature != 20 {
+		t.Errorf("sensor data not passed through, got %+v", result[0])
+	}
+	// missing values must not be copied from previous entries
+	if result[1].HeartRate != 140 || result[1].Cadence != 0 || result[1].Power != 0 || result[1].Temperature == nil || *result[1].Temperature != 0 {
+		t.Errorf("unexpected sensor data %+v", result[1])
+	}
+
+	gpsData := GpsData{}
+	gpsData.ComputeMetrics(entries)
+	if gpsData.AvgHeartRate != 120 || gpsData.MaxHeartRate != 140 {
+		t.Errorf("expected heart rate 120 avg and 140 max, got %v and %v", gpsData.AvgHeartRate, gpsData.MaxHeartRate)
+	}
+}
+
+func TestReverseEntries(t *testing.T) {
+	start := time.Date(2021, time.June, 1, 8, 0, 0, 0, time.UTC)
+	entries := []DataEntry{
+		{Time: start, Latitude: 46, Distance: 0},
+		{Time: start.Add(10 * time.Minute), Latitude: 46.01, Distance: 1},
+		{Time: start.Add(30 * time.Minute), Latitude: 46.02, Distance: 3},
+	}
+
+	ReverseEntries(entries)
+
+	expected := []DataEntry{
+		{Time: start, Latitude: 46.02, Distance: 0},
+		{Time: start.Add(20 * time.Minute), Latitude: 46.01, Distance: 2},
+		{Time: start.Add(30 * time.Minute), Latitude: 46, Distance: 3},
+	}
+	for i := range expected {
+		if !entries[i].Time.Equal(expected[i].Time) || entries[i].Latitude != expected[i].Latitude || entries[i].Distance != expected[i].Distance {
+			t.Errorf("entry %d: expected %+v, got %+v", i, expected[i], entries[i])
+		}
+	}
+}
+
+func TestReverseEntriesSinglePoint(t *testing.T) {
+	start := time.Date(2021, time.June, 1, 8, 0, 0, 0, time.UTC)
+	entries := []DataEntry{{Time: start, Latitude: 46, Distance: 2}}
+
+	ReverseEntries(entries)
+
+	if !entries[0].Time.Equal(start) || entries[0].Latitude != 46 || entries[0].Distance != 0 {
+		t.Errorf("unexpected entry %+v", entries[0])
+	}
+}
+
+func TestReverseEntriesEmpty(t *testing.T) {
+	ReverseEntries(nil)
+	ReverseEntries([]DataEntry{})
+}
+
+func TestReverseEntriesWithoutTime(t *testing.T) {
+	entries := []DataEntry{{Distance: 0}, {Distance: 1.5}}
+
+	ReverseEntries(entries)
+
+	for i, entry := range entries {
+		if !entry.Time.IsZero() {
+			t.Errorf("entry %d: expected zero time, got %v", i, entry.Time)
+		}
+	}
+	if entries[0].Distance != 0 || entries[1].Distance != 1.5 {
+		t.Errorf("unexpected distances %v, %v", entries[0].Distance, entries[1].Distance)
+	}
+}
+
+// elevation returns pointer to elevation of gps data.
+func elevation(value float64) *float64 {
+	return &value
+}
+
+func TestMapEntrySummary(t *testing.T) {
+	mapEntry := MapEntry{
+		Tracks: []GpsData{
+			{Start: "A", End: "B", Length: 6, Duration: 7200, Ascent: 100, MaxElevation: elevation(500), MinElevation: elevation(300), AvgHeartRate: 120, MaxHeartRate: 150},
+			{Start: "B", End: "C", Length: 3, Duration: 3600, Ascent: 50, MaxElevation: elevation(700), MinElevation: elevation(400)},
+		},
+	}
+
+	summary := mapEntry.Summary()
+	if summary.Start != "A" || summary.End != "C" {
+		t.Errorf("expected A - C, got %s - %s", summary.Start, summary.End)
+	}
+	if summary.Length != 9 || summary.Duration != 10800 || summary.Ascent != 150 {
+		t.Errorf("unexpected sums %+v", summary)
+	}
+	if summary.AvgSpeed != 3 {
+		t.Errorf("expected speed 3, got %v", summary.AvgSpeed)
+	}
+	if !summary.HasElevation() || *summary.MaxElevation != 700 || *summary.MinElevation != 300 {
+		t.Errorf("expected elevations 700 and 300, got %v and %v", summary.MaxElevation, summary.MinElevation)
+	}
+	if summary.AvgHeartRate != 120 || summary.MaxHeartRate != 150 {
+		t.Errorf("expected heart rate 120 and 150, got %v and %v", summary.AvgHeartRate, summary.MaxHeartRate)
+	}
+}
+
+func TestMapEntrySummarySeaLevel(t *testing.T) {
+	// Finisterre to Muxia, the last track has no elevation
+	mapEntry := MapEntry{
+		Tracks: []GpsData{
+			{Start: "Finisterre", End: "Lires", MaxElevation: elevation(250), MinElevation: elevation(0)},
+			{Start: "Lires", End: "Muxia", MaxElevation: elevation(300), MinElevation: elevation(100)},
+			{Start: "Muxia", End: "Muxia"},
+		},
+	}
+
+	summary := mapEntry.Summary()
+	if !summary.HasElevation() || *summary.MaxElevation != 300 || *summary.MinElevation != 0 {
+		t.Errorf("expected elevations 300 and 0, got %v and %v", summary.MaxElevation, summary.MinElevation)
+	}
+
+	mapEntry.Tracks = mapEntry.Tracks[2:]
+	if summary := mapEntry.Summary(); summary.HasElevation() {
+		t.Errorf("expected no elevation, got %v and %v", *summary.MaxElevation, *summary.MinElevation)
+	}
+}
+
+func TestMapEntryElevationProfile(t *testing.T) {
+	mapEntry := MapEntry{
+		Tracks: []GpsData{
+			{Profile: "[[0,300,0,0],[2.5,320,4,0]]"},
+			{Profile: "[[0,320,0,0],[1,350,3,0]]"},
+		},
+	}
+
+	profile, err := mapEntry.ElevationProfile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "[[0,300,0,0],[2.5,320,4,0],[2.5,320,0,0],[3.5,350,3,0]]"
+	if profile != expected {
+		t.Errorf("expected %s, got %s", expected, profile)
+	}
+}
+
+// stubGeocoder finds every address at the same place unless err is set.
+type stubGeocoder struct {
+	err      error
+	searches int
+}
+
+func (g *stubGeocoder) Reverse(ctx context.Context, latitude, longitude float64) (geocode.Place, error) {
+	return geocode.Place{}, errors.New("not implemented")
+}
+
+func (g *stubGeocoder) Search(ctx context.Context, address string) (geocode.Place, error) {
+	g.searches++
+	return geocode.Place{Name: address, Latitude: 45.5, Longitude: 13.6}, g.err
+}
+
+func TestLocate(t *testing.T) {
+	track := GpsData{
+		End:  "Piran",
+		Data: `[{"lat": 45.1, "lon": 13.1}, {"lat": 45.2, "lon": 13.2}]`,
+	}
+
+	tests := []struct {
+		name     string
+		mapEntry MapEntry
+		lat, lon float64
+		city     string
+		searches int
+	}{
+		{"track", MapEntry{Tracks: []GpsData{track}}, 45.2, 13.2, "Piran", 0},
+		{"city", MapEntry{City: "Koper", Tracks: []GpsData{track}}, 45.5, 13.6, "Koper", 1},
+		{"manual", MapEntry{City: "Koper", Lat: 1, Lon: 2, ManualLocation: true, GeocodePending: true}, 1, 2, "Koper", 0},
+		{"empty", MapEntry{}, 0, 0, "", 0},
+	}
+	for _, test := range tests {
+		geocoder := &stubGeocoder{}
+		mapEntry := test.mapEntry
+		if err := mapEntry.Locate(context.Background(), geocoder); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if mapEntry.Lat != test.lat || mapEntry.Lon != test.lon || mapEntry.City != test.city {
+			t.Errorf("%s: expected %s at %v, %v, got %s at %v, %v", test.name, test.city, test.lat, test.lon, mapEntry.City, mapEntry.Lat, mapEntry.Lon)
+		}
+		if mapEntry.GeocodePending {
+			t.Errorf("%s: expected geocoding not to be pending", test.name)
+		}
+		if geocoder.searches != test.searches {
+			t.Errorf("%s: expected %d searches, got %d", test.name, test.searches, geocoder.searches)
+		}
+	}
+}
+
+func TestLocateNoResults(t *testing.T) {
+	mapEntry := MapEntry{City: "Nowhere", Lat: 1, Lon: 2}
+	err := mapEntry.Locate(context.Background(), &stubGeocoder{err: geocode.NoResultsError})
+	if errors.Cause(err) != geocode.NoResultsError {
+		t.Errorf("expected no results error, got %v", err)
+	}
+	if mapEntry.Lat != 1 || mapEntry.Lon != 2 {
+		t.Errorf("expected coordinates to be kept, got %v, %v", mapEntry.Lat, mapEntry.Lon)
+	}
+}
+
+func BenchmarkSimplifiedData(b *testing.B) {
+	gpsData := testGpsData(b, 10000)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	var size int
+	for i := 0; i < b.N; i++ {
+		data, err := gpsData.SimplifiedData(DefaultTolerance)
+		if err != nil {
+			b.Fatal(err)
+		}
+		size = len(data)
+	}
+	b.ReportMetric(float64(size), "output-bytes")
+}
+
+func BenchmarkDistanceThinnedData(b *testing.B) {
+	gpsData := testGpsData(b, 10000)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	var size int
+	for i := 0; i < b.N; i++ {
+		data, err := distanceThinnedData(gpsData)
+		if err != nil {
+			b.Fatal(err)
+		}
+		size = len(data)
+	}
+	b.ReportMetric(float64(size), "output-bytes")
+}
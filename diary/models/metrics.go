@@ -0,0 +1,111 @@
+package models
+
+import "math"
+
+const (
+	// ElevationThreshold is the hysteresis in meters before elevation change counts as ascent or descent.
+	ElevationThreshold = 5.0
+	// MovingSpeed is the minimal speed in km/h counted as moving.
+	MovingSpeed = 1.0
+)
+
+// ComputeMetrics sets ascent, descent, elevation range, moving time and heart
+// rate from data entries. Entries without elevation and zero heart rates are
+// treated as missing.
+func (g *GpsData) ComputeMetrics(dataEntries []DataEntry) {
+	g.Ascent = 0
+	g.Descent = 0
+	g.MaxElevation = nil
+	g.MinElevation = nil
+	g.MovingTime = 0
+	g.AvgHeartRate = averageHeartRate(dataEntries)
+	g.MaxHeartRate = 0
+
+	reference := math.NaN()
+	for i, entry := range dataEntries {
+		if i > 0 {
+			previous := dataEntries[i-1]
+			if !entry.Time.IsZero() && !previous.Time.IsZero() {
+				hours := entry.Time.Sub(previous.Time).Hours()
+				distance := float64(entry.Distance - previous.Distance)
+				if hours > 0 && distance/hours >= MovingSpeed {
+					g.MovingTime += hours * 3600
+				}
+			}
+		}
+
+		g.MaxHeartRate = math.Max(g.MaxHeartRate, float64(entry.HeartRate))
+
+		if entry.Elevation == nil {
+			continue
+		}
+		elevation := float64(*entry.Elevation)
+
+		if math.IsNaN(reference) {
+			reference = elevation
+			maxElevation, minElevation := elevation, elevation
+			g.MaxElevation = &maxElevation
+			g.MinElevation = &minElevation
+			continue
+		}
+
+		*g.MaxElevation = math.Max(*g.MaxElevation, elevation)
+		*g.MinElevation = math.Min(*g.MinElevation, elevation)
+
+		if elevation-reference >= ElevationThreshold {
+			g.Ascent += elevation - reference
+			reference = elevation
+		} else if reference-elevation >= ElevationThreshold {
+			g.Descent += reference - elevation
+			reference = elevation
+		}
+	}
+}
+
+// SetRecordedAscent sets ascent computed elsewhere, e.g. by Strava, for the
+// recorded direction of the track. Descent is derived from it and the net
+// elevation change of data entries, so both come from the same source.
+func (g *GpsData) SetRecordedAscent(ascent float64, dataEntries []DataEntry) {
+	// change in stored direction, data entries are reversed with the track
+	change := elevationChange(dataEntries)
+	if g.Reversed {
+		g.Ascent = math.Max(ascent+change, 0)
+		g.Descent = ascent
+	} else {
+		g.Ascent = ascent
+		g.Descent = math.Max(ascent-change, 0)
+	}
+}
+
+// elevationChange returns difference between last and first recorded elevation.
+func elevationChange(dataEntries []DataEntry) float64 {
+	var first, last *Float
+	for i := range dataEntries {
+		if dataEntries[i].Elevation != nil {
+			if first == nil {
+				first = dataEntries[i].Elevation
+			}
+			last = dataEntries[i].Elevation
+		}
+	}
+	if first == nil {
+		return 0
+	}
+	return float64(*last - *first)
+}
+
+// averageHeartRate returns mean of recorded heart rates, zero when none are recorded.
+func averageHeartRate(dataEntries []DataEntry) float64 {
+	sum := 0.0
+	count := 0
+	for _, entry := range dataEntries {
+		if entry.HeartRate > 0 {
+			sum += float64(entry.HeartRate)
+			count++
+		}
+	}
+	if count == 0 {
+		return 0
+	}
+	return sum / float64(count)
+}
@@ -0,0 +1,52 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestComputeMetricsSeaLevel(t *testing.T) {
+	start := time.Date(2021, time.June, 1, 8, 0, 0, 0, time.UTC)
+	entries := []DataEntry{
+		{Time: start, Elevation: NewFloat(0)},
+		{Time: start.Add(time.Minute), Elevation: NewFloat(20), Distance: 0.1},
+		{Time: start.Add(2 * time.Minute), Distance: 0.2},
+		{Time: start.Add(3 * time.Minute), Elevation: NewFloat(0), Distance: 0.3},
+	}
+
+	gpsData := GpsData{}
+	gpsData.ComputeMetrics(entries)
+	if gpsData.Ascent != 20 || gpsData.Descent != 20 {
+		t.Errorf("expected ascent and descent 20, got %v and %v", gpsData.Ascent, gpsData.Descent)
+	}
+	if !gpsData.HasElevation() || *gpsData.MinElevation != 0 || *gpsData.MaxElevation != 20 {
+		t.Errorf("expected elevations 0 and 20, got %v and %v", gpsData.MinElevation, gpsData.MaxElevation)
+	}
+
+	gpsData.ComputeMetrics([]DataEntry{{Time: start}, {Time: start.Add(time.Minute), Distance: 0.1}})
+	if gpsData.HasElevation() {
+		t.Errorf("expected no elevation, got %v and %v", *gpsData.MinElevation, *gpsData.MaxElevation)
+	}
+}
+
+func TestSetRecordedAscent(t *testing.T) {
+	entries := []DataEntry{
+		{Elevation: NewFloat(300)},
+		{},
+		{Elevation: NewFloat(450)},
+	}
+
+	gpsData := GpsData{}
+	gpsData.SetRecordedAscent(200, entries)
+	if gpsData.Ascent != 200 || gpsData.Descent != 50 {
+		t.Errorf("expected ascent 200 and descent 50, got %v and %v", gpsData.Ascent, gpsData.Descent)
+	}
+
+	// reversed entries climb 150 m less than recorded track
+	ReverseEntries(entries)
+	gpsData = GpsData{Reversed: true}
+	gpsData.SetRecordedAscent(200, entries)
+	if gpsData.Ascent != 50 || gpsData.Descent != 200 {
+		t.Errorf("expected reversed ascent 50 and descent 200, got %v and %v", gpsData.Ascent, gpsData.Descent)
+	}
+}
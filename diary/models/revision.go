@@ -0,0 +1,148 @@
+package models
+
+import (
+	"regexp"
+
+	"github.com/jinzhu/gorm"
+	"github.com/matematik7/gongo/authorization"
+)
+
+// Revision is a saved version of a diary entry.
+type Revision struct {
+	gorm.Model
+	DiaryEntryID uint `gorm:"index"`
+	Title        string
+	Text         string `gorm:"type:text"`
+	Format       string
+	Editor       authorization.User `valid:"-"`
+	EditorID     uint
+}
+
+func (r *Revision) AfterFind() error {
+	r.CreatedAt = r.CreatedAt.In(location)
+
+	return nil
+}
+
+// Revision returns the current version of the entry edited by editorID.
+func (de DiaryEntry) Revision(editorID uint) Revision {
+	return Revision{
+		DiaryEntryID: de.ID,
+		Title:        de.Title,
+		Text:         de.Text,
+		Format:       de.Format,
+		EditorID:     editorID,
+	}
+}
+
+// SaveRevision stores revision unless it equals the latest revision of the entry.
+func SaveRevision(db *gorm.DB, revision Revision) error {
+	var latest Revision
+	query := db.Where("diary_entry_id = ?", revision.DiaryEntryID).Order("id desc").First(&latest)
+	if query.Error != nil && !query.RecordNotFound() {
+		return query.Error
+	}
+	if !query.RecordNotFound() && latest.Title == revision.Title && latest.Text == revision.Text && latest.Format == revision.Format {
+		return nil
+	}
+
+	return db.Create(&revision).Error
+}
+
+// DiffOp is a part of the difference between two texts.
+type DiffOp struct {
+	// Type is one of "equal", "insert" or "delete".
+	Type string
+	Text string
+}
+
+var diffTokens = regexp.MustCompile(`<[^>]*>|\s+|[^<\s]+`)
+
+// maxDiffCells limits the lcs table to 16 MB, a larger changed part is shown
+// as deleted and inserted as a whole.
+const maxDiffCells = 4 << 20
+
+// Diff compares two texts word by word, html tags are compared as whole words.
+func Diff(a, b string) []DiffOp {
+	at := diffTokens.FindAllString(a, -1)
+	bt := diffTokens.FindAllString(b, -1)
+
+	// common prefix and suffix keep the table small for usual edits
+	prefix := 0
+	for prefix < len(at) && prefix < len(bt) && at[prefix] == bt[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(at)-prefix && suffix < len(bt)-prefix &&
+		at[len(at)-1-suffix] == bt[len(bt)-1-suffix] {
+		suffix++
+	}
+
+	var ops []DiffOp
+	add := func(typ string, text string) {
+		if len(ops) > 0 && ops[len(ops)-1].Type == typ {
+			ops[len(ops)-1].Text += text
+			return
+		}
+		ops = append(ops, DiffOp{Type: typ, Text: text})
+	}
+
+	for _, t := range at[:prefix] {
+		add("equal", t)
+	}
+
+	am := at[prefix : len(at)-suffix]
+	bm := bt[prefix : len(bt)-suffix]
+
+	if len(am)*len(bm) > maxDiffCells {
+		for _, t := range am {
+			add("delete", t)
+		}
+		for _, t := range bm {
+			add("insert", t)
+		}
+		for _, t := range at[len(at)-suffix:] {
+			add("equal", t)
+		}
+		return ops
+	}
+
+	// lcs[i][j] is length of the longest common subsequence of am[i:] and bm[j:]
+	lcs := make([][]int32, len(am)+1)
+	for i := range lcs {
+		lcs[i] = make([]int32, len(bm)+1)
+	}
+	for i := len(am) - 1; i >= 0; i-- {
+		for j := len(bm) - 1; j >= 0; j-- {
+			if am[i] == bm[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(am) || j < len(bm) {
+		switch {
+		case i < len(am) && j < len(bm) && am[i] == bm[j]:
+			add("equal", am[i])
+			i++
+			j++
+		case j < len(bm) && (i == len(am) || lcs[i][j+1] > lcs[i+1][j]):
+			add("insert", bm[j])
+			j++
+		default:
+			add("delete", am[i])
+			i++
+		}
+	}
+
+	for _, t := range at[len(at)-suffix:] {
+		add("equal", t)
+	}
+
+	return ops
+}
@@ -0,0 +1,81 @@
+package models
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	ops := Diff("<p>Danes smo hodili do Leona.</p>", "<p>Danes smo kolesarili do Leona. Bilo je lepo.</p>")
+	want := []DiffOp{
+		{Type: "equal", Text: "<p>Danes smo "},
+		{Type: "delete", Text: "hodili"},
+		{Type: "insert", Text: "kolesarili"},
+		{Type: "equal", Text: " do Leona."},
+		{Type: "insert", Text: " Bilo je lepo."},
+		{Type: "equal", Text: "</p>"},
+	}
+	if !reflect.DeepEqual(ops, want) {
+		t.Errorf("got %#v, want %#v", ops, want)
+	}
+}
+
+func TestDiffReplaced(t *testing.T) {
+	a := "<p>Začetek</p>" + strings.Repeat("staro ", 2100) + "<p>Konec</p>"
+	b := "<p>Začetek</p>" + strings.Repeat("novo ", 2100) + "<p>Konec</p>"
+
+	ops := Diff(a, b)
+	types := []string{}
+	for _, op := range ops {
+		types = append(types, op.Type)
+	}
+	if want := []string{"equal", "delete", "insert", "equal"}; !reflect.DeepEqual(types, want) {
+		t.Fatalf("got ops %v, want %v", types, want)
+	}
+	if ops[0].Text != "<p>Začetek</p>" || ops[3].Text != " <p>Konec</p>" {
+		t.Errorf("unexpected common parts %q and %q", ops[0].Text, ops[3].Text)
+	}
+	if ops[1].Text != strings.TrimSuffix(strings.Repeat("staro ", 2100), " ") {
+		t.Errorf("unexpected deleted text %q", ops[1].Text)
+	}
+}
+
+func TestDiffEqual(t *testing.T) {
+	ops := Diff("enako besedilo", "enako besedilo")
+	want := []DiffOp{{Type: "equal", Text: "enako besedilo"}}
+	if !reflect.DeepEqual(ops, want) {
+		t.Errorf("got %#v, want %#v", ops, want)
+	}
+
+	if ops := Diff("", ""); len(ops) != 0 {
+		t.Errorf("got %#v for empty texts", ops)
+	}
+}
+
+func TestSaveRevision(t *testing.T) {
+	DB := newTestDB(t)
+	if err := DB.AutoMigrate(&Revision{}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	entry := DiaryEntry{Title: "Naslov", Text: "Prvo"}
+	if err := DB.Create(&entry).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	for _, text := range []string{"Prvo", "Prvo", "Drugo", "Prvo"} {
+		entry.Text = text
+		if err := SaveRevision(DB, entry.Revision(1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var texts []string
+	if err := DB.Model(&Revision{}).Where("diary_entry_id = ?", entry.ID).Order("id").Pluck("text", &texts).Error; err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"Prvo", "Drugo", "Prvo"}; !reflect.DeepEqual(texts, want) {
+		t.Errorf("got revisions %v, want %v", texts, want)
+	}
+}
@@ -0,0 +1,59 @@
+package models
+
+import (
+	"html"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+// SearchConfig is the text search configuration for diary search. Postgres
+// has no slovenian dictionary, so words are only lowercased and stripped of
+// accents, which lets "cesnja" match "češnja".
+const SearchConfig = "sl_unaccent"
+
+// markers around matched words in snippets, they are replaced after html escaping
+const (
+	startSel = "\x01"
+	stopSel  = "\x02"
+)
+
+// searchText is the searched text of an entry without html tags.
+const searchText = `concat_ws(' ',
+	regexp_replace(diary_entries.text, '<[^>]*>', ' ', 'g'),
+	search_me.city,
+	search_c.comments)`
+
+// Search returns query over diary entries matching the web search style
+// query q, ordered by relevance. Entries get Snippet with matched words.
+//
+// The document includes city and comments from other tables, so it cannot be
+// indexed and is built for every entry on each search. That is fast enough for
+// a diary with a few thousand entries, larger ones would need a stored
+// tsvector column kept up to date on save.
+func Search(db *gorm.DB, q string) *gorm.DB {
+	document := `setweight(to_tsvector('` + SearchConfig + `', diary_entries.title), 'A') ||
+		setweight(to_tsvector('` + SearchConfig + `', ` + searchText + `), 'B')`
+
+	return db.Model(&DiaryEntry{}).
+		Select(`diary_entries.*,
+			ts_headline('`+SearchConfig+`', `+searchText+`, search_q.q,
+				'StartSel=`+startSel+`, StopSel=`+stopSel+`, MaxWords=35, MinWords=15, MaxFragments=2') as snippet`).
+		Joins("CROSS JOIN websearch_to_tsquery('"+SearchConfig+"', ?) search_q(q)", q).
+		Joins("LEFT JOIN map_entries search_me ON search_me.id = diary_entries.map_entry_id").
+		Joins(`LEFT JOIN (
+			SELECT diary_entry_id, string_agg(comment, ' ') as comments
+			FROM comments
+			WHERE comments.deleted_at IS NULL
+			GROUP BY diary_entry_id
+		) search_c ON search_c.diary_entry_id = diary_entries.id`).
+		Where("(" + document + ") @@ search_q.q").
+		Order("ts_rank(" + document + ", search_q.q) desc").
+		Order(DateColumn + " desc")
+}
+
+// Highlight escapes a snippet returned by Search and marks matched words.
+func Highlight(snippet string) string {
+	snippet = html.EscapeString(html.UnescapeString(snippet))
+	return strings.NewReplacer(startSel, "<mark>", stopSel, "</mark>").Replace(snippet)
+}
@@ -0,0 +1,11 @@
+package models
+
+import "testing"
+
+func TestHighlight(t *testing.T) {
+	got := Highlight("Pot do \x01Leóna\x02 &amp; <b>nazaj</b>")
+	want := "Pot do <mark>Leóna</mark> &amp; &lt;b&gt;nazaj&lt;/b&gt;"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,32 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// StravaImport marks a strava activity that was turned into a draft entry.
+type StravaImport struct {
+	ActivityID int `gorm:"primary_key;auto_increment:false"`
+	CreatedAt  time.Time
+}
+
+// ClaimStravaImport marks activity as imported, it returns false when it was
+// already claimed, so strava events delivered more than once create one entry.
+func ClaimStravaImport(db *gorm.DB, activityID int, now time.Time) (bool, error) {
+	query := db.Exec(
+		"INSERT INTO strava_imports (activity_id, created_at) VALUES (?, ?) ON CONFLICT DO NOTHING",
+		activityID,
+		now,
+	)
+	if query.Error != nil {
+		return false, query.Error
+	}
+	return query.RowsAffected == 1, nil
+}
+
+// ReleaseStravaImport removes the claim, so the activity can be imported again.
+func ReleaseStravaImport(db *gorm.DB, activityID int) error {
+	return db.Where("activity_id = ?", activityID).Delete(&StravaImport{}).Error
+}
@@ -0,0 +1,31 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClaimStravaImport(t *testing.T) {
+	DB := newTestDB(t)
+	if err := DB.AutoMigrate(&StravaImport{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2021, 9, 9, 8, 0, 0, 0, time.UTC)
+
+	if claimed, err := ClaimStravaImport(DB, 42, now); err != nil || !claimed {
+		t.Fatalf("first claim = %v, %v", claimed, err)
+	}
+	if claimed, err := ClaimStravaImport(DB, 42, now); err != nil || claimed {
+		t.Fatalf("second claim = %v, %v", claimed, err)
+	}
+	if claimed, err := ClaimStravaImport(DB, 43, now); err != nil || !claimed {
+		t.Errorf("claim of other activity = %v, %v", claimed, err)
+	}
+
+	if err := ReleaseStravaImport(DB, 42); err != nil {
+		t.Fatal(err)
+	}
+	if claimed, err := ClaimStravaImport(DB, 42, now); err != nil || !claimed {
+		t.Errorf("claim after release = %v, %v", claimed, err)
+	}
+}
@@ -0,0 +1,90 @@
+package models
+
+import (
+	"strings"
+
+	"github.com/gosimple/slug"
+	"github.com/jinzhu/gorm"
+)
+
+// Tag groups diary entries, e.g. one trip or a tournament.
+type Tag struct {
+	gorm.Model
+	Name string
+	Slug string `gorm:"unique_index"`
+
+	// Count is number of entries with the tag and Weight its size in the
+	// cloud from 1 to 5, both are set by TagCloud.
+	Count  int `gorm:"-"`
+	Weight int `gorm:"-"`
+}
+
+// ParseTags parses comma separated tag names, tags with the same slug are
+// merged.
+func ParseTags(value string) []Tag {
+	var tags []Tag
+	seen := map[string]bool{}
+	for _, name := range strings.Split(value, ",") {
+		name = strings.Join(strings.Fields(name), " ")
+		tagSlug := slug.Make(name)
+		if tagSlug == "" || seen[tagSlug] {
+			continue
+		}
+		seen[tagSlug] = true
+		tags = append(tags, Tag{Name: name, Slug: tagSlug})
+	}
+	return tags
+}
+
+// FindOrCreateTags returns stored tags with the same slugs, missing ones are created.
+func FindOrCreateTags(db *gorm.DB, tags []Tag) ([]Tag, error) {
+	stored := make([]Tag, 0, len(tags))
+	for _, tag := range tags {
+		if err := db.Where(Tag{Slug: tag.Slug}).Attrs(Tag{Name: tag.Name}).FirstOrCreate(&tag).Error; err != nil {
+			return nil, err
+		}
+		stored = append(stored, tag)
+	}
+	return stored, nil
+}
+
+// TagNames returns comma separated names of the entry tags.
+func (de DiaryEntry) TagNames() string {
+	names := make([]string, len(de.Tags))
+	for i, tag := range de.Tags {
+		names[i] = tag.Name
+	}
+	return strings.Join(names, ", ")
+}
+
+// TagCloud returns tags of published entries with their counts and weights,
+// ordered by name.
+func TagCloud(db *gorm.DB) ([]Tag, error) {
+	var tags []Tag
+	err := db.Model(&Tag{}).
+		Select("tags.*, COUNT(diary_entries.id) as count").
+		Joins("JOIN diary_entry_tags ON diary_entry_tags.tag_id = tags.id").
+		Joins("JOIN diary_entries ON diary_entries.id = diary_entry_tags.diary_entry_id AND diary_entries.deleted_at IS NULL").
+		Where("diary_entries.published = ?", true).
+		Group("tags.id").
+		Order("tags.name").
+		Find(&tags).Error
+	if err != nil {
+		return nil, err
+	}
+
+	max := 0
+	for _, tag := range tags {
+		if tag.Count > max {
+			max = tag.Count
+		}
+	}
+	for i := range tags {
+		tags[i].Weight = 1
+		if max > 1 {
+			tags[i].Weight += 4 * (tags[i].Count - 1) / (max - 1)
+		}
+	}
+
+	return tags, nil
+}
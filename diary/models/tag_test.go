@@ -0,0 +1,72 @@
+package models
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseTags(t *testing.T) {
+	tags := ParseTags(" Camino  Francés, hribi,,camino frances, Pikado ")
+	want := []Tag{
+		{Name: "Camino Francés", Slug: "camino-frances"},
+		{Name: "hribi", Slug: "hribi"},
+		{Name: "Pikado", Slug: "pikado"},
+	}
+	if !reflect.DeepEqual(tags, want) {
+		t.Errorf("got %+v, want %+v", tags, want)
+	}
+
+	if tags := ParseTags(" , "); len(tags) != 0 {
+		t.Errorf("got %+v for empty tags", tags)
+	}
+}
+
+func TestTagCloud(t *testing.T) {
+	DB := newTestDB(t)
+	if err := DB.AutoMigrate(&Tag{}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	tags, err := FindOrCreateTags(DB, ParseTags("Camino, Hribi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := FindOrCreateTags(DB, ParseTags("camino"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(again) != 1 || again[0].ID != tags[0].ID || again[0].Name != "Camino" {
+		t.Fatalf("existing tag not found: %+v", again)
+	}
+
+	entries := []DiaryEntry{
+		{Title: "1", Published: true, Tags: tags},
+		{Title: "2", Published: true, Tags: tags[:1]},
+		{Title: "3", Tags: tags[1:]},
+	}
+	for i := range entries {
+		if err := DB.Create(&entries[i]).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cloud, err := TagCloud(DB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := map[string][2]int{}
+	for _, tag := range cloud {
+		counts[tag.Slug] = [2]int{tag.Count, tag.Weight}
+	}
+	if want := map[string][2]int{"camino": {2, 5}, "hribi": {1, 1}}; !reflect.DeepEqual(counts, want) {
+		t.Errorf("got counts and weights %v, want %v", counts, want)
+	}
+
+	var entry DiaryEntry
+	if err := DB.Preload("Tags").First(&entry, entries[0].ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if names := entry.TagNames(); names != "Camino, Hribi" {
+		t.Errorf("got tag names %q", names)
+	}
+}
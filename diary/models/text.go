@@ -0,0 +1,44 @@
+package models
+
+import (
+	"regexp"
+
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/russross/blackfriday"
+)
+
+// Formats of the diary entry text.
+const (
+	FormatHTML     = "html"
+	FormatMarkdown = "markdown"
+)
+
+var policy = newPolicy()
+
+// newPolicy allows user generated content and formatting summernote editor produces.
+func newPolicy() *bluemonday.Policy {
+	p := bluemonday.UGCPolicy()
+	p.AllowStyles("text-align", "color", "background-color", "float", "width", "height").Globally()
+	p.AllowAttrs("class").Matching(regexp.MustCompile(`^note-video-clip$`)).OnElements("iframe")
+	p.AllowAttrs("src").
+		Matching(regexp.MustCompile(`^(https?:)?//(www\.youtube\.com/embed/|player\.vimeo\.com/video/)`)).
+		OnElements("iframe")
+	p.AllowAttrs("width", "height").Matching(bluemonday.NumberOrPercent).OnElements("iframe")
+	p.AllowAttrs("frameborder").Matching(bluemonday.Integer).OnElements("iframe")
+	p.AllowAttrs("allowfullscreen").Matching(regexp.MustCompile(`^(allowfullscreen)?$`)).OnElements("iframe")
+	return p
+}
+
+// Sanitize removes elements and attributes that are not allowed in diary text.
+func Sanitize(html string) string {
+	return policy.Sanitize(html)
+}
+
+// HTML returns the sanitized text of the entry, markdown is converted to html.
+func (de DiaryEntry) HTML() string {
+	text := de.Text
+	if de.Format == FormatMarkdown {
+		text = string(blackfriday.MarkdownCommon([]byte(text)))
+	}
+	return Sanitize(text)
+}
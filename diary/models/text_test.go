@@ -0,0 +1,48 @@
+package models
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSanitize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{`<p>Buen <b>camino</b></p>`, `<p>Buen <b>camino</b></p>`},
+		{`<p onclick="alert(1)">x</p><script>alert(1)</script>`, `<p>x</p>`},
+		{`<a href="javascript:alert(1)">x</a>`, `x`},
+		{`<p style="text-align: center; position: fixed">x</p>`, `<p style="text-align: center">x</p>`},
+		{
+			`<iframe frameborder="0" src="//www.youtube.com/embed/abc" width="640" height="360" class="note-video-clip"></iframe>`,
+			`<iframe frameborder="0" src="//www.youtube.com/embed/abc" width="640" height="360" class="note-video-clip"></iframe>`,
+		},
+		{`<iframe src="https://example.com/"></iframe>`, ``},
+	}
+
+	for _, test := range tests {
+		if got := Sanitize(test.in); got != test.want {
+			t.Errorf("Sanitize(%q) = %q, want %q", test.in, got, test.want)
+		}
+	}
+}
+
+func TestEntryHTML(t *testing.T) {
+	entry := DiaryEntry{
+		Text:   "Danes **lepo** vreme.\n\n<script>alert(1)</script>",
+		Format: FormatMarkdown,
+	}
+	html := entry.HTML()
+	if !strings.Contains(html, "<p>Danes <strong>lepo</strong> vreme.</p>") {
+		t.Errorf("markdown not converted: %q", html)
+	}
+	if strings.Contains(html, "<script>") {
+		t.Errorf("script not removed: %q", html)
+	}
+
+	entry = DiaryEntry{Text: "<p>**ni markdown**</p>"}
+	if html := entry.HTML(); html != "<p>**ni markdown**</p>" {
+		t.Errorf("html entry changed: %q", html)
+	}
+}
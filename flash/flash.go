@@ -0,0 +1,28 @@
+// Package flash has messages shown once on the next rendered page.
+package flash
+
+import "encoding/gob"
+
+type Flash struct {
+	Type    string
+	Message string
+}
+
+func Info(msg string) Flash {
+	return Flash{
+		Type:    "info",
+		Message: msg,
+	}
+}
+
+func Error(msg string) Flash {
+	return Flash{
+		Type:    "danger",
+		Message: msg,
+	}
+}
+
+func init() {
+	// name of the type when it was in diary, so flashes in sessions still decode
+	gob.RegisterName("*diary.Flash", &Flash{})
+}
@@ -0,0 +1,159 @@
+package geocode
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/matematik7/gongo"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"googlemaps.github.io/maps"
+)
+
+var NoResultsError = errors.New("no results for geocode")
+
+const (
+	DefaultNominatimURL = "https://nominatim.openstreetmap.org"
+	DefaultTimeout      = 10 * time.Second
+
+	// CachePrecision is number of decimals coordinates are rounded to for
+	// reverse lookups, three decimals are roughly 100 m.
+	CachePrecision = 3
+)
+
+// Place is a geocoding result.
+type Place struct {
+	Name      string
+	Latitude  float64
+	Longitude float64
+}
+
+// Geocoder converts between coordinates and place names.
+type Geocoder interface {
+	// Reverse returns name of the city at the coordinates.
+	Reverse(ctx context.Context, latitude, longitude float64) (Place, error)
+	// Search returns coordinates of the address.
+	Search(ctx context.Context, address string) (Place, error)
+}
+
+// Service is a cached geocoder, providers are tried in order until one of them
+// answers.
+type Service struct {
+	DB        *gorm.DB
+	Providers []Geocoder
+
+	log *logrus.Logger
+}
+
+func New() *Service {
+	return &Service{}
+}
+
+// Configure sets up providers listed in geocoder config (google, nominatim),
+// unless they were already set.
+func (s *Service) Configure(app gongo.App) error {
+	s.DB = app["DB"].(*gorm.DB)
+	s.log = app["Log"].(*logrus.Logger)
+
+	if len(s.Providers) > 0 {
+		return nil
+	}
+
+	viper.SetDefault("geocoder", "google")
+	viper.SetDefault("nominatim_url", DefaultNominatimURL)
+	for _, name := range strings.Split(viper.GetString("geocoder"), ",") {
+		switch strings.TrimSpace(name) {
+		case "google":
+			client, err := maps.NewClient(maps.WithAPIKey(viper.GetString("GMAP_SERVER_KEY")))
+			if err != nil {
+				return errors.Wrap(err, "could not get maps client")
+			}
+			s.Providers = append(s.Providers, &Google{Client: client})
+		case "nominatim":
+			s.Providers = append(s.Providers, &Nominatim{
+				Client:    &http.Client{Timeout: DefaultTimeout},
+				BaseURL:   viper.GetString("nominatim_url"),
+				UserAgent: fmt.Sprintf("camino-go (%s)", viper.GetString("url")),
+			})
+		default:
+			return errors.Errorf("unknown geocoder %q", name)
+		}
+	}
+
+	return nil
+}
+
+func (s *Service) Resources() []interface{} {
+	return []interface{}{
+		&CacheEntry{},
+	}
+}
+
+func (s *Service) Reverse(ctx context.Context, latitude, longitude float64) (Place, error) {
+	key := fmt.Sprintf("reverse:%.*f,%.*f", CachePrecision, round(latitude), CachePrecision, round(longitude))
+	return s.cached(key, func(provider Geocoder) (Place, error) {
+		return provider.Reverse(ctx, latitude, longitude)
+	})
+}
+
+func (s *Service) Search(ctx context.Context, address string) (Place, error) {
+	key := "search:" + strings.ToLower(strings.TrimSpace(address))
+	return s.cached(key, func(provider Geocoder) (Place, error) {
+		return provider.Search(ctx, address)
+	})
+}
+
+// cached returns place from cache or asks providers in order, the first
+// result or no results answer is used.
+func (s *Service) cached(key string, lookup func(provider Geocoder) (Place, error)) (Place, error) {
+	var entry CacheEntry
+	query := s.DB.Where("key = ?", key).First(&entry)
+	if query.Error == nil {
+		return entry.Place(), nil
+	} else if !query.RecordNotFound() {
+		return Place{}, errors.Wrap(query.Error, "could not get geocode cache")
+	}
+
+	if len(s.Providers) == 0 {
+		return Place{}, errors.New("no geocoding providers")
+	}
+
+	var err error
+	for _, provider := range s.Providers {
+		var place Place
+		place, err = lookup(provider)
+		if err == NoResultsError {
+			return Place{}, err
+		} else if err != nil {
+			if s.log != nil {
+				s.log.Warn(errors.Wrapf(err, "geocoding %s failed", key))
+			}
+			continue
+		}
+
+		entry = CacheEntry{
+			Key:       key,
+			Name:      place.Name,
+			Latitude:  place.Latitude,
+			Longitude: place.Longitude,
+		}
+		// a failed cache write only costs another lookup later
+		if err := s.DB.Save(&entry).Error; err != nil && s.log != nil {
+			s.log.Warn(errors.Wrap(err, "could not save geocode cache"))
+		}
+		return place, nil
+	}
+
+	return Place{}, err
+}
+
+func round(value float64) float64 {
+	scale := math.Pow(10, CachePrecision)
+	return math.Round(value*scale) / scale
+}
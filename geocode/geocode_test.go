@@ -0,0 +1,200 @@
+package geocode
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"github.com/pkg/errors"
+)
+
+// stubGeocoder answers from a fixed place and counts lookups, it fails when
+// err is set.
+type stubGeocoder struct {
+	place   Place
+	err     error
+	lookups int
+}
+
+func (g *stubGeocoder) Reverse(ctx context.Context, latitude, longitude float64) (Place, error) {
+	g.lookups++
+	return g.place, g.err
+}
+
+func (g *stubGeocoder) Search(ctx context.Context, address string) (Place, error) {
+	g.lookups++
+	return g.place, g.err
+}
+
+func newTestService(t *testing.T, providers ...Geocoder) *Service {
+	DB, err := gorm.Open("sqlite3", filepath.Join(t.TempDir(), "geocode.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { DB.Close() })
+
+	if err := DB.AutoMigrate(&CacheEntry{}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	return &Service{
+		DB:        DB,
+		Providers: providers,
+	}
+}
+
+func TestReverseCached(t *testing.T) {
+	stub := &stubGeocoder{place: Place{Name: "Ljubljana", Latitude: 46.0512, Longitude: 14.5051}}
+	s := newTestService(t, stub)
+
+	for _, location := range [][]float64{{46.0512, 14.5051}, {46.0514, 14.5049}} {
+		place, err := s.Reverse(context.Background(), location[0], location[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if place.Name != "Ljubljana" {
+			t.Errorf("expected Ljubljana, got %q", place.Name)
+		}
+	}
+	if stub.lookups != 1 {
+		t.Errorf("expected nearby locations to share cache, got %d lookups", stub.lookups)
+	}
+
+	if _, err := s.Reverse(context.Background(), 46.1, 14.5); err != nil {
+		t.Fatal(err)
+	}
+	if stub.lookups != 2 {
+		t.Errorf("expected lookup for distant location, got %d lookups", stub.lookups)
+	}
+}
+
+func TestSearchCached(t *testing.T) {
+	stub := &stubGeocoder{place: Place{Name: "Ljubljana", Latitude: 46.0512, Longitude: 14.5051}}
+	s := newTestService(t, stub)
+
+	for _, address := range []string{"Ljubljana", " ljubljana "} {
+		place, err := s.Search(context.Background(), address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if place.Latitude != 46.0512 || place.Longitude != 14.5051 {
+			t.Errorf("unexpected place %+v", place)
+		}
+	}
+	if stub.lookups != 1 {
+		t.Errorf("expected one lookup, got %d", stub.lookups)
+	}
+}
+
+func TestFallback(t *testing.T) {
+	failing := &stubGeocoder{err: errors.New("unreachable")}
+	working := &stubGeocoder{place: Place{Name: "Koper"}}
+	s := newTestService(t, failing, working)
+
+	place, err := s.Reverse(context.Background(), 45.54, 13.73)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if place.Name != "Koper" {
+		t.Errorf("expected Koper, got %q", place.Name)
+	}
+	if failing.lookups != 1 || working.lookups != 1 {
+		t.Errorf("expected one lookup each, got %d and %d", failing.lookups, working.lookups)
+	}
+}
+
+func TestNoResults(t *testing.T) {
+	empty := &stubGeocoder{err: NoResultsError}
+	other := &stubGeocoder{place: Place{Name: "Koper"}}
+	s := newTestService(t, empty, other)
+
+	if _, err := s.Search(context.Background(), "Nowhere"); err != NoResultsError {
+		t.Errorf("expected no results error, got %v", err)
+	}
+	if other.lookups != 0 {
+		t.Errorf("expected no fallback after no results, got %d lookups", other.lookups)
+	}
+
+	// no results are not cached
+	empty.err = nil
+	if _, err := s.Search(context.Background(), "Nowhere"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAllProvidersFail(t *testing.T) {
+	s := newTestService(t, &stubGeocoder{err: errors.New("unreachable")})
+
+	if _, err := s.Reverse(context.Background(), 46, 14); err == nil {
+		t.Error("expected error")
+	}
+}
+
+func newTestNominatim(t *testing.T) *Nominatim {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/reverse", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("User-Agent") != "test" {
+			t.Errorf("expected user agent, got %q", r.Header.Get("User-Agent"))
+		}
+		if r.URL.Query().Get("lat") == "0" {
+			fmt.Fprint(w, `{"error": "Unable to geocode"}`)
+			return
+		}
+		fmt.Fprint(w, `{"lat": "46.05", "lon": "14.50", "display_name": "Prešernov trg, Ljubljana, Slovenija", "address": {"road": "Prešernov trg", "city": "Ljubljana"}}`)
+	})
+	mux.HandleFunc("/search", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("q") != "Piran" {
+			fmt.Fprint(w, `[]`)
+			return
+		}
+		fmt.Fprint(w, `[{"lat": "45.5283", "lon": "13.5683", "display_name": "Piran, Slovenija", "address": {"town": "Piran"}}]`)
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	return &Nominatim{
+		Client:    &http.Client{Timeout: time.Second},
+		BaseURL:   server.URL + "/",
+		UserAgent: "test",
+	}
+}
+
+func TestNominatimReverse(t *testing.T) {
+	n := newTestNominatim(t)
+
+	place, err := n.Reverse(context.Background(), 46.0512, 14.5051)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Place{Name: "Ljubljana", Latitude: 46.0512, Longitude: 14.5051}
+	if place != expected {
+		t.Errorf("expected %+v, got %+v", expected, place)
+	}
+
+	if _, err := n.Reverse(context.Background(), 0, 0); err != NoResultsError {
+		t.Errorf("expected no results error, got %v", err)
+	}
+}
+
+func TestNominatimSearch(t *testing.T) {
+	n := newTestNominatim(t)
+
+	place, err := n.Search(context.Background(), "Piran")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Place{Name: "Piran", Latitude: 45.5283, Longitude: 13.5683}
+	if place != expected {
+		t.Errorf("expected %+v, got %+v", expected, place)
+	}
+
+	if _, err := n.Search(context.Background(), "Nowhere"); err != NoResultsError {
+		t.Errorf("expected no results error, got %v", err)
+	}
+}
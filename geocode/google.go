@@ -0,0 +1,61 @@
+package geocode
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"googlemaps.github.io/maps"
+)
+
+// Google geocodes with Google Maps Geocoding API.
+type Google struct {
+	Client *maps.Client
+}
+
+func (g *Google) Reverse(ctx context.Context, latitude, longitude float64) (Place, error) {
+	result, err := g.Client.Geocode(ctx, &maps.GeocodingRequest{
+		LatLng: &maps.LatLng{
+			Lat: latitude,
+			Lng: longitude,
+		},
+	})
+	if err != nil {
+		return Place{}, errors.Wrap(err, "could not get geocode result")
+	}
+	if len(result) < 1 {
+		return Place{}, NoResultsError
+	}
+
+	place := Place{
+		Name:      result[0].FormattedAddress,
+		Latitude:  latitude,
+		Longitude: longitude,
+	}
+	for _, ac := range result[0].AddressComponents {
+		for _, typ := range ac.Types {
+			if typ == "locality" {
+				place.Name = ac.LongName
+				return place, nil
+			}
+		}
+	}
+	return place, nil
+}
+
+func (g *Google) Search(ctx context.Context, address string) (Place, error) {
+	result, err := g.Client.Geocode(ctx, &maps.GeocodingRequest{
+		Address: address,
+	})
+	if err != nil {
+		return Place{}, errors.Wrap(err, "could not get geocode result")
+	}
+	if len(result) < 1 {
+		return Place{}, NoResultsError
+	}
+
+	return Place{
+		Name:      result[0].FormattedAddress,
+		Latitude:  result[0].Geometry.Location.Lat,
+		Longitude: result[0].Geometry.Location.Lng,
+	}, nil
+}
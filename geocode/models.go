@@ -0,0 +1,25 @@
+package geocode
+
+import "github.com/jinzhu/gorm"
+
+// CacheEntry is a stored geocoding result, key is a rounded location for
+// reverse lookups or a normalized address for searches.
+type CacheEntry struct {
+	gorm.Model
+	Key       string `gorm:"unique_index"`
+	Name      string
+	Latitude  float64
+	Longitude float64
+}
+
+func (CacheEntry) TableName() string {
+	return "geocode_cache"
+}
+
+func (e CacheEntry) Place() Place {
+	return Place{
+		Name:      e.Name,
+		Latitude:  e.Latitude,
+		Longitude: e.Longitude,
+	}
+}
@@ -0,0 +1,124 @@
+package geocode
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Nominatim geocodes with a Nominatim compatible API, like the public
+// OpenStreetMap instance or a self hosted one.
+type Nominatim struct {
+	Client    *http.Client
+	BaseURL   string
+	UserAgent string
+}
+
+type nominatimPlace struct {
+	Lat         string            `json:"lat"`
+	Lon         string            `json:"lon"`
+	DisplayName string            `json:"display_name"`
+	Address     map[string]string `json:"address"`
+	Error       string            `json:"error"`
+}
+
+// cityKeys are address fields checked in order for the name of a place.
+var cityKeys = []string{"city", "town", "village", "hamlet", "municipality"}
+
+func (n *Nominatim) get(ctx context.Context, path string, params url.Values, v interface{}) error {
+	params.Set("format", "jsonv2")
+	params.Set("accept-language", "sl")
+
+	req, err := http.NewRequest("GET", strings.TrimRight(n.BaseURL, "/")+path+"?"+params.Encode(), nil)
+	if err != nil {
+		return errors.Wrap(err, "could not create nominatim request")
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("User-Agent", n.UserAgent)
+
+	resp, err := n.Client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "could not get nominatim response")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("nominatim returned %s", resp.Status)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return errors.Wrap(err, "could not decode nominatim response")
+	}
+	return nil
+}
+
+func (p nominatimPlace) place() (Place, error) {
+	latitude, err := strconv.ParseFloat(p.Lat, 64)
+	if err != nil {
+		return Place{}, errors.Wrap(err, "invalid nominatim latitude")
+	}
+	longitude, err := strconv.ParseFloat(p.Lon, 64)
+	if err != nil {
+		return Place{}, errors.Wrap(err, "invalid nominatim longitude")
+	}
+
+	place := Place{
+		Name:      p.DisplayName,
+		Latitude:  latitude,
+		Longitude: longitude,
+	}
+	for _, key := range cityKeys {
+		if name := p.Address[key]; name != "" {
+			place.Name = name
+			break
+		}
+	}
+	return place, nil
+}
+
+func (n *Nominatim) Reverse(ctx context.Context, latitude, longitude float64) (Place, error) {
+	var result nominatimPlace
+	err := n.get(ctx, "/reverse", url.Values{
+		"lat":  {fmt.Sprint(latitude)},
+		"lon":  {fmt.Sprint(longitude)},
+		"zoom": {"14"},
+	}, &result)
+	if err != nil {
+		return Place{}, err
+	}
+	if result.Error != "" {
+		return Place{}, NoResultsError
+	}
+
+	place, err := result.place()
+	if err != nil {
+		return Place{}, err
+	}
+	// keep the asked location, nominatim returns location of the found object
+	place.Latitude = latitude
+	place.Longitude = longitude
+	return place, nil
+}
+
+func (n *Nominatim) Search(ctx context.Context, address string) (Place, error) {
+	var results []nominatimPlace
+	err := n.get(ctx, "/search", url.Values{
+		"q":              {address},
+		"limit":          {"1"},
+		"addressdetails": {"1"},
+	}, &results)
+	if err != nil {
+		return Place{}, err
+	}
+	if len(results) < 1 {
+		return Place{}, NoResultsError
+	}
+
+	return results[0].place()
+}
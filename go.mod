@@ -1,6 +1,6 @@
 module github.com/matematik7/camino-go
 
-go 1.13
+go 1.15
 
 require (
 	github.com/0xAX/notificator v0.0.0-20191016112426-3962a5ea8da1 // indirect
@@ -20,7 +20,7 @@ require (
 	github.com/gorilla/csrf v1.7.1
 	github.com/gorilla/mux v1.8.0 // indirect
 	github.com/gorilla/sessions v1.2.1
-	github.com/gosimple/slug v1.10.0 // indirect
+	github.com/gosimple/slug v1.10.0
 	github.com/jinzhu/gorm v1.9.16
 	github.com/jinzhu/now v1.1.2 // indirect
 	github.com/json-iterator/go v1.1.11
@@ -30,7 +30,8 @@ require (
 	github.com/markbates/goth v1.68.0 // indirect
 	github.com/matematik7/gongo v0.0.0-20200202165922-0ccb4e7ad925
 	github.com/mattn/go-shellwords v1.0.11 // indirect
-	github.com/microcosm-cc/bluemonday v1.0.15 // indirect
+	github.com/mattn/go-sqlite3 v2.0.1+incompatible // indirect
+	github.com/microcosm-cc/bluemonday v1.0.15
 	github.com/modern-go/concurrent v0.0.0-20180306012644-bacd9c7ef1dd // indirect
 	github.com/mrjones/oauth v0.0.0-20190623134757-126b35219450 // indirect
 	github.com/pkg/errors v0.9.1
@@ -39,6 +40,7 @@ require (
 	github.com/qor/responder v0.0.0-20201015104727-4f3a345378c2 // indirect
 	github.com/qor/roles v0.0.0-20201008080147-dcaf8a4646d8 // indirect
 	github.com/rogpeppe/go-internal v1.8.0 // indirect
+	github.com/russross/blackfriday v1.6.0
 	github.com/satori/go.uuid v1.2.1-0.20181028125025-b2ce2384e17b
 	github.com/sirupsen/logrus v1.8.1
 	github.com/spf13/cast v1.4.1 // indirect
@@ -46,6 +48,7 @@ require (
 	github.com/twpayne/go-polyline v1.0.1
 	golang.org/x/net v0.0.0-20210813160813-60bc85c4be6d
 	golang.org/x/oauth2 v0.0.0-20210817223510-7df4dd6e12ab // indirect
+	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c
 	golang.org/x/sys v0.0.0-20210818153620-00dd8d7831e7 // indirect
 	golang.org/x/text v0.3.7 // indirect
 	golang.org/x/time v0.0.0-20210723032227-1f47c861a9ac // indirect
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http"
+	"os"
 	"strings"
 	"time"
 
@@ -20,6 +22,7 @@ import (
 	_ "github.com/jinzhu/gorm/dialects/postgres"
 	"github.com/matematik7/camino-go/diary"
 	"github.com/matematik7/camino-go/gallery"
+	"github.com/matematik7/camino-go/geocode"
 	"github.com/matematik7/camino-go/links"
 	"github.com/matematik7/camino-go/maps"
 	"github.com/matematik7/camino-go/pages"
@@ -158,6 +161,8 @@ func main() {
 	Maps := maps.New()
 	Gallery := gallery.New()
 	Stats := stats.New()
+	Strava := strava.New()
+	Geocoder := geocode.New()
 
 	app := gongo.App{
 		"Admin":          Admin,
@@ -177,7 +182,8 @@ func main() {
 		"Gallery":    Gallery,
 		"Stats":      Stats,
 
-		"Strava": strava.New(),
+		"Strava":   Strava,
+		"Geocoder": Geocoder,
 	}
 
 	for _, itf := range app {
@@ -187,6 +193,31 @@ func main() {
 			}
 		}
 	}
+	if err := maps.MigrateTracks(DB, log); err != nil {
+		log.Fatal(err)
+	}
+	if err := diary.MigratePublished(DB, log); err != nil {
+		log.Fatal(err)
+	}
+
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "backfill":
+			if err := maps.Backfill(DB, log); err != nil {
+				log.Fatal(err)
+			}
+		case "strava-subscribe":
+			Strava.DB = DB
+			subscription, err := Strava.Subscribe(context.Background(), url+"/strava/webhook")
+			if err != nil {
+				log.Fatal(err)
+			}
+			log.Printf("Created strava subscription %d", subscription.ID)
+		default:
+			log.Fatalf("Unknown command %s", os.Args[1])
+		}
+		return
+	}
 
 	if err := app.Configure(); err != nil {
 		log.Fatalln(err)
@@ -203,6 +234,7 @@ func main() {
 
 	r.Mount("/admin", Admin.ServeMux()) // TODO: figure out if this uses some sort of csrf
 	r.Mount("/auth", Authentication.ServeMux())
+	r.HandleFunc("/strava/webhook", Strava.WebhookHandler) // called by strava, no csrf
 
 	r.Group(func(r chi.Router) { // web is protected with csrf
 		// TODO: move csrf stuff to gongo package
@@ -224,6 +256,7 @@ func main() {
 		r.Mount("/map", Maps.ServeMux())
 		r.Mount("/gallery", Gallery.ServeMux())
 		r.Mount("/stats", Stats.ServeMux())
+		r.Mount("/strava", Strava.ServeMux())
 		r.Mount("/", Diary.ServeMux())
 	})
 
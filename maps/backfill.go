@@ -0,0 +1,110 @@
+package maps
+
+import (
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/matematik7/camino-go/diary/models"
+)
+
+// MigrateTracks links gps data to map entries through gps_data.map_entry_id,
+// before entries could have more tracks they referenced a single one through
+// map_entries.gps_data_id.
+func MigrateTracks(DB *gorm.DB, log *logrus.Logger) error {
+	if !DB.Dialect().HasColumn("map_entries", "gps_data_id") {
+		return nil
+	}
+
+	query := DB.Exec(`UPDATE gps_data SET map_entry_id = map_entries.id
+		FROM map_entries
+		WHERE map_entries.gps_data_id = gps_data.id AND COALESCE(gps_data.map_entry_id, 0) = 0`)
+	if query.Error != nil {
+		return errors.Wrap(query.Error, "could not migrate tracks")
+	}
+	if query.RowsAffected > 0 {
+		log.Infof("Linked %d gps data entries to map entries", query.RowsAffected)
+	}
+
+	return nil
+}
+
+// Backfill precomputes metrics and simplified tracks for gps data saved before
+// they were stored. Gps data that already has metrics, which may come from
+// strava, only gets the heart rate columns and profile computed from streams.
+// Elevation range stored as zeros, before missing elevation was stored as
+// NULL, is computed again.
+func Backfill(DB *gorm.DB, log *logrus.Logger) error {
+	withData := "COALESCE(data, '') != ''"
+	needsMetrics := "(COALESCE(polyline, '') = '' OR moving_time IS NULL)"
+
+	precomputed, err := backfill(DB, log, needsMetrics+" AND "+withData, func(gpsData models.GpsData) map[string]interface{} {
+		return map[string]interface{}{
+			"ascent":         gpsData.Ascent,
+			"descent":        gpsData.Descent,
+			"max_elevation":  gpsData.MaxElevation,
+			"min_elevation":  gpsData.MinElevation,
+			"moving_time":    gpsData.MovingTime,
+			"avg_heart_rate": gpsData.AvgHeartRate,
+			"max_heart_rate": gpsData.MaxHeartRate,
+			"polyline":       gpsData.Polyline,
+			"profile":        gpsData.Profile,
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	streams, err := backfill(DB, log, "avg_heart_rate IS NULL AND NOT "+needsMetrics+" AND "+withData, func(gpsData models.GpsData) map[string]interface{} {
+		return map[string]interface{}{
+			"avg_heart_rate": gpsData.AvgHeartRate,
+			"max_heart_rate": gpsData.MaxHeartRate,
+			"profile":        gpsData.Profile,
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	elevations, err := backfill(DB, log, "max_elevation = 0 AND min_elevation = 0 AND NOT "+needsMetrics+" AND "+withData, func(gpsData models.GpsData) map[string]interface{} {
+		return map[string]interface{}{
+			"max_elevation": gpsData.MaxElevation,
+			"min_elevation": gpsData.MinElevation,
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Backfilled %d gps data entries", precomputed+streams+elevations)
+
+	return nil
+}
+
+// backfill precomputes gps data matching where and saves columns returned by updates.
+func backfill(DB *gorm.DB, log *logrus.Logger, where string, updates func(models.GpsData) map[string]interface{}) (int, error) {
+	var ids []uint
+	query := DB.Model(&models.GpsData{}).Where(where).Order("id").Pluck("id", &ids)
+	if query.Error != nil {
+		return 0, errors.Wrap(query.Error, "could not get gps data to backfill")
+	}
+
+	for _, id := range ids {
+		var gpsData models.GpsData
+		if err := DB.First(&gpsData, id).Error; err != nil {
+			return 0, errors.Wrapf(err, "could not get gps data %d", id)
+		}
+
+		if err := gpsData.Precompute(); err != nil {
+			return 0, errors.Wrapf(err, "could not precompute gps data %d", id)
+		}
+
+		if err := DB.Model(&gpsData).UpdateColumns(updates(gpsData)).Error; err != nil {
+			return 0, errors.Wrapf(err, "could not save gps data %d", id)
+		}
+
+		log.Infof("Precomputed gps data %d", id)
+	}
+
+	return len(ids), nil
+}
@@ -0,0 +1,88 @@
+package maps
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"github.com/sirupsen/logrus"
+
+	"github.com/matematik7/camino-go/diary/models"
+)
+
+func TestBackfill(t *testing.T) {
+	DB, err := gorm.Open("sqlite3", filepath.Join(t.TempDir(), "maps.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer DB.Close()
+	if err := DB.AutoMigrate(&models.GpsData{}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Date(2021, time.September, 9, 8, 0, 0, 0, time.UTC)
+	data, err := json.Marshal([]models.DataEntry{
+		{Time: start, Latitude: 42.5987, Longitude: -5.5671, Elevation: models.NewFloat(840), HeartRate: 100},
+		{Time: start.Add(time.Hour), Latitude: 42.58, Longitude: -5.6, Elevation: models.NewFloat(870), Distance: 3, HeartRate: 140},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// old track without metrics and a strava track with metrics from strava
+	old := models.GpsData{Data: string(data)}
+	imported := models.GpsData{Data: string(data)}
+	for _, gpsData := range []*models.GpsData{&old, &imported} {
+		if err := DB.Create(gpsData).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = DB.Model(&old).UpdateColumns(map[string]interface{}{
+		"polyline":       "",
+		"moving_time":    gorm.Expr("NULL"),
+		"avg_heart_rate": gorm.Expr("NULL"),
+	}).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = DB.Model(&imported).UpdateColumns(map[string]interface{}{
+		"ascent":         100,
+		"max_elevation":  0,
+		"min_elevation":  0,
+		"moving_time":    1800,
+		"avg_heart_rate": gorm.Expr("NULL"),
+	}).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	if err := Backfill(DB, log); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := DB.First(&old, old.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if old.Polyline == "" || old.Ascent != 30 || old.MovingTime != 3600 || old.AvgHeartRate != 120 {
+		t.Errorf("old track was not precomputed %+v", old)
+	}
+
+	if err := DB.First(&imported, imported.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if imported.Ascent != 100 || imported.MovingTime != 1800 {
+		t.Errorf("strava metrics were overwritten, got ascent %v and moving time %v", imported.Ascent, imported.MovingTime)
+	}
+	if imported.AvgHeartRate != 120 || imported.MaxHeartRate != 140 {
+		t.Errorf("expected heart rate 120 avg and 140 max, got %v and %v", imported.AvgHeartRate, imported.MaxHeartRate)
+	}
+	if !imported.HasElevation() || *imported.MinElevation != 840 || *imported.MaxElevation != 870 {
+		t.Errorf("expected elevations 840 and 870, got %v and %v", imported.MinElevation, imported.MaxElevation)
+	}
+}
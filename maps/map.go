@@ -1,17 +1,25 @@
 package maps
 
 import (
+	"fmt"
 	"net/http"
+	"os"
+	"path/filepath"
 	"strconv"
 
 	"github.com/go-chi/chi"
 	"github.com/gobuffalo/packr"
+	"github.com/gosimple/slug"
 	"github.com/jinzhu/gorm"
 	jsoniter "github.com/json-iterator/go"
 	"github.com/matematik7/camino-go/diary/models"
+	"github.com/matematik7/camino-go/staticmap"
+	"github.com/matematik7/camino-go/tracks"
 	"github.com/matematik7/gongo"
+	"github.com/matematik7/gongo/authorization"
 	"github.com/matematik7/gongo/files"
 	"github.com/matematik7/gongo/render"
+	"github.com/pkg/errors"
 	"github.com/spf13/viper"
 )
 
@@ -19,6 +27,11 @@ type Maps struct {
 	DB     *gorm.DB
 	Files  *files.Files
 	render *render.Render
+
+	// provider is google or osm, osm uses leaflet and server rendered static maps
+	provider string
+	tileURL  string
+	tiles    *staticmap.TileCache
 }
 
 func New() *Maps {
@@ -32,6 +45,25 @@ func (c *Maps) Configure(app gongo.App) error {
 
 	c.render.AddTemplates(packr.NewBox("./templates"))
 
+	viper.SetDefault("map_provider", "google")
+	viper.SetDefault("tile_url", staticmap.DefaultTileURL)
+	viper.SetDefault("tile_cache_dir", filepath.Join(os.TempDir(), "camino-tiles"))
+	c.provider = viper.GetString("map_provider")
+	if c.provider != "google" && c.provider != "osm" {
+		return errors.Errorf("unknown map provider %q", c.provider)
+	}
+	c.tileURL = viper.GetString("tile_url")
+	c.tiles = staticmap.NewTileCache(
+		c.tileURL,
+		viper.GetString("tile_cache_dir"),
+		fmt.Sprintf("camino-go (%s)", viper.GetString("url")),
+	)
+
+	c.render.AddContextFunc(func(r *http.Request, ctx render.Context) {
+		ctx["map_provider"] = c.provider
+		ctx["tile_url"] = c.tileURL
+	})
+
 	return nil
 }
 
@@ -48,14 +80,33 @@ func (c *Maps) ServeMux() http.Handler {
 
 	router.Get("/", c.ViewHandler)
 	router.Get("/group/{groupID:[0-9]+}", c.GroupJSONHandler)
+	router.Get("/group/{groupID:[0-9]+}.gpx", c.GroupExportHandler("gpx"))
+	router.Get("/group/{groupID:[0-9]+}.kml", c.GroupExportHandler("kml"))
+	router.Get("/group/{groupID:[0-9]+}.geojson", c.GroupExportHandler("geojson"))
+	router.Get("/entry/{entryID:[0-9]+}.png", c.EntryImageHandler)
+	router.Get("/entry/{entryID:[0-9]+}/overview.png", c.EntryOverviewHandler)
 
 	return router
 }
 
+// visibleEntries limits map entries to those the user of the request can see,
+// entries of unpublished diary entries are only shown to their author.
+func visibleEntries(r *http.Request) func(*gorm.DB) *gorm.DB {
+	userID := -1
+	if r.Context().Value("user") != nil {
+		userID = int(r.Context().Value("user").(authorization.User).ID)
+	}
+
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Where(`map_entries.id NOT IN (SELECT map_entry_id FROM diary_entries
+			WHERE map_entry_id IS NOT NULL AND deleted_at IS NULL AND published = ? AND author_id != ?)`, false, userID)
+	}
+}
+
 func (c *Maps) ViewHandler(w http.ResponseWriter, r *http.Request) {
 	var groups []models.MapGroup
 
-	subQuery := c.DB.Select("distinct map_group_id").Table("map_entries").SubQuery()
+	subQuery := c.DB.Select("distinct map_group_id").Table("map_entries").Scopes(visibleEntries(r)).SubQuery()
 	query := c.DB.Order("id desc").Where("id IN (?)", subQuery).Find(&groups)
 	if err := query.Error; err != nil {
 		c.render.Error(w, r, err)
@@ -76,7 +127,7 @@ type MapEntryJSON struct {
 	Description string          `json:"description,omitempty"`
 	Lat         float64         `json:"latitude"`
 	Lon         float64         `json:"longitude"`
-	GpsDataID   uint            `json:"gps_id"`
+	GpsDataIDs  []uint          `json:"gps_ids"`
 	DiaryEntry  *DiaryEntryJSON `json:"diary,omitempty"`
 }
 
@@ -102,18 +153,48 @@ func (c *Maps) GroupJSONHandler(w http.ResponseWriter, r *http.Request) {
 	result := c.DB.Preload("DiaryEntry.Images", func(db *gorm.DB) *gorm.DB {
 		return db.Order("diary_entry_id, RANDOM()").Select("distinct on (diary_entry_id) *")
 	}).
+		Preload("Tracks", func(db *gorm.DB) *gorm.DB {
+			return db.Select("id, map_entry_id").Order("gps_data.date, gps_data.id")
+		}).
+		Scopes(visibleEntries(r)).
 		Where("map_group_id = ?", id).Order("id desc").Find(&entries)
 	if err := result.Error; err != nil {
 		c.render.Error(w, r, err)
 		return
 	}
 
+	// precomputed polylines are used unless a specific tolerance is requested
+	tolerance := 0.0
+	if value := r.URL.Query().Get("tolerance"); value != "" {
+		tolerance, err = strconv.ParseFloat(value, 64)
+		if err != nil {
+			http.Error(w, "invalid tolerance", http.StatusBadRequest)
+			return
+		}
+	} else if value := r.URL.Query().Get("zoom"); value != "" {
+		zoom, err := strconv.Atoi(value)
+		if err != nil {
+			http.Error(w, "invalid zoom", http.StatusBadRequest)
+			return
+		}
+		tolerance = models.ToleranceForZoom(zoom)
+	}
+
 	var gpsData models.GpsData
-	gpsRows, err := c.DB.Model(&gpsData).Joins("JOIN map_entries ON map_entries.gps_data_id = gps_data.id").Where("map_entries.map_group_id = ?", id).Rows()
+	gpsQuery := c.DB.Model(&gpsData).
+		Joins("JOIN map_entries ON gps_data.map_entry_id = map_entries.id").
+		Scopes(visibleEntries(r)).
+		Where("map_entries.map_group_id = ?", id)
+	if tolerance == 0 {
+		// only load full data for rows that were not precomputed yet
+		gpsQuery = gpsQuery.Select("gps_data.id, COALESCE(gps_data.polyline, '') AS polyline, CASE WHEN COALESCE(gps_data.polyline, '') = '' THEN gps_data.data ELSE '' END AS data")
+	}
+	gpsRows, err := gpsQuery.Rows()
 	if err != nil {
 		c.render.Error(w, r, err)
 		return
 	}
+	defer gpsRows.Close()
 
 	w.Header().Set("Content-Type", "application/json")
 	stream := jsoniter.ConfigFastest.BorrowStream(w)
@@ -133,7 +214,7 @@ func (c *Maps) GroupJSONHandler(w http.ResponseWriter, r *http.Request) {
 			Description: entry.Description,
 			Lat:         entry.Lat,
 			Lon:         entry.Lon,
-			GpsDataID:   entry.GpsDataID,
+			GpsDataIDs:  entry.TrackIDs(),
 		}
 		if entry.DiaryEntry != nil {
 			jsonEntry.DiaryEntry = &DiaryEntryJSON{
@@ -162,12 +243,19 @@ func (c *Maps) GroupJSONHandler(w http.ResponseWriter, r *http.Request) {
 	stream.WriteObjectStart()
 	first := true
 	for gpsRows.Next() {
+		gpsData = models.GpsData{}
 		err := c.DB.ScanRows(gpsRows, &gpsData)
 		if err != nil {
 			c.render.Error(w, r, err)
 			return
 		}
-		optimizedData, err := gpsData.OptimizedData()
+
+		encoded := gpsData.Polyline
+		if tolerance != 0 {
+			encoded, err = gpsData.SimplifiedPolyline(tolerance)
+		} else if encoded == "" {
+			encoded, err = gpsData.SimplifiedPolyline(models.DefaultTolerance)
+		}
 		if err != nil {
 			c.render.Error(w, r, err)
 			return
@@ -177,7 +265,7 @@ func (c *Maps) GroupJSONHandler(w http.ResponseWriter, r *http.Request) {
 			stream.WriteMore()
 		}
 		stream.WriteObjectField(strconv.Itoa(int(gpsData.ID)))
-		stream.WriteRaw(optimizedData)
+		stream.WriteString(encoded)
 
 		first = false
 	}
@@ -190,3 +278,72 @@ func (c *Maps) GroupJSONHandler(w http.ResponseWriter, r *http.Request) {
 	stream.WriteObjectEnd()
 	stream.Flush()
 }
+
+// GroupExportHandler serves markers and tracks of a map group in a standard format (gpx, kml or geojson).
+func (c *Maps) GroupExportHandler(format string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "groupID"))
+		if err != nil {
+			c.render.NotFound(w, r)
+			return
+		}
+
+		var group models.MapGroup
+		query := c.DB.Preload("Entries", func(db *gorm.DB) *gorm.DB {
+			return db.Scopes(visibleEntries(r)).Order("map_entries.id")
+		}).
+			Preload("Entries.Tracks", func(db *gorm.DB) *gorm.DB {
+				return db.Order("gps_data.date, gps_data.id")
+			}).
+			First(&group, id)
+		if query.RecordNotFound() {
+			c.render.NotFound(w, r)
+			return
+		} else if query.Error != nil {
+			c.render.Error(w, r, query.Error)
+			return
+		}
+
+		waypoints := []tracks.Waypoint{}
+		gpsTracks := []tracks.Track{}
+		for _, entry := range group.Entries {
+			waypoints = append(waypoints, tracks.Waypoint{
+				Name:        entry.City,
+				Description: entry.Description,
+				Latitude:    entry.Lat,
+				Longitude:   entry.Lon,
+			})
+
+			for _, gpsData := range entry.Tracks {
+				dataEntries, err := gpsData.DataEntries()
+				if err != nil {
+					c.render.Error(w, r, err)
+					return
+				}
+				gpsTracks = append(gpsTracks, tracks.Track{
+					Name:    fmt.Sprintf("%s - %s", gpsData.Start, gpsData.End),
+					Entries: dataEntries,
+				})
+			}
+		}
+
+		filename := fmt.Sprintf("%s.%s", slug.Make(group.Name), format)
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+
+		switch format {
+		case "gpx":
+			w.Header().Set("Content-Type", "application/gpx+xml")
+			err = tracks.WriteGPX(w, group.Name, waypoints, gpsTracks)
+		case "kml":
+			w.Header().Set("Content-Type", "application/vnd.google-earth.kml+xml")
+			err = tracks.WriteKML(w, group.Name, waypoints, gpsTracks)
+		case "geojson":
+			w.Header().Set("Content-Type", "application/geo+json")
+			err = tracks.WriteGeoJSON(w, waypoints, gpsTracks)
+		}
+		if err != nil {
+			c.render.Error(w, r, err)
+			return
+		}
+	}
+}
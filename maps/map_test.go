@@ -0,0 +1,143 @@
+package maps
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"github.com/matematik7/gongo/authorization"
+
+	"github.com/matematik7/camino-go/diary/models"
+)
+
+// newTestMaps returns maps with a sqlite database in a temporary directory.
+func newTestMaps(t *testing.T) *Maps {
+	DB, err := gorm.Open("sqlite3", filepath.Join(t.TempDir(), "maps.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { DB.Close() })
+
+	resources := append(New().Resources(), &models.DiaryEntry{})
+	if err := DB.AutoMigrate(resources...).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	return &Maps{DB: DB}
+}
+
+// saveEntries saves map entries with diary entries by author, nil entries
+// get a map entry without a diary entry.
+func saveEntries(t *testing.T, DB *gorm.DB, entries []*models.DiaryEntry) []uint {
+	ids := []uint{}
+	for i, entry := range entries {
+		mapEntry := models.MapEntry{City: fmt.Sprintf("Entry %d", i), MapGroupID: 1}
+		if err := DB.Save(&mapEntry).Error; err != nil {
+			t.Fatal(err)
+		}
+		if entry != nil {
+			entry.Title = "Leon"
+			entry.Text = "Leon"
+			entry.MapEntryID = mapEntry.ID
+			if err := DB.Save(entry).Error; err != nil {
+				t.Fatal(err)
+			}
+		}
+		ids = append(ids, mapEntry.ID)
+	}
+	return ids
+}
+
+func TestVisibleEntries(t *testing.T) {
+	c := newTestMaps(t)
+	ids := saveEntries(t, c.DB, []*models.DiaryEntry{
+		nil,
+		{AuthorID: 2, Published: true},
+		{AuthorID: 2},
+		{AuthorID: 1},
+	})
+
+	tests := []struct {
+		name string
+		user interface{}
+		want []uint
+	}{
+		{"anonymous", nil, ids[:2]},
+		{"author", authorization.User{Model: gorm.Model{ID: 1}}, []uint{ids[0], ids[1], ids[3]}},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/map/group/1", nil)
+		if test.user != nil {
+			r = r.WithContext(context.WithValue(r.Context(), "user", test.user))
+		}
+
+		var visible []uint
+		query := c.DB.Model(&models.MapEntry{}).Scopes(visibleEntries(r)).Order("id").Pluck("id", &visible)
+		if query.Error != nil {
+			t.Fatal(query.Error)
+		}
+		if !reflect.DeepEqual(visible, test.want) {
+			t.Errorf("%s: expected entries %v, got %v", test.name, test.want, visible)
+		}
+	}
+}
+
+func TestGroupExportHandler(t *testing.T) {
+	c := newTestMaps(t)
+	if err := c.DB.Save(&models.MapGroup{Name: "Camino"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	ids := saveEntries(t, c.DB, []*models.DiaryEntry{
+		{AuthorID: 2, Published: true},
+		{AuthorID: 2},
+	})
+
+	start := time.Date(2021, time.September, 9, 8, 0, 0, 0, time.UTC)
+	data, err := json.Marshal([]models.DataEntry{
+		{Time: start, Latitude: 42.5987, Longitude: -5.5671},
+		{Time: start.Add(time.Hour), Latitude: 42.58, Longitude: -5.6, Distance: 3},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range ids {
+		if err := c.DB.Save(&models.GpsData{MapEntryID: id, Data: string(data)}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/map/group/1.geojson", nil)
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("groupID", "1")
+	r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+	w := httptest.NewRecorder()
+	c.GroupExportHandler("geojson")(w, r)
+
+	var collection struct {
+		Features []struct {
+			Geometry struct {
+				Type string `json:"type"`
+			} `json:"geometry"`
+			Properties map[string]interface{} `json:"properties"`
+		} `json:"features"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&collection); err != nil {
+		t.Fatal(err)
+	}
+
+	// the draft of another user is left out
+	if len(collection.Features) != 2 {
+		t.Fatalf("expected marker and track of published entry, got %+v", collection.Features)
+	}
+	if collection.Features[0].Properties["name"] != "Entry 0" || collection.Features[1].Geometry.Type != "LineString" {
+		t.Errorf("unexpected features %+v", collection.Features)
+	}
+}
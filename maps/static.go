@@ -0,0 +1,115 @@
+package maps
+
+import (
+	"image/png"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi"
+	"github.com/jinzhu/gorm"
+	"github.com/twpayne/go-polyline"
+
+	"github.com/matematik7/camino-go/diary/models"
+	"github.com/matematik7/camino-go/staticmap"
+)
+
+const (
+	StaticWidth  = 400
+	StaticHeight = 300
+
+	// OverviewZoom shows the entry marker in the middle of all map entries.
+	OverviewZoom = 5
+)
+
+// EntryImageHandler renders tracks of a map entry, or its marker when it has
+// none, as a png for pages that cannot use the map page scripts.
+func (c *Maps) EntryImageHandler(w http.ResponseWriter, r *http.Request) {
+	var entry models.MapEntry
+	query := c.DB.Preload("Tracks", func(db *gorm.DB) *gorm.DB {
+		return db.Order("gps_data.date, gps_data.id")
+	}).Scopes(visibleEntries(r)).First(&entry, chi.URLParam(r, "entryID"))
+	if query.RecordNotFound() {
+		c.render.NotFound(w, r)
+		return
+	} else if query.Error != nil {
+		c.render.Error(w, r, query.Error)
+		return
+	}
+
+	m := staticmap.Map{
+		Width:  StaticWidth,
+		Height: StaticHeight,
+	}
+	for _, gpsData := range entry.Tracks {
+		encoded := gpsData.Polyline
+		if encoded == "" {
+			var err error
+			encoded, err = gpsData.SimplifiedPolyline(models.DefaultTolerance)
+			if err != nil {
+				c.render.Error(w, r, err)
+				return
+			}
+		}
+		coords, _, err := polyline.DecodeCoords([]byte(encoded))
+		if err != nil {
+			c.render.Error(w, r, err)
+			return
+		}
+
+		path := make([]staticmap.LatLng, 0, len(coords))
+		for _, coord := range coords {
+			path = append(path, staticmap.LatLng{Latitude: coord[0], Longitude: coord[1]})
+		}
+		m.Paths = append(m.Paths, path)
+	}
+	if len(m.Paths) == 0 {
+		m.Markers = []staticmap.LatLng{{Latitude: entry.Lat, Longitude: entry.Lon}}
+	}
+
+	c.writeImage(w, r, m)
+}
+
+// EntryOverviewHandler renders a zoomed out map with the map entry marker.
+func (c *Maps) EntryOverviewHandler(w http.ResponseWriter, r *http.Request) {
+	var entry models.MapEntry
+	query := c.DB.Scopes(visibleEntries(r)).First(&entry, chi.URLParam(r, "entryID"))
+	if query.RecordNotFound() {
+		c.render.NotFound(w, r)
+		return
+	} else if query.Error != nil {
+		c.render.Error(w, r, query.Error)
+		return
+	}
+
+	center := struct {
+		Lat float64
+		Lon float64
+	}{}
+	if err := c.DB.Raw("SELECT AVG(lat) as lat, AVG(lon) as lon FROM map_entries WHERE deleted_at IS NULL").Scan(&center).Error; err != nil {
+		c.render.Error(w, r, err)
+		return
+	}
+
+	c.writeImage(w, r, staticmap.Map{
+		Width:   StaticWidth,
+		Height:  StaticHeight,
+		Center:  staticmap.LatLng{Latitude: center.Lat, Longitude: center.Lon},
+		Zoom:    OverviewZoom,
+		Markers: []staticmap.LatLng{{Latitude: entry.Lat, Longitude: entry.Lon}},
+	})
+}
+
+func (c *Maps) writeImage(w http.ResponseWriter, r *http.Request, m staticmap.Map) {
+	img, err := c.tiles.Render(r.Context(), m)
+	if err != nil {
+		c.render.Error(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(3600))
+	if err := png.Encode(w, img); err != nil {
+		c.render.Error(w, r, err)
+		return
+	}
+}
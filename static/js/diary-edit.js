@@ -1,7 +1,10 @@
 /* global $,browser_key,google */
 
 $(function () {
-	$.getScript('//maps.googleapis.com/maps/api/js?key=' + browser_key + '&sensor=false&callback=initAutocomplete&libraries=places');
+	// city autocomplete is only available with google maps
+	if (browser_key) {
+		$.getScript('//maps.googleapis.com/maps/api/js?key=' + browser_key + '&sensor=false&callback=initAutocomplete&libraries=places');
+	}
 	$('#gps').change(function () {
 		var value = $('#gps option:selected').first().attr('rel');
 		if (value !== 'Neznano') {
@@ -10,13 +13,59 @@ $(function () {
 	});
 });
 
+$(function () {
+	var page = 1;
+
+	function loadWorkouts () {
+		var select = $('#workout');
+		$.getJSON('/diary/workouts.json', {
+			page: page,
+			type: $('#workout_type').val(),
+			after: $('#workout_after').val(),
+			before: $('#workout_before').val()
+		}, function (data) {
+			var selected = select.val();
+			// keep empty and selected option
+			select.find('option').not(':first').not(':selected').remove();
+			$.each(data.workouts, function (i, workout) {
+				if (workout.ID !== selected) {
+					select.append($('<option>').val(workout.ID).text(workout.Description));
+				}
+			});
+			$('#workout_prev').prop('disabled', page <= 1);
+			$('#workout_next').prop('disabled', !data.more);
+			$('#workout_error').text('');
+		}).fail(function (xhr) {
+			if (xhr.responseJSON && xhr.responseJSON.error) {
+				$('#workout_error').text(xhr.responseJSON.error);
+			}
+		});
+	}
+
+	$('#workout_type, #workout_after, #workout_before').change(function () {
+		page = 1;
+		loadWorkouts();
+	});
+	$('#workout_prev').click(function () {
+		page--;
+		loadWorkouts();
+	});
+	$('#workout_next').click(function () {
+		page++;
+		loadWorkouts();
+	});
+});
+
 function initAutocomplete () {
 	$('.google_autocomplete').each(function () {
 		var ac = new google.maps.places.Autocomplete(this);
 	});
 }
 
-$(document).ready(function() {
+function initEditor () {
+  if ($('#format').val() == 'markdown') {
+	  return;
+  }
   $('#content').summernote({
 	  height: 300,
 	  toolbar: [
@@ -28,4 +77,17 @@ $(document).ready(function() {
 		  ['misc', ['fullscreen', 'codeview']],
 	  ],
   });
+}
+
+$(document).ready(function() {
+  initEditor();
+
+  // markdown is written in the plain textarea
+  $('#format').change(function () {
+	  if ($(this).val() == 'markdown') {
+		  $('#content').summernote('destroy');
+	  } else {
+		  initEditor();
+	  }
+  });
 });
@@ -2,12 +2,35 @@ google.load('visualization', '1.0', {'packages': ['corechart']});
 google.setOnLoadCallback(displayHeightChart);
 
 function displayHeightChart () {
-    var heightChart = $('#height-chart');
+    drawProfileChart($('#height-chart'), 1, 'Višina', 'm');
+    drawProfileChart($('#speed-chart'), 2, 'Hitrost', 'km/h');
+    drawProfileChart($('#heart-rate-chart'), 3, 'Srčni utrip', 'bpm');
+}
+
+// recorded returns whether column of profile value was recorded, elevation
+// is null when missing and other columns are zero.
+function recorded (value, column) {
+    if (value.length <= column || value[column] === null) {
+        return false;
+    }
+    return column === 1 || value[column] !== 0.0;
+}
+
+// drawProfileChart draws column of heightChartData against distance,
+// chart is hidden when column has no recorded values.
+function drawProfileChart (element, column, title, unit) {
+    var hasData = heightChartData.some(function (value) {
+        return recorded(value, column);
+    });
+    if (!hasData) {
+        element.hide();
+        return;
+    }
 
     // Create the data table.
     var dataTable = new google.visualization.DataTable();
     dataTable.addColumn('number', 'Razdalja');
-    dataTable.addColumn('number', 'Višina');
+    dataTable.addColumn('number', title);
 
 
     var decimation = Math.floor(heightChartData.length / 50);
@@ -15,20 +38,23 @@ function displayHeightChart () {
     var divisor = decimation;
     for (var i = 1; i < heightChartData.length; i++) {
         var value = heightChartData[i];
-        if (value.elevation === 0.0) {
+        var current = 0.0;
+        if (recorded(value, column)) {
+            current = value[column];
+        } else {
             divisor--;
         }
 
-        average += parseFloat(value.elevation)
+        average += current;
         if (decimation > 0) {
             if (i % decimation !== 0) {
                 continue;
             }
 
-            average /= divisor;
+            average = divisor > 0 ? average / divisor : 0;
         }
 
-        dataTable.addRow([{v: parseFloat(value.dist), f: parseFloat(value.dist).toFixed(1) + ' km'}, {v: average, f: average.toFixed(1) + ' m'}]);
+        dataTable.addRow([{v: value[0], f: value[0].toFixed(1) + ' km'}, {v: average, f: average.toFixed(1) + ' ' + unit}]);
 
         average = 0;
         divisor = decimation;
@@ -40,7 +66,7 @@ function displayHeightChart () {
             title: 'Razdalja [km]'
         },
         vAxis: {
-            title: 'Višina [m]'
+            title: title + ' [' + unit + ']'
         },
         legend: {
             position: 'none'
@@ -54,17 +80,17 @@ function displayHeightChart () {
     };
 
     // Instantiate and draw our chart, passing in some options.
-    var chart = new google.visualization.LineChart(heightChart.get(0));
+    var chart = new google.visualization.LineChart(element.get(0));
     chart.draw(dataTable, options);
 
     var resize = function () {
-        heightChart.height(heightChart.width() * 0.75);
-        options.width = heightChart.width();
-        options.height = heightChart.width() * 0.75;
+        element.height(element.width() * 0.75);
+        options.width = element.width();
+        options.height = element.width() * 0.75;
         options.chartArea.left = 45;
-        options.chartArea.width = heightChart.width() - options.chartArea.left;
+        options.chartArea.width = element.width() - options.chartArea.left;
         options.chartArea.top = 10;
-        options.chartArea.height = heightChart.height() - options.chartArea.top - 30;
+        options.chartArea.height = element.height() - options.chartArea.top - 30;
         chart.draw(dataTable, options);
     };
 
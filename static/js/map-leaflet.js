@@ -0,0 +1,231 @@
+/* global $,L,tile_url */
+
+$.urlParam = function (name) {
+  var results = new RegExp("[?&amp;]" + name + "=([^&amp;#]*)").exec(
+    window.location.href
+  );
+  if (results) {
+    return parseInt(results[1], 10) || null;
+  } else {
+    return null;
+  }
+};
+
+var mapApp = {
+  markers: {},
+  polylines: {},
+  defaultIndex: 0,
+};
+
+// decodePath decodes google encoded polyline into [lat, lng] pairs
+function decodePath(encoded) {
+  var path = [];
+  var index = 0;
+  var lat = 0;
+  var lng = 0;
+
+  while (index < encoded.length) {
+    var values = [0, 0];
+    for (var i = 0; i < 2; i++) {
+      var shift = 0;
+      var result = 0;
+      var b;
+      do {
+        b = encoded.charCodeAt(index++) - 63;
+        result |= (b & 0x1f) << shift;
+        shift += 5;
+      } while (b >= 0x20);
+      values[i] = result & 1 ? ~(result >> 1) : result >> 1;
+    }
+    lat += values[0];
+    lng += values[1];
+    path.push([lat / 1e5, lng / 1e5]);
+  }
+
+  return path;
+}
+
+function markerIcon(background, border) {
+  return $("<span>").css({
+    display: "inline-block",
+    width: "12px",
+    height: "12px",
+    "border-radius": "6px",
+    background: background,
+    border: "2px solid " + border,
+  });
+}
+
+// init marker groups
+$(function () {
+  mapApp.defaultIndex = $.urlParam("index");
+  mapApp.defaultMarker = $.urlParam("marker");
+  mapApp.defaultPath = $.urlParam("path");
+
+  initializeMap();
+});
+
+function fitToMarkers() {
+  var bounds = L.latLngBounds([]);
+  $.each(mapApp.markers, function (i, markerGroup) {
+    $.each(markerGroup, function (id, marker) {
+      if (mapApp.map.hasLayer(marker)) {
+        bounds.extend(marker.getLatLng());
+      }
+    });
+  });
+
+  if (bounds.isValid()) {
+    // Don't zoom in too far on only one marker
+    mapApp.map.fitBounds(bounds, { maxZoom: 12 });
+  }
+}
+
+// init markers and paths
+function initializeMap() {
+  var mapDiv = $(".map");
+  mapDiv.show();
+  mapDiv.height(mapDiv.width() * 0.75);
+  $(window).resize(function () {
+    mapDiv.height(mapDiv.width() * 0.75);
+    mapApp.map.invalidateSize();
+  });
+
+  mapApp.map = L.map(mapDiv.get(0)).setView([46, 14.5], 8);
+  L.tileLayer(tile_url, {
+    maxZoom: 19,
+    attribution:
+      '&copy; <a href="https://www.openstreetmap.org/copyright">OpenStreetMap</a>',
+  }).addTo(mapApp.map);
+
+  $(".map-group").each(function () {
+    var map_group = this;
+
+    var index = parseInt($(map_group).attr("rel"), 10);
+    if (mapApp.defaultIndex == null) {
+      mapApp.defaultIndex = index;
+    }
+
+    var color = $(".map-color-icon", map_group).data("color");
+    $(".map-color-icon", map_group).append(markerIcon(color, color));
+    $(".map-gray-icon", map_group).append(markerIcon("#dfdfdf", "#000000"));
+    if (index !== mapApp.defaultIndex) {
+      $(".map-color-icon", map_group).hide();
+    } else {
+      $(".map-gray-icon", map_group).hide();
+    }
+
+    $(map_group).children("a").click(function () {
+      $(".map-color-icon", map_group).toggle();
+      $(".map-gray-icon", map_group).toggle();
+
+      mapApp.map.closePopup();
+
+      if (!(index in mapApp.markers)) {
+        loadData(index);
+      } else {
+        $.each(mapApp.markers[index], function (id, layer) {
+          toggleLayer(layer);
+        });
+        $.each(mapApp.polylines[index], function (id, layer) {
+          toggleLayer(layer);
+        });
+
+        fitToMarkers();
+      }
+
+      return false;
+    });
+  });
+
+  loadData(mapApp.defaultIndex);
+}
+
+function toggleLayer(layer) {
+  if (mapApp.map.hasLayer(layer)) {
+    mapApp.map.removeLayer(layer);
+  } else {
+    layer.addTo(mapApp.map);
+  }
+}
+
+function loadData(index) {
+  var isFit = false;
+  $.ajax(`/map/group/${index}`).done(function (data) {
+    var color = $(`#map-group-${index} .map-color-icon`).data("color");
+    mapApp.markers[index] = {};
+    mapApp.polylines[index] = {};
+
+    $(data.entries).each(function (i, entry) {
+      var content = `<strong>${entry.title}</strong>`;
+      if (entry.diary) {
+        if (entry.diary.image) {
+          content += `<br>
+<a href="/diary/${entry.diary.id}" title="${entry.diary.image.description}">
+    <img src="https://res.cloudinary.com/dvmih7vrf/image/fetch/w_200,h_100,c_fill/${entry.diary.image.url}" alt="${entry.diary.image.description}">
+</a>`;
+        }
+        content += `<br>Preberi v dnevniku: <a href="/diary/${entry.diary.id}">${entry.diary.title}</a>`;
+      }
+      if (entry.description) {
+        content += `<br>${entry.description}`;
+      }
+
+      // construct marker
+      var marker = L.circleMarker([entry.latitude, entry.longitude], {
+        radius: 6,
+        color: color,
+        fillColor: color,
+        fillOpacity: 0.9,
+      }).bindPopup(content);
+      marker.addTo(mapApp.map);
+
+      // store marker
+      mapApp.markers[index][entry.id] = marker;
+
+      // load gps if available
+      var bounds = L.latLngBounds([]);
+      $.each(entry.gps_ids, function (j, gpsId) {
+        var path = decodePath(data.gps[gpsId]);
+        if (entry.gps_ids.indexOf(mapApp.defaultPath) !== -1) {
+          bounds.extend(path);
+        }
+
+        // different color for even and odd ones
+        var polyline = L.polyline(path, {
+          color: i % 2 ? "#006600" : "#0000cc",
+          opacity: 0.5,
+        }).bindPopup(content);
+        polyline.on("mouseover", function () {
+          polyline.setStyle({ opacity: 1 });
+        });
+        polyline.on("mouseout", function () {
+          polyline.setStyle({ opacity: 0.5 });
+        });
+        polyline.addTo(mapApp.map);
+
+        mapApp.polylines[index][gpsId] = polyline;
+
+        // move marker to last gps point
+        if (path.length > 0) {
+          marker.setLatLng(path[path.length - 1]);
+        }
+      });
+
+      // fit map if on map id
+      if (bounds.isValid()) {
+        mapApp.map.fitBounds(bounds);
+        isFit = true;
+      }
+
+      // show bubble for default marker
+      if (entry.id === mapApp.defaultMarker) {
+        marker.openPopup();
+      }
+    });
+
+    if (!isFit) {
+      fitToMarkers();
+    }
+  });
+}
@@ -28,7 +28,7 @@ $(function () {
   $.getScript(
     "//maps.googleapis.com/maps/api/js?key=" +
       browser_key +
-      "&sensor=false&callback=initializeMap&libraries=marker"
+      "&sensor=false&callback=initializeMap&libraries=marker,geometry"
   );
 
   mapApp.defaultIndex = $.urlParam("index");
@@ -126,7 +126,7 @@ function initializeMap() {
       $(".map-gray-icon", map_group).hide();
     }
 
-    $("a", map_group).click(function () {
+    $(map_group).children("a").click(function () {
       $(".map-color-icon", map_group).toggle();
       $(".map-gray-icon", map_group).toggle();
 
@@ -215,17 +215,15 @@ function loadData(index) {
       }
 
       // load gps if available
-      if (entry.gps_id !== 0) {
-        // parse points
-        var path = [];
-        var bounds = new google.maps.LatLngBounds();
-        $.each(data.gps[entry.gps_id], function (i, value) {
-          var point = new google.maps.LatLng(value.lat, value.lon);
-          path.push(point);
-          if (entry.gps_id === mapApp.defaultPath) {
+      var bounds = new google.maps.LatLngBounds();
+      $.each(entry.gps_ids, function (j, gpsId) {
+        // decode points
+        var path = google.maps.geometry.encoding.decodePath(data.gps[gpsId]);
+        if (entry.gps_ids.indexOf(mapApp.defaultPath) !== -1) {
+          $.each(path, function (i, point) {
             bounds.extend(point);
-          }
-        });
+          });
+        }
 
         // construct polyline
         var polyline = new google.maps.Polyline({
@@ -245,13 +243,7 @@ function loadData(index) {
         // set map
         polyline.setMap(mapApp.map);
 
-        mapApp.polylines[index][entry.id] = polyline;
-
-        // fit map if on map id
-        if (!bounds.isEmpty()) {
-          mapApp.map.fitBounds(bounds);
-          isFit = true;
-        }
+        mapApp.polylines[index][gpsId] = polyline;
 
         // move marker to last gps point
         marker.position = path[path.length - 1];
@@ -262,6 +254,12 @@ function loadData(index) {
 
         // set mouse click
         google.maps.event.addListener(polyline, "click", openFunction);
+      });
+
+      // fit map if on map id
+      if (!bounds.isEmpty()) {
+        mapApp.map.fitBounds(bounds);
+        isFit = true;
       }
     });
 
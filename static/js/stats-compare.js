@@ -0,0 +1,54 @@
+google.load('visualization', '1.0', {'packages': ['corechart']});
+google.setOnLoadCallback(displayCompareChart);
+
+function displayCompareChart () {
+    var container = $('#compare');
+    if (container.length === 0) {
+        return;
+    }
+
+    // one column per year, rows only have value for their own year
+    var dataTable = new google.visualization.DataTable();
+    dataTable.addColumn('number', 'Dan');
+    compareData.forEach(function (series) {
+        dataTable.addColumn('number', series.year);
+    });
+
+    compareData.forEach(function (series, column) {
+        series.points.forEach(function (point) {
+            var row = [{v: point[0], f: point[0] + '. dan'}];
+            compareData.forEach(function (other, i) {
+                row.push(i === column ? {v: point[1], f: point[1].toFixed(1) + ' km'} : null);
+            });
+            dataTable.addRow(row);
+        });
+    });
+
+    var options = {
+        hAxis: {
+            title: 'Dan v letu',
+            viewWindow: {min: 1, max: 366}
+        },
+        vAxis: {
+            title: 'Skupna razdalja [km]'
+        },
+        interpolateNulls: true,
+        legend: {
+            position: 'bottom'
+        },
+        width: 100,
+        height: 100
+    };
+
+    var chart = new google.visualization.LineChart(container.get(0));
+
+    var resize = function () {
+        container.height(container.width() * 0.5);
+        options.width = container.width();
+        options.height = container.width() * 0.5;
+        chart.draw(dataTable, options);
+    };
+
+    resize();
+    $(window).resize(resize);
+}
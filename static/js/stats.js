@@ -1,5 +1,6 @@
 google.load('visualization', '1.0', {'packages': ['corechart']});
 google.setOnLoadCallback(displayStatsCharts);
+google.setOnLoadCallback(displayPeriodCharts);
 
 function displayStatsCharts () {
     statsData.forEach(function (data) {
@@ -70,3 +71,47 @@ function displayStatsCharts () {
         $(window).resize(resize);
     });
 }
+
+function displayPeriodCharts () {
+    if (typeof periodData === 'undefined') {
+        return;
+    }
+
+    periodData.forEach(function (data) {
+        var container = $(data.id);
+
+        var dataTable = new google.visualization.DataTable();
+        dataTable.addColumn('string', 'Obdobje');
+        dataTable.addColumn('number', data.title);
+
+        data.data.forEach(function (value, i) {
+            dataTable.addRow([data.labels[i], {
+                v: value,
+                f: value.toFixed(1) + ' km',
+            }]);
+        });
+
+        var options = {
+            vAxis: {
+                title: 'Razdalja [km]'
+            },
+            legend: {
+                position: 'none'
+            },
+            width: 100,
+            height: 100
+        };
+
+        var chart = new google.visualization.ColumnChart(container.get(0));
+
+        var resize = function () {
+            container.height(container.width() * 0.75);
+            options.width = container.width();
+            options.height = container.width() * 0.75;
+            chart.draw(dataTable, options);
+        };
+
+        resize();
+        $(window).resize(resize);
+    });
+}
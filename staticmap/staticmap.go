@@ -0,0 +1,167 @@
+package staticmap
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+)
+
+const (
+	// MaxZoom is the highest zoom level used when fitting a map.
+	MaxZoom = 17
+	// Padding in pixels is kept around fitted paths and markers.
+	Padding = 20
+)
+
+var (
+	PathColor   = color.NRGBA{R: 0, G: 0, B: 255, A: 128}
+	MarkerColor = color.NRGBA{R: 220, G: 0, B: 0, A: 255}
+	background  = color.NRGBA{R: 221, G: 221, B: 221, A: 255}
+)
+
+// LatLng is a location in degrees.
+type LatLng struct {
+	Latitude  float64
+	Longitude float64
+}
+
+// Map describes a static map image, when Zoom is zero the map is centered and
+// zoomed to fit all paths and markers.
+type Map struct {
+	Width   int
+	Height  int
+	Center  LatLng
+	Zoom    int
+	Paths   [][]LatLng
+	Markers []LatLng
+}
+
+// pixel returns web mercator world pixel coordinates at zoom.
+func pixel(point LatLng, zoom int) (float64, float64) {
+	scale := TileSize * math.Pow(2, float64(zoom))
+	latitude := math.Max(-85.05112878, math.Min(85.05112878, point.Latitude))
+	sin := math.Sin(latitude * math.Pi / 180)
+	x := (point.Longitude + 180) / 360 * scale
+	y := (0.5 - math.Log((1+sin)/(1-sin))/(4*math.Pi)) * scale
+	return x, y
+}
+
+// fit returns center and the highest zoom where all points are visible.
+func (m Map) fit() (LatLng, int) {
+	points := []LatLng{}
+	for _, path := range m.Paths {
+		points = append(points, path...)
+	}
+	points = append(points, m.Markers...)
+	if len(points) == 0 {
+		return m.Center, 1
+	}
+
+	minLat, maxLat := points[0].Latitude, points[0].Latitude
+	minLon, maxLon := points[0].Longitude, points[0].Longitude
+	for _, point := range points {
+		minLat = math.Min(minLat, point.Latitude)
+		maxLat = math.Max(maxLat, point.Latitude)
+		minLon = math.Min(minLon, point.Longitude)
+		maxLon = math.Max(maxLon, point.Longitude)
+	}
+	center := LatLng{
+		Latitude:  (minLat + maxLat) / 2,
+		Longitude: (minLon + maxLon) / 2,
+	}
+
+	for zoom := MaxZoom; zoom > 0; zoom-- {
+		left, top := pixel(LatLng{maxLat, minLon}, zoom)
+		right, bottom := pixel(LatLng{minLat, maxLon}, zoom)
+		if right-left <= float64(m.Width-2*Padding) && bottom-top <= float64(m.Height-2*Padding) {
+			return center, zoom
+		}
+	}
+	return center, 0
+}
+
+// Render draws tiles, paths and markers into an image.
+func (c *TileCache) Render(ctx context.Context, m Map) (image.Image, error) {
+	center, zoom := m.Center, m.Zoom
+	if zoom == 0 {
+		center, zoom = m.fit()
+	}
+
+	centerX, centerY := pixel(center, zoom)
+	originX := int(math.Floor(centerX)) - m.Width/2
+	originY := int(math.Floor(centerY)) - m.Height/2
+
+	img := image.NewRGBA(image.Rect(0, 0, m.Width, m.Height))
+	draw.Draw(img, img.Bounds(), image.NewUniform(background), image.Point{}, draw.Src)
+
+	tiles := 1 << uint(zoom)
+	for tileY := floorDiv(originY, TileSize); tileY*TileSize < originY+m.Height; tileY++ {
+		if tileY < 0 || tileY >= tiles {
+			continue
+		}
+		for tileX := floorDiv(originX, TileSize); tileX*TileSize < originX+m.Width; tileX++ {
+			tile, err := c.Tile(ctx, zoom, ((tileX%tiles)+tiles)%tiles, tileY)
+			if err != nil {
+				return nil, err
+			}
+			offset := image.Pt(tileX*TileSize-originX, tileY*TileSize-originY)
+			draw.Draw(img, tile.Bounds().Add(offset), tile, tile.Bounds().Min, draw.Over)
+		}
+	}
+
+	// paths are drawn into a mask first so overlapping segments are not darker
+	mask := image.NewAlpha(img.Bounds())
+	for _, path := range m.Paths {
+		for i := 1; i < len(path); i++ {
+			x1, y1 := pixel(path[i-1], zoom)
+			x2, y2 := pixel(path[i], zoom)
+			line(mask, x1-float64(originX), y1-float64(originY), x2-float64(originX), y2-float64(originY), 1.5)
+		}
+	}
+	draw.DrawMask(img, img.Bounds(), image.NewUniform(PathColor), image.Point{}, mask, image.Point{}, draw.Over)
+
+	for _, marker := range m.Markers {
+		x, y := pixel(marker, zoom)
+		x -= float64(originX)
+		y -= float64(originY)
+		disc(img, x, y, 7, color.White)
+		disc(img, x, y, 5, MarkerColor)
+	}
+
+	return img, nil
+}
+
+func floorDiv(a, b int) int {
+	return int(math.Floor(float64(a) / float64(b)))
+}
+
+// line marks pixels of a segment with the given half width in the mask.
+func line(mask *image.Alpha, x1, y1, x2, y2, width float64) {
+	steps := int(math.Ceil(math.Max(math.Abs(x2-x1), math.Abs(y2-y1))))
+	if steps == 0 {
+		steps = 1
+	}
+	for i := 0; i <= steps; i++ {
+		t := float64(i) / float64(steps)
+		disc(mask, x1+(x2-x1)*t, y1+(y2-y1)*t, width, color.Opaque)
+	}
+}
+
+// disc fills a circle centered at x, y.
+func disc(img draw.Image, x, y, radius float64, c color.Color) {
+	bounds := img.Bounds()
+	for py := int(math.Floor(y - radius)); py <= int(math.Ceil(y+radius)); py++ {
+		for px := int(math.Floor(x - radius)); px <= int(math.Ceil(x+radius)); px++ {
+			if !image.Pt(px, py).In(bounds) {
+				continue
+			}
+			dx := float64(px) + 0.5 - x
+			dy := float64(py) + 0.5 - y
+			if dx*dx+dy*dy <= radius*radius {
+				img.Set(px, py, c)
+			}
+		}
+	}
+}
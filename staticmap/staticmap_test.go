@@ -0,0 +1,162 @@
+package staticmap
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// newTestTileServer serves white tiles and counts requests.
+func newTestTileServer(t *testing.T) (*httptest.Server, func() int) {
+	tile := image.NewRGBA(image.Rect(0, 0, TileSize, TileSize))
+	draw.Draw(tile, tile.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, tile); err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("User-Agent") != "test" {
+			t.Errorf("expected user agent, got %q", r.Header.Get("User-Agent"))
+		}
+		mu.Lock()
+		requests++
+		mu.Unlock()
+		w.Write(buf.Bytes())
+	}))
+	t.Cleanup(server.Close)
+
+	return server, func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return requests
+	}
+}
+
+func TestRender(t *testing.T) {
+	server, requests := newTestTileServer(t)
+	tiles := NewTileCache(server.URL+"/{z}/{x}/{y}.png", t.TempDir(), "test")
+
+	m := Map{
+		Width:  400,
+		Height: 300,
+		Paths: [][]LatLng{{
+			{Latitude: 46.0, Longitude: 14.5},
+			{Latitude: 46.1, Longitude: 14.6},
+		}},
+	}
+	img, err := tiles.Render(context.Background(), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds() != image.Rect(0, 0, 400, 300) {
+		t.Errorf("unexpected bounds %v", img.Bounds())
+	}
+
+	// path goes through the center of fitted map
+	r, g, b, _ := img.At(200, 150).RGBA()
+	if b <= r || b <= g {
+		t.Errorf("expected path color in the center, got %v", img.At(200, 150))
+	}
+	r, g, b, _ = img.At(5, 5).RGBA()
+	if r != 0xffff || g != 0xffff || b != 0xffff {
+		t.Errorf("expected tile color in the corner, got %v", img.At(5, 5))
+	}
+
+	fetched := requests()
+	if fetched == 0 {
+		t.Fatal("expected tiles to be fetched")
+	}
+	if _, err := tiles.Render(context.Background(), m); err != nil {
+		t.Fatal(err)
+	}
+	if requests() != fetched {
+		t.Errorf("expected cached tiles, got %d more requests", requests()-fetched)
+	}
+}
+
+func TestRenderMarker(t *testing.T) {
+	server, _ := newTestTileServer(t)
+	tiles := NewTileCache(server.URL+"/{z}/{x}/{y}.png", t.TempDir(), "test")
+
+	img, err := tiles.Render(context.Background(), Map{
+		Width:   400,
+		Height:  300,
+		Center:  LatLng{Latitude: 46, Longitude: 14.5},
+		Zoom:    5,
+		Markers: []LatLng{{Latitude: 46, Longitude: 14.5}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c := color.NRGBAModel.Convert(img.At(200, 150)); c != MarkerColor {
+		t.Errorf("expected marker in the center, got %v", c)
+	}
+}
+
+func TestRenderTileError(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+	tiles := NewTileCache(server.URL+"/{z}/{x}/{y}.png", t.TempDir(), "test")
+
+	_, err := tiles.Render(context.Background(), Map{Width: 100, Height: 100, Zoom: 3})
+	if err == nil {
+		t.Error("expected error")
+	}
+}
+
+func TestTileCanceledCaller(t *testing.T) {
+	server, requests := newTestTileServer(t)
+	release := make(chan struct{})
+	blocked := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		http.Redirect(w, r, server.URL+r.URL.Path, http.StatusFound)
+	}))
+	defer blocked.Close()
+	tiles := NewTileCache(blocked.URL+"/{z}/{x}/{y}.png", t.TempDir(), "test")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := tiles.Tile(ctx, 3, 4, 2); err != context.Canceled {
+		t.Fatalf("expected context canceled, got %v", err)
+	}
+
+	// download started by the canceled caller is finished and shared
+	close(release)
+	if _, err := tiles.Tile(context.Background(), 3, 4, 2); err != nil {
+		t.Fatal(err)
+	}
+	if requests() != 1 {
+		t.Errorf("expected 1 tile request, got %d", requests())
+	}
+}
+
+func TestFit(t *testing.T) {
+	m := Map{
+		Width:  400,
+		Height: 300,
+		Markers: []LatLng{
+			{Latitude: 46, Longitude: 14},
+			{Latitude: 46, Longitude: 15},
+		},
+	}
+
+	center, zoom := m.fit()
+	if center.Latitude != 46 || center.Longitude != 14.5 {
+		t.Errorf("unexpected center %+v", center)
+	}
+	// one degree of longitude is 256 * 2^zoom / 360 pixels
+	if zoom != 8 {
+		t.Errorf("expected zoom 8, got %d", zoom)
+	}
+}
@@ -0,0 +1,138 @@
+package staticmap
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	DefaultTileURL = "https://tile.openstreetmap.org/{z}/{x}/{y}.png"
+	DefaultTimeout = 10 * time.Second
+
+	TileSize = 256
+)
+
+// TileCache fetches map tiles from a tile server and keeps them on disk, so
+// every tile is downloaded only once.
+type TileCache struct {
+	Client *http.Client
+	// URL is a tile url template with {z}, {x}, {y} and optional {s} placeholders.
+	URL       string
+	Dir       string
+	UserAgent string
+
+	// fetchGroup merges concurrent downloads of the same tile
+	fetchGroup singleflight.Group
+}
+
+// NewTileCache returns a tile cache storing tiles of url template in dir.
+func NewTileCache(url, dir, userAgent string) *TileCache {
+	return &TileCache{
+		Client: &http.Client{
+			Timeout: DefaultTimeout,
+		},
+		URL:       url,
+		Dir:       dir,
+		UserAgent: userAgent,
+	}
+}
+
+func (c *TileCache) tileURL(z, x, y int) string {
+	return strings.NewReplacer(
+		"{s}", "a",
+		"{z}", strconv.Itoa(z),
+		"{x}", strconv.Itoa(x),
+		"{y}", strconv.Itoa(y),
+	).Replace(c.URL)
+}
+
+func (c *TileCache) tilePath(z, x, y int) string {
+	return filepath.Join(c.Dir, strconv.Itoa(z), strconv.Itoa(x), strconv.Itoa(y))
+}
+
+// Tile returns decoded tile, it is read from disk when it was already fetched.
+func (c *TileCache) Tile(ctx context.Context, z, x, y int) (image.Image, error) {
+	path := c.tilePath(z, x, y)
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		// download is shared with other callers, so it must not be canceled
+		// with the context of the caller that started it
+		fetched := c.fetchGroup.DoChan(path, func() (interface{}, error) {
+			ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
+			defer cancel()
+			return c.fetch(ctx, z, x, y, path)
+		})
+		select {
+		case result := <-fetched:
+			err = result.Err
+			if err == nil {
+				data = result.Val.([]byte)
+			}
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tile, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not decode tile %d/%d/%d", z, x, y)
+	}
+	return tile, nil
+}
+
+func (c *TileCache) fetch(ctx context.Context, z, x, y int, path string) ([]byte, error) {
+	req, err := http.NewRequest("GET", c.tileURL(z, x, y), nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create tile request")
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("User-Agent", c.UserAgent)
+
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not get tile")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("tile %d/%d/%d: tile server returned %s", z, x, y, resp.Status)
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read tile")
+	}
+
+	// write to a temporary file first so readers never see a partial tile
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, errors.Wrap(err, "could not create tile cache directory")
+	}
+	tmp := fmt.Sprintf("%s.%d.tmp", path, time.Now().UnixNano())
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return nil, errors.Wrap(err, "could not write tile")
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return nil, errors.Wrap(err, "could not write tile")
+	}
+
+	return data, nil
+}
@@ -1,8 +1,14 @@
 package stats
 
 import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
 	"net/http"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/flosch/pongo2"
 	"github.com/go-chi/chi"
@@ -10,6 +16,7 @@ import (
 	"github.com/jinzhu/gorm"
 	"github.com/matematik7/gongo"
 	"github.com/matematik7/gongo/render"
+	"github.com/pkg/errors"
 
 	"github.com/matematik7/camino-go/diary/models"
 )
@@ -33,9 +40,9 @@ func (c *Stats) Configure(app gongo.App) error {
 		var years []int
 		// TODO: handle errors
 		c.DB.Model(&models.DiaryEntry{}).
-			Select("DISTINCT date_part('year', diary_entries.created_at) as year").
+			Select("DISTINCT date_part('year', "+models.DateColumn+") as year").
 			Joins("LEFT JOIN map_entries me1 ON diary_entries.map_entry_id = me1.id").
-			Joins("LEFT JOIN gps_data gd1 ON me1.gps_data_id = gd1.id").
+			Joins("LEFT JOIN gps_data gd1 ON gd1.map_entry_id = me1.id").
 			Where("gd1.id IS NOT NULL").
 			Order("year desc").
 			Pluck("year", &years)
@@ -67,10 +74,354 @@ func (c *Stats) ServeMux() http.Handler {
 	router := chi.NewRouter()
 
 	router.Get("/{year:[0-9]+}", c.ViewHandler)
+	router.Get("/{year:[0-9]+}.json", c.JSONHandler)
+	router.Get("/{year:[0-9]+}.csv", c.CSVHandler)
+	router.Get("/compare", c.CompareHandler)
 
 	return router
 }
 
+// Period is aggregated gps data for a month, week or activity type.
+type Period struct {
+	Period   time.Time
+	Type     string
+	Label    string
+	Count    int
+	Distance float64
+	Duration float64
+	Ascent   float64
+}
+
+// CumulativePoint is total distance for a year up to a day of year.
+type CumulativePoint struct {
+	Year     int
+	Day      int
+	Distance float64
+}
+
+// YearSeries is a cumulative distance curve for one year.
+type YearSeries struct {
+	Year   int
+	Total  float64
+	Points []CumulativePoint
+}
+
+// EntryRow is gps data of one track of a published diary entry for exports,
+// entries with several tracks have a row for each.
+type EntryRow struct {
+	Date         time.Time `json:"date"`
+	DiaryID      uint      `json:"diary_id"`
+	Title        string    `json:"title"`
+	Start        string    `json:"start"`
+	End          string    `json:"end"`
+	Length       float64   `json:"length"`
+	Duration     float64   `json:"duration"`
+	Speed        float64   `json:"speed"`
+	Ascent       float64   `json:"ascent"`
+	Descent      float64   `json:"descent"`
+	MaxElevation *float64  `json:"max_elevation"`
+	MinElevation *float64  `json:"min_elevation"`
+	AvgHeartRate float64   `json:"avg_heart_rate"`
+	MaxHeartRate float64   `json:"max_heart_rate"`
+}
+
+// Totals are yearly sums of entry rows.
+type Totals struct {
+	Entries  int     `json:"entries"`
+	Length   float64 `json:"length"`
+	Duration float64 `json:"duration"`
+	Speed    float64 `json:"speed"`
+	Ascent   float64 `json:"ascent"`
+	Descent  float64 `json:"descent"`
+}
+
+// publishedGpsData returns query over gps data joined with published diary entries.
+func (c *Stats) publishedGpsData() *gorm.DB {
+	return c.DB.Table("gps_data").
+		Joins("JOIN map_entries me1 ON gps_data.map_entry_id = me1.id").
+		Joins("JOIN diary_entries de1 ON de1.map_entry_id = me1.id").
+		Where("de1.published = true").
+		Where("gps_data.deleted_at IS NULL AND me1.deleted_at IS NULL AND de1.deleted_at IS NULL")
+}
+
+// trackRow is one track of a published diary entry, aggregations are computed
+// from these in Go so they do not depend on database date functions.
+type trackRow struct {
+	DiaryID  uint
+	Date     time.Time
+	Type     string
+	Distance float64
+	Duration float64
+	Ascent   float64
+}
+
+// yearRange returns start of the year and start of the next year.
+func yearRange(year int) (time.Time, time.Time) {
+	start := time.Date(year, time.January, 1, 0, 0, 0, 0, time.UTC)
+	return start, start.AddDate(1, 0, 0)
+}
+
+// tracks returns tracks of diary entries published in years, oldest first.
+func (c *Stats) tracks(years ...int) ([]trackRow, error) {
+	rows := []trackRow{}
+	if len(years) == 0 {
+		return rows, nil
+	}
+
+	conditions := make([]string, 0, len(years))
+	args := make([]interface{}, 0, 2*len(years))
+	for _, year := range years {
+		start, end := yearRange(year)
+		conditions = append(conditions, "(de1.published_at >= ? AND de1.published_at < ?)")
+		args = append(args, start, end)
+	}
+
+	query := c.publishedGpsData().
+		Select(`de1.id as diary_id,
+			de1.published_at as date,
+			COALESCE(gps_data.activity_type, '') as type,
+			COALESCE(gps_data.length, 0) as distance,
+			COALESCE(gps_data.duration, 0) as duration,
+			COALESCE(gps_data.ascent, 0) as ascent`).
+		Where(strings.Join(conditions, " OR "), args...).
+		Order("de1.published_at, gps_data.id").
+		Scan(&rows)
+	if query.Error != nil {
+		return nil, errors.Wrap(query.Error, "could not get tracks for stats")
+	}
+
+	// periods are in the same time zone as years
+	for i := range rows {
+		rows[i].Date = rows[i].Date.UTC()
+	}
+	return rows, nil
+}
+
+// truncateMonth returns the first day of the month of t.
+func truncateMonth(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+}
+
+// truncateWeek returns monday of the week of t.
+func truncateWeek(t time.Time) time.Time {
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+}
+
+// periods sums tracks ordered by date into periods returned by truncate.
+func periods(tracks []trackRow, truncate func(time.Time) time.Time) []Period {
+	periods := []Period{}
+	var diaryIDs map[uint]bool
+	for _, track := range tracks {
+		period := truncate(track.Date)
+		if len(periods) == 0 || !periods[len(periods)-1].Period.Equal(period) {
+			periods = append(periods, Period{Period: period})
+			diaryIDs = map[uint]bool{}
+		}
+
+		current := &periods[len(periods)-1]
+		if !diaryIDs[track.DiaryID] {
+			diaryIDs[track.DiaryID] = true
+			current.Count++
+		}
+		current.Distance += track.Distance
+		current.Duration += track.Duration
+		current.Ascent += track.Ascent
+	}
+	return periods
+}
+
+// types sums tracks by activity type, longest distance first.
+func types(tracks []trackRow) []Period {
+	periods := []Period{}
+	indexes := map[string]int{}
+	diaryIDs := map[string]map[uint]bool{}
+	for _, track := range tracks {
+		i, ok := indexes[track.Type]
+		if !ok {
+			i = len(periods)
+			indexes[track.Type] = i
+			diaryIDs[track.Type] = map[uint]bool{}
+			periods = append(periods, Period{Type: track.Type, Label: "Neznano"})
+			for _, activityType := range models.ActivityTypes {
+				if activityType.ID == track.Type {
+					periods[i].Label = activityType.Name
+				}
+			}
+		}
+
+		if !diaryIDs[track.Type][track.DiaryID] {
+			diaryIDs[track.Type][track.DiaryID] = true
+			periods[i].Count++
+		}
+		periods[i].Distance += track.Distance
+		periods[i].Duration += track.Duration
+		periods[i].Ascent += track.Ascent
+	}
+
+	sort.SliceStable(periods, func(i, j int) bool {
+		return periods[i].Distance > periods[j].Distance
+	})
+	return periods
+}
+
+// cumulative returns distance series of years from tracks ordered by date,
+// each diary entry adds one point.
+func cumulative(tracks []trackRow, years []int) []YearSeries {
+	series := make([]YearSeries, len(years))
+	for i, year := range years {
+		series[i].Year = year
+		var diaryID uint
+		for _, track := range tracks {
+			if track.Date.Year() != year {
+				continue
+			}
+
+			series[i].Total += track.Distance
+			if len(series[i].Points) > 0 && track.DiaryID == diaryID {
+				series[i].Points[len(series[i].Points)-1].Distance = series[i].Total
+				continue
+			}
+			diaryID = track.DiaryID
+			series[i].Points = append(series[i].Points, CumulativePoint{
+				Year:     year,
+				Day:      track.Date.YearDay(),
+				Distance: series[i].Total,
+			})
+		}
+	}
+	return series
+}
+
+func (c *Stats) entryRows(year int) ([]EntryRow, error) {
+	rows := []EntryRow{}
+	start, end := yearRange(year)
+	query := c.publishedGpsData().
+		Select(`de1.published_at as date,
+			de1.id as diary_id,
+			de1.title as title,
+			gps_data.start as start,
+			gps_data."end" as "end",
+			gps_data.length as length,
+			gps_data.duration as duration,
+			gps_data.avg_speed as speed,
+			COALESCE(gps_data.ascent, 0) as ascent,
+			COALESCE(gps_data.descent, 0) as descent,
+			gps_data.max_elevation as max_elevation,
+			gps_data.min_elevation as min_elevation,
+			COALESCE(gps_data.avg_heart_rate, 0) as avg_heart_rate,
+			COALESCE(gps_data.max_heart_rate, 0) as max_heart_rate`).
+		Where("de1.published_at >= ? AND de1.published_at < ?", start, end).
+		Order("de1.published_at, gps_data.id").
+		Scan(&rows)
+	if query.Error != nil {
+		return nil, errors.Wrap(query.Error, "could not get entry stats")
+	}
+	return rows, nil
+}
+
+func (c *Stats) JSONHandler(w http.ResponseWriter, r *http.Request) {
+	year, err := strconv.Atoi(chi.URLParam(r, "year"))
+	if err != nil {
+		c.render.NotFound(w, r)
+		return
+	}
+
+	rows, err := c.entryRows(year)
+	if err != nil {
+		c.render.Error(w, r, err)
+		return
+	}
+
+	totals := Totals{}
+	diaryIDs := map[uint]bool{}
+	for _, row := range rows {
+		diaryIDs[row.DiaryID] = true
+		totals.Length += row.Length
+		totals.Duration += row.Duration
+		totals.Ascent += row.Ascent
+		totals.Descent += row.Descent
+	}
+	totals.Entries = len(diaryIDs)
+	if totals.Duration > 0 {
+		totals.Speed = totals.Length / (totals.Duration / 3600)
+	}
+
+	response := struct {
+		Year    int        `json:"year"`
+		Entries []EntryRow `json:"entries"`
+		Totals  Totals     `json:"totals"`
+	}{
+		Year:    year,
+		Entries: rows,
+		Totals:  totals,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		c.render.Error(w, r, err)
+		return
+	}
+}
+
+func (c *Stats) CSVHandler(w http.ResponseWriter, r *http.Request) {
+	year, err := strconv.Atoi(chi.URLParam(r, "year"))
+	if err != nil {
+		c.render.NotFound(w, r)
+		return
+	}
+
+	rows, err := c.entryRows(year)
+	if err != nil {
+		c.render.Error(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"stats-%d.csv\"", year))
+
+	formatFloat := func(f float64) string {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	// missing elevation is an empty cell
+	formatElevation := func(f *float64) string {
+		if f == nil {
+			return ""
+		}
+		return formatFloat(*f)
+	}
+
+	writer := csv.NewWriter(w)
+	writer.Write([]string{
+		"date", "diary_id", "title", "start", "end", "length", "duration", "speed",
+		"ascent", "descent", "max_elevation", "min_elevation",
+		"avg_heart_rate", "max_heart_rate",
+	})
+	for _, row := range rows {
+		writer.Write([]string{
+			row.Date.Format(time.RFC3339),
+			strconv.Itoa(int(row.DiaryID)),
+			row.Title,
+			row.Start,
+			row.End,
+			formatFloat(row.Length),
+			formatFloat(row.Duration),
+			formatFloat(row.Speed),
+			formatFloat(row.Ascent),
+			formatFloat(row.Descent),
+			formatElevation(row.MaxElevation),
+			formatElevation(row.MinElevation),
+			formatFloat(row.AvgHeartRate),
+			formatFloat(row.MaxHeartRate),
+		})
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		c.render.Error(w, r, err)
+		return
+	}
+}
+
 func (c *Stats) ViewHandler(w http.ResponseWriter, r *http.Request) {
 	year, err := strconv.Atoi(chi.URLParam(r, "year"))
 	if err != nil {
@@ -78,26 +429,79 @@ func (c *Stats) ViewHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	gpsData := []models.GpsData{}
+	diaryEntries := []models.DiaryEntry{}
 	query := c.DB.
-		Joins("LEFT JOIN map_entries me1 ON gps_data.id = me1.gps_data_id").
-		Joins("LEFT JOIN diary_entries de1 ON de1.map_entry_id = me1.id").
-		Where("date_part('year', de1.created_at) = ?", year).
-		Where("de1.published = true").
-		Order("de1.created_at").
-		Find(&gpsData)
+		Preload("MapEntry.Tracks", func(db *gorm.DB) *gorm.DB {
+			return db.Order("gps_data.date, gps_data.id")
+		}).
+		Where("date_part('year', published_at) = ?", year).
+		Where("published = true").
+		Order("published_at").
+		Find(&diaryEntries)
 	if query.Error != nil {
 		c.render.Error(w, r, query.Error)
 		return
 	}
 
+	// one stage per diary entry, tracks of the same day are summed
+	gpsData := []models.GpsData{}
+	for _, diaryEntry := range diaryEntries {
+		if len(diaryEntry.MapEntry.Tracks) > 0 {
+			gpsData = append(gpsData, diaryEntry.MapEntry.Summary())
+		}
+	}
+
 	distances := make([]float64, len(gpsData))
 	times := make([]float64, len(gpsData))
 	speeds := make([]float64, len(gpsData))
+	ascents := make([]float64, len(gpsData))
+	movingTimes := make([]float64, len(gpsData))
+	heartRates := make([]float64, len(gpsData))
+	maxHeartRates := make([]float64, len(gpsData))
+	maxElevation := 0.0
+	maxHeartRate := 0.0
+	heartRateSum := 0.0
+	heartRateCount := 0
 	for i := range gpsData {
 		distances[i] = gpsData[i].Length
 		times[i] = gpsData[i].Duration
 		speeds[i] = gpsData[i].AvgSpeed
+		ascents[i] = gpsData[i].Ascent
+		movingTimes[i] = gpsData[i].MovingTime
+		if gpsData[i].HasElevation() && *gpsData[i].MaxElevation > maxElevation {
+			maxElevation = *gpsData[i].MaxElevation
+		}
+		heartRates[i] = gpsData[i].AvgHeartRate
+		maxHeartRates[i] = gpsData[i].MaxHeartRate
+		if gpsData[i].AvgHeartRate > 0 {
+			heartRateSum += gpsData[i].AvgHeartRate
+			heartRateCount++
+		}
+		if gpsData[i].MaxHeartRate > maxHeartRate {
+			maxHeartRate = gpsData[i].MaxHeartRate
+		}
+	}
+	// stages without a heart rate monitor are left out of the average
+	avgHeartRate := 0.0
+	if heartRateCount > 0 {
+		avgHeartRate = heartRateSum / float64(heartRateCount)
+	}
+
+	tracks, err := c.tracks(year)
+	if err != nil {
+		c.render.Error(w, r, err)
+		return
+	}
+
+	months := periods(tracks, truncateMonth)
+	for i := range months {
+		months[i].Label = months[i].Period.Format("1. 2006")
+	}
+
+	weeks := periods(tracks, truncateWeek)
+	for i := range weeks {
+		_, week := weeks[i].Period.ISOWeek()
+		weeks[i].Label = fmt.Sprintf("%d. teden", week)
 	}
 
 	// TODO: separate year to fix active year marker
@@ -106,7 +510,58 @@ func (c *Stats) ViewHandler(w http.ResponseWriter, r *http.Request) {
 		"distances": distances,
 		"times":     times,
 		"speeds":    speeds,
+
+		"ascents":      ascents,
+		"movingTimes":  movingTimes,
+		"maxElevation": maxElevation,
+
+		"heartRates":    heartRates,
+		"maxHeartRates": maxHeartRates,
+		"avgHeartRate":  avgHeartRate,
+		"maxHeartRate":  maxHeartRate,
+
+		"months": months,
+		"weeks":  weeks,
+		"types":  types(tracks),
 	}
 
 	c.render.Template(w, r, "stats.html", context)
 }
+
+func (c *Stats) CompareHandler(w http.ResponseWriter, r *http.Request) {
+	years := []int{}
+	if value := r.URL.Query().Get("years"); value != "" {
+		for _, yearStr := range strings.Split(value, ",") {
+			year, err := strconv.Atoi(strings.TrimSpace(yearStr))
+			if err != nil {
+				http.Error(w, "invalid year", http.StatusBadRequest)
+				return
+			}
+			years = append(years, year)
+		}
+	} else if r.URL.Query()["year"] != nil {
+		for _, yearStr := range r.URL.Query()["year"] {
+			year, err := strconv.Atoi(yearStr)
+			if err != nil {
+				http.Error(w, "invalid year", http.StatusBadRequest)
+				return
+			}
+			years = append(years, year)
+		}
+	}
+
+	tracks, err := c.tracks(years...)
+	if err != nil {
+		c.render.Error(w, r, err)
+		return
+	}
+
+	series := cumulative(tracks, years)
+
+	context := render.Context{
+		"series": series,
+		"years":  years,
+	}
+
+	c.render.Template(w, r, "stats_compare.html", context)
+}
@@ -0,0 +1,237 @@
+package stats
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+
+	"github.com/matematik7/camino-go/diary/models"
+)
+
+// newTestStats returns stats with a sqlite database in a temporary directory.
+func newTestStats(t *testing.T) *Stats {
+	DB, err := gorm.Open("sqlite3", filepath.Join(t.TempDir(), "stats.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { DB.Close() })
+
+	if err := DB.AutoMigrate(&models.DiaryEntry{}, &models.MapEntry{}, &models.GpsData{}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	return &Stats{DB: DB}
+}
+
+// saveEntry saves a diary entry published at date with tracks.
+func saveEntry(t *testing.T, DB *gorm.DB, title string, published bool, date time.Time, tracks ...models.GpsData) {
+	entry := models.DiaryEntry{
+		Title:       title,
+		Text:        title,
+		AuthorID:    1,
+		Published:   published,
+		PublishedAt: &date,
+		MapEntry:    models.MapEntry{City: title, Tracks: tracks},
+	}
+	if err := DB.Save(&entry).Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func date(year int, month time.Month, day int) time.Time {
+	return time.Date(year, month, day, 18, 0, 0, 0, time.UTC)
+}
+
+func TestTracks(t *testing.T) {
+	c := newTestStats(t)
+	saveEntry(t, c.DB, "Leon", true, date(2021, time.September, 9),
+		models.GpsData{Length: 10, Duration: 3600, Ascent: 100, ActivityType: "Walk"},
+		models.GpsData{Length: 5, Duration: 1800, Ascent: 50},
+	)
+	saveEntry(t, c.DB, "Draft", false, date(2021, time.September, 10), models.GpsData{Length: 20})
+	saveEntry(t, c.DB, "Ljubljana", true, date(2020, time.December, 31), models.GpsData{Length: 30})
+
+	tracks, err := c.tracks(2021)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []trackRow{
+		{DiaryID: 1, Date: date(2021, time.September, 9), Type: "Walk", Distance: 10, Duration: 3600, Ascent: 100},
+		{DiaryID: 1, Date: date(2021, time.September, 9), Distance: 5, Duration: 1800, Ascent: 50},
+	}
+	if !reflect.DeepEqual(tracks, want) {
+		t.Errorf("expected tracks %+v, got %+v", want, tracks)
+	}
+
+	tracks, err = c.tracks(2020, 2021)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tracks) != 3 || tracks[0].DiaryID != 3 {
+		t.Errorf("expected tracks of both years, got %+v", tracks)
+	}
+}
+
+func TestPeriods(t *testing.T) {
+	tracks := []trackRow{
+		// sunday, the first entry has two tracks
+		{DiaryID: 1, Date: date(2021, time.August, 29), Distance: 10, Duration: 3600, Ascent: 100},
+		{DiaryID: 1, Date: date(2021, time.August, 29), Distance: 5, Duration: 1800},
+		// monday and wednesday of the next week
+		{DiaryID: 2, Date: date(2021, time.August, 30), Distance: 20},
+		{DiaryID: 3, Date: date(2021, time.September, 1), Distance: 25, Ascent: 300},
+	}
+
+	months := periods(tracks, truncateMonth)
+	want := []Period{
+		{Period: time.Date(2021, time.August, 1, 0, 0, 0, 0, time.UTC), Count: 2, Distance: 35, Duration: 5400, Ascent: 100},
+		{Period: time.Date(2021, time.September, 1, 0, 0, 0, 0, time.UTC), Count: 1, Distance: 25, Ascent: 300},
+	}
+	if !reflect.DeepEqual(months, want) {
+		t.Errorf("expected months %+v, got %+v", want, months)
+	}
+
+	weeks := periods(tracks, truncateWeek)
+	want = []Period{
+		{Period: time.Date(2021, time.August, 23, 0, 0, 0, 0, time.UTC), Count: 1, Distance: 15, Duration: 5400, Ascent: 100},
+		{Period: time.Date(2021, time.August, 30, 0, 0, 0, 0, time.UTC), Count: 2, Distance: 45, Ascent: 300},
+	}
+	if !reflect.DeepEqual(weeks, want) {
+		t.Errorf("expected weeks %+v, got %+v", want, weeks)
+	}
+
+	if periods := periods(nil, truncateMonth); len(periods) != 0 {
+		t.Errorf("expected no periods, got %+v", periods)
+	}
+}
+
+func TestTypes(t *testing.T) {
+	tracks := []trackRow{
+		{DiaryID: 1, Type: "Walk", Distance: 10},
+		{DiaryID: 1, Type: "Ride", Distance: 40},
+		{DiaryID: 2, Type: "Walk", Distance: 20},
+		{DiaryID: 3, Distance: 5},
+	}
+
+	periods := types(tracks)
+	if len(periods) != 3 {
+		t.Fatalf("expected 3 types, got %+v", periods)
+	}
+	if periods[0].Type != "Ride" || periods[0].Count != 1 || periods[0].Distance != 40 {
+		t.Errorf("expected rides first, got %+v", periods[0])
+	}
+	if periods[1].Type != "Walk" || periods[1].Count != 2 || periods[1].Distance != 30 {
+		t.Errorf("expected walks second, got %+v", periods[1])
+	}
+	if periods[2].Type != "" || periods[2].Label != "Neznano" {
+		t.Errorf("expected unknown type last, got %+v", periods[2])
+	}
+}
+
+func TestCumulative(t *testing.T) {
+	tracks := []trackRow{
+		{DiaryID: 1, Date: date(2020, time.June, 1), Distance: 30},
+		{DiaryID: 2, Date: date(2021, time.January, 2), Distance: 10},
+		{DiaryID: 2, Date: date(2021, time.January, 2), Distance: 5},
+		{DiaryID: 3, Date: date(2021, time.January, 3), Distance: 20},
+	}
+
+	series := cumulative(tracks, []int{2021, 2020, 2019})
+	want := []YearSeries{
+		{Year: 2021, Total: 35, Points: []CumulativePoint{{Year: 2021, Day: 2, Distance: 15}, {Year: 2021, Day: 3, Distance: 35}}},
+		{Year: 2020, Total: 30, Points: []CumulativePoint{{Year: 2020, Day: 153, Distance: 30}}},
+		{Year: 2019},
+	}
+	if !reflect.DeepEqual(series, want) {
+		t.Errorf("expected series %+v, got %+v", want, series)
+	}
+}
+
+// exportFixture saves entries of 2021, the first one with two tracks.
+func exportFixture(t *testing.T, c *Stats) {
+	saveEntry(t, c.DB, "Leon", true, date(2021, time.September, 9),
+		models.GpsData{Start: "Leon", End: "Virgen", Length: 8, Duration: 7200, AvgSpeed: 4, Ascent: 50, Descent: 20, MaxElevation: elevation(870), MinElevation: elevation(0), AvgHeartRate: 110, MaxHeartRate: 140},
+		models.GpsData{Start: "Virgen", End: "Mazarife", Length: 14, Duration: 10800, AvgSpeed: 4.5},
+	)
+	saveEntry(t, c.DB, "Astorga", true, date(2021, time.September, 10),
+		models.GpsData{Start: "Mazarife", End: "Astorga", Length: 30, Duration: 21600, Ascent: 150, Descent: 100},
+	)
+	saveEntry(t, c.DB, "Draft", false, date(2021, time.September, 11), models.GpsData{Length: 20})
+}
+
+// elevation returns pointer to elevation of gps data.
+func elevation(value float64) *float64 {
+	return &value
+}
+
+// yearRequest returns request for path with year url parameter.
+func yearRequest(path string, year string) *http.Request {
+	r := httptest.NewRequest("GET", path, nil)
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("year", year)
+	return r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+}
+
+func TestJSONHandler(t *testing.T) {
+	c := newTestStats(t)
+	exportFixture(t, c)
+
+	w := httptest.NewRecorder()
+	c.JSONHandler(w, yearRequest("/stats/2021.json", "2021"))
+
+	var response struct {
+		Year    int        `json:"year"`
+		Entries []EntryRow `json:"entries"`
+		Totals  Totals     `json:"totals"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+
+	if response.Year != 2021 || len(response.Entries) != 3 {
+		t.Fatalf("expected 3 rows of 2021, got %+v", response)
+	}
+	if row := response.Entries[1]; row.Title != "Leon" || row.Start != "Virgen" || row.MaxElevation != nil {
+		t.Errorf("expected second track of Leon without elevation, got %+v", row)
+	}
+	want := Totals{Entries: 2, Length: 52, Duration: 39600, Speed: 52 / 11.0, Ascent: 200, Descent: 120}
+	if response.Totals != want {
+		t.Errorf("expected totals %+v, got %+v", want, response.Totals)
+	}
+}
+
+func TestCSVHandler(t *testing.T) {
+	c := newTestStats(t)
+	exportFixture(t, c)
+
+	w := httptest.NewRecorder()
+	c.CSVHandler(w, yearRequest("/stats/2021.csv", "2021"))
+
+	if disposition := w.Header().Get("Content-Disposition"); disposition != `attachment; filename="stats-2021.csv"` {
+		t.Errorf("unexpected content disposition %q", disposition)
+	}
+	records, err := csv.NewReader(w.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := [][]string{
+		{"date", "diary_id", "title", "start", "end", "length", "duration", "speed", "ascent", "descent", "max_elevation", "min_elevation", "avg_heart_rate", "max_heart_rate"},
+		{"2021-09-09T18:00:00Z", "1", "Leon", "Leon", "Virgen", "8", "7200", "4", "50", "20", "870", "0", "110", "140"},
+		{"2021-09-09T18:00:00Z", "1", "Leon", "Virgen", "Mazarife", "14", "10800", "4.5", "0", "0", "", "", "0", "0"},
+		{"2021-09-10T18:00:00Z", "2", "Astorga", "Mazarife", "Astorga", "30", "21600", "0", "150", "100", "", "", "0", "0"},
+	}
+	if !reflect.DeepEqual(records, want) {
+		t.Errorf("expected csv %v, got %v", want, records)
+	}
+}
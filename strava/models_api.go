@@ -8,11 +8,12 @@ import (
 type Activity struct {
 	ID                  int       `json:"id"`
 	Name                string    `json:"name"`
+	Description         string    `json:"description"`
 	Distance            float64   `json:"distance"`
 	MovingTime          int       `json:"moving_time"`
 	ElapsedTime         int       `json:"elapsed_time"`
 	TotalEleveationGain float64   `json:"total_elevation_gain"`
-	Type                string    `json:"Walk"`
+	Type                string    `json:"type"`
 	StartDate           time.Time `json:"start_date"`
 	AverageSpeed        float64   `json:"average_speed"`
 }
@@ -20,6 +21,35 @@ type Activity struct {
 type Tokens struct {
 	AccessToken  string `json:"access_token"`
 	RefreshToken string `json:"refresh_token"`
+	ExpiresAt    int64  `json:"expires_at"`
+
+	// Athlete is only returned when exchanging authorization code
+	Athlete *Athlete `json:"athlete"`
+}
+
+type Athlete struct {
+	ID int `json:"id"`
+}
+
+type Photo struct {
+	UniqueID string            `json:"unique_id"`
+	Caption  string            `json:"caption"`
+	Source   int               `json:"source"`
+	URLs     map[string]string `json:"urls"`
+}
+
+type WebhookEvent struct {
+	ObjectType     string                 `json:"object_type"`
+	ObjectID       int                    `json:"object_id"`
+	AspectType     string                 `json:"aspect_type"`
+	OwnerID        int                    `json:"owner_id"`
+	SubscriptionID int                    `json:"subscription_id"`
+	EventTime      int64                  `json:"event_time"`
+	Updates        map[string]interface{} `json:"updates"`
+}
+
+type Subscription struct {
+	ID int `json:"id"`
 }
 
 type Stream struct {
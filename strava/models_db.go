@@ -1,6 +1,8 @@
 package strava
 
 import (
+	"time"
+
 	"github.com/jinzhu/gorm"
 	"github.com/matematik7/gongo/authorization"
 )
@@ -11,6 +13,18 @@ type StravaUserTokens struct {
 	User   *authorization.User
 	UserID uint
 
+	// AthleteID is the strava owner id sent with webhook events.
+	AthleteID int `gorm:"index"`
+
 	AccessToken  string
 	RefreshToken string
+	ExpiresAt    time.Time
+}
+
+// StravaSubscription is a push subscription created by Subscribe, webhook
+// events of other subscriptions are rejected.
+type StravaSubscription struct {
+	gorm.Model
+
+	SubscriptionID int `gorm:"unique_index"`
 }
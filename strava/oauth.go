@@ -0,0 +1,238 @@
+package strava
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/matematik7/gongo/authorization"
+	"github.com/pkg/errors"
+
+	"github.com/matematik7/camino-go/flash"
+)
+
+const (
+	sessionName = "strava"
+	stateKey    = "state"
+
+	scope = "read,activity:read_all"
+)
+
+func (s *Service) ServeMux() http.Handler {
+	router := chi.NewRouter()
+
+	router.Get("/connect", s.ConnectHandler)
+	router.Get("/callback", s.CallbackHandler)
+	router.Post("/disconnect", s.DisconnectHandler)
+
+	return router
+}
+
+func (s *Service) redirectURI() string {
+	return s.appURL + "/strava/callback"
+}
+
+// ConnectHandler redirects logged in user to strava authorization page.
+func (s *Service) ConnectHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Context().Value("user") == nil {
+		s.render.Forbidden(w, r)
+		return
+	}
+
+	state := make([]byte, 32)
+	if _, err := rand.Read(state); err != nil {
+		s.render.Error(w, r, errors.Wrap(err, "could not generate state"))
+		return
+	}
+
+	session, err := s.store.Get(r, sessionName)
+	if err != nil {
+		s.render.Error(w, r, errors.Wrap(err, "could not get session"))
+		return
+	}
+	session.Values[stateKey] = base64.RawURLEncoding.EncodeToString(state)
+	if err := session.Save(r, w); err != nil {
+		s.render.Error(w, r, errors.Wrap(err, "could not save session"))
+		return
+	}
+
+	query := url.Values{}
+	query.Set("client_id", s.ClientID)
+	query.Set("response_type", "code")
+	query.Set("redirect_uri", s.redirectURI())
+	query.Set("approval_prompt", "auto")
+	query.Set("scope", scope)
+	query.Set("state", session.Values[stateKey].(string))
+
+	http.Redirect(w, r, s.AuthorizeURL+"?"+query.Encode(), http.StatusFound)
+}
+
+// CallbackHandler exchanges authorization code for tokens of the logged in user.
+func (s *Service) CallbackHandler(w http.ResponseWriter, r *http.Request) {
+	userItf := r.Context().Value("user")
+	if userItf == nil {
+		s.render.Forbidden(w, r)
+		return
+	}
+	user := userItf.(authorization.User)
+
+	session, err := s.store.Get(r, sessionName)
+	if err != nil {
+		s.render.Error(w, r, errors.Wrap(err, "could not get session"))
+		return
+	}
+	state, _ := session.Values[stateKey].(string)
+	delete(session.Values, stateKey)
+	if err := session.Save(r, w); err != nil {
+		s.render.Error(w, r, errors.Wrap(err, "could not save session"))
+		return
+	}
+
+	query := r.URL.Query()
+	if state == "" || subtle.ConstantTimeCompare([]byte(state), []byte(query.Get("state"))) != 1 {
+		s.render.Forbidden(w, r)
+		return
+	}
+
+	if query.Get("error") != "" || query.Get("code") == "" {
+		if err := s.render.AddFlash(w, r, flash.Error("Povezava s Strava ni bila odobrena!")); err != nil {
+			s.render.Error(w, r, err)
+			return
+		}
+		http.Redirect(w, r, "/diary/new", http.StatusFound)
+		return
+	}
+
+	if !strings.Contains(query.Get("scope"), "activity:read") {
+		if err := s.render.AddFlash(w, r, flash.Error("Za uvoz aktivnosti je potreben dostop do aktivnosti!")); err != nil {
+			s.render.Error(w, r, err)
+			return
+		}
+		http.Redirect(w, r, "/diary/new", http.StatusFound)
+		return
+	}
+
+	if err := s.Connect(r.Context(), user.ID, query.Get("code")); err != nil {
+		s.render.Error(w, r, err)
+		return
+	}
+
+	if err := s.render.AddFlash(w, r, flash.Info("Strava povezana!")); err != nil {
+		s.render.Error(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, "/diary/new", http.StatusFound)
+}
+
+// Connect exchanges authorization code and stores tokens for user.
+func (s *Service) Connect(ctx context.Context, userID uint, code string) error {
+	form := url.Values{}
+	form.Add("grant_type", "authorization_code")
+	form.Add("code", code)
+
+	tokens, err := s.token(ctx, form)
+	if err != nil {
+		return errors.Wrap(err, "could not exchange code")
+	}
+
+	var userTokens StravaUserTokens
+	query := s.DB.First(&userTokens, "user_id = ?", userID)
+	if !query.RecordNotFound() && query.Error != nil {
+		return errors.Wrap(query.Error, "could not get user tokens")
+	}
+
+	userTokens.UserID = userID
+	userTokens.AccessToken = tokens.AccessToken
+	userTokens.RefreshToken = tokens.RefreshToken
+	userTokens.ExpiresAt = time.Unix(tokens.ExpiresAt, 0)
+	if tokens.Athlete != nil {
+		userTokens.AthleteID = tokens.Athlete.ID
+	}
+
+	if err := s.DB.Save(&userTokens).Error; err != nil {
+		return errors.Wrap(err, "user token db write")
+	}
+
+	return nil
+}
+
+// DisconnectHandler revokes strava access and deletes tokens of the logged in
+// user, it only accepts csrf protected POST requests.
+func (s *Service) DisconnectHandler(w http.ResponseWriter, r *http.Request) {
+	userItf := r.Context().Value("user")
+	if userItf == nil {
+		s.render.Forbidden(w, r)
+		return
+	}
+	user := userItf.(authorization.User)
+
+	if err := s.Disconnect(r.Context(), user.ID); err != nil && err != NoTokenError {
+		s.render.Error(w, r, err)
+		return
+	}
+
+	if err := s.render.AddFlash(w, r, flash.Info("Strava odklopljena!")); err != nil {
+		s.render.Error(w, r, err)
+		return
+	}
+
+	http.Redirect(w, r, "/diary/new", http.StatusFound)
+}
+
+// Disconnect deauthorizes the application and deletes tokens of user.
+func (s *Service) Disconnect(ctx context.Context, userID uint) error {
+	userTokens, err := s.userTokens(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	status, err := s.deauthorize(ctx, userTokens.AccessToken)
+	if err != nil {
+		return err
+	}
+	if status == http.StatusUnauthorized {
+		userTokens, err = s.refresh(ctx, userID, userTokens.AccessToken)
+		if err != nil {
+			return err
+		}
+		status, err = s.deauthorize(ctx, userTokens.AccessToken)
+		if err != nil {
+			return err
+		}
+	}
+	if status/100 != 2 {
+		return errors.Errorf("strava error: %v", http.StatusText(status))
+	}
+
+	if err := s.DB.Unscoped().Delete(&userTokens).Error; err != nil {
+		return errors.Wrap(err, "could not delete user tokens")
+	}
+
+	return nil
+}
+
+func (s *Service) deauthorize(ctx context.Context, accessToken string) (int, error) {
+	form := url.Values{}
+	form.Add("access_token", accessToken)
+
+	req, err := s.request(ctx, "POST", "v3/oauth/deauthorize", strings.NewReader(form.Encode()))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := s.do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,106 @@
+package strava
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// shortTermWindow is the strava rate limit window, windows start at natural
+// quarter hours, daily limit resets at midnight UTC.
+const shortTermWindow = 15 * time.Minute
+
+// RateLimitedError is returned when strava rate limit is exhausted, no
+// requests are made until Until.
+type RateLimitedError struct {
+	Until time.Time
+}
+
+func (e *RateLimitedError) Error() string {
+	return fmt.Sprintf("strava rate limit exceeded until %v", e.Until.Format(time.RFC3339))
+}
+
+// do sends request with configured client unless the rate limit is exhausted.
+func (s *Service) do(req *http.Request) (*http.Response, error) {
+	if err := s.rateLimited(time.Now()); err != nil {
+		return nil, err
+	}
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	s.updateRateLimit(resp, time.Now())
+	if resp.StatusCode == http.StatusTooManyRequests {
+		resp.Body.Close()
+		return nil, s.rateLimited(time.Now())
+	}
+
+	return resp, nil
+}
+
+func (s *Service) rateLimited(now time.Time) error {
+	s.rateLimitMu.Lock()
+	defer s.rateLimitMu.Unlock()
+
+	if now.Before(s.rateLimitUntil) {
+		return &RateLimitedError{
+			Until: s.rateLimitUntil,
+		}
+	}
+	return nil
+}
+
+// updateRateLimit backs off until the end of the window when usage reported
+// in response headers reached the limit or strava refused the request.
+func (s *Service) updateRateLimit(resp *http.Response, now time.Time) {
+	now = now.UTC()
+	nextWindow := now.Truncate(shortTermWindow).Add(shortTermWindow)
+	nextDay := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+
+	var until time.Time
+	limit, limitOK := parseRateLimit(resp.Header.Get("X-RateLimit-Limit"))
+	usage, usageOK := parseRateLimit(resp.Header.Get("X-RateLimit-Usage"))
+	if limitOK && usageOK {
+		if usage[1] >= limit[1] {
+			until = nextDay
+		} else if usage[0] >= limit[0] {
+			until = nextWindow
+		}
+	}
+	if until.IsZero() && resp.StatusCode == http.StatusTooManyRequests {
+		until = nextWindow
+	}
+	if until.IsZero() {
+		return
+	}
+
+	s.rateLimitMu.Lock()
+	defer s.rateLimitMu.Unlock()
+	if until.After(s.rateLimitUntil) {
+		s.rateLimitUntil = until
+	}
+}
+
+// parseRateLimit parses short term and daily values of rate limit headers,
+// for example "600,30000".
+func parseRateLimit(value string) ([2]int, bool) {
+	var values [2]int
+
+	parts := strings.Split(value, ",")
+	if len(parts) != 2 {
+		return values, false
+	}
+	for i, part := range parts {
+		v, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return values, false
+		}
+		values[i] = v
+	}
+
+	return values, true
+}
@@ -5,133 +5,247 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/gorilla/sessions"
 	"github.com/jinzhu/gorm"
 	"github.com/matematik7/gongo"
 	"github.com/matematik7/gongo/authorization"
+	"github.com/matematik7/gongo/render"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"golang.org/x/sync/singleflight"
 )
 
 var NoTokenError = errors.New("current user doesn't have strava access tokens")
 
+const (
+	DefaultBaseURL      = "https://www.strava.com/api/"
+	DefaultAuthorizeURL = "https://www.strava.com/oauth/authorize"
+	DefaultTimeout      = 30 * time.Second
+)
+
 type Service struct {
-	DB *gorm.DB
+	DB           *gorm.DB
+	Client       *http.Client
+	BaseURL      string
+	AuthorizeURL string
+
+	ClientID     string
+	ClientSecret string
+
+	// VerifyToken is echoed by strava when validating a push subscription.
+	VerifyToken string
+
+	// OnActivityCreate is called for every activity created by a connected
+	// athlete, context has "user" and "activityID" values.
+	OnActivityCreate gongo.Callback
+
+	// refreshGroup merges concurrent token refreshes of the same user
+	refreshGroup singleflight.Group
+
+	// requests are refused until the exhausted rate limit window resets
+	rateLimitMu    sync.Mutex
+	rateLimitUntil time.Time
+
+	log    *logrus.Logger
+	render *render.Render
+	store  sessions.Store
+	appURL string
 }
 
 func New() *Service {
-	return &Service{}
+	return &Service{
+		Client: &http.Client{
+			Timeout: DefaultTimeout,
+		},
+		BaseURL:      DefaultBaseURL,
+		AuthorizeURL: DefaultAuthorizeURL,
+		ClientID:     viper.GetString("strava_client_id"),
+		ClientSecret: viper.GetString("strava_client_secret"),
+		VerifyToken:  viper.GetString("strava_verify_token"),
+	}
 }
 
 func (s *Service) Configure(app gongo.App) error {
 	s.DB = app["DB"].(*gorm.DB)
+	s.log = app["Log"].(*logrus.Logger)
+	s.render = app["Render"].(*render.Render)
+	s.store = app["Store"].(sessions.Store)
+	s.appURL = viper.GetString("url")
 	return nil
 }
 
-func (s Service) Resources() []interface{} {
+func (s *Service) Resources() []interface{} {
 	return []interface{}{
 		&StravaUserTokens{},
+		&StravaSubscription{},
 	}
 }
 
-func (s Service) request(ctx context.Context, method, path string, body io.Reader) (*http.Request, error) {
-	url := fmt.Sprintf("https://www.strava.com/api/%v", path)
+func (s *Service) request(ctx context.Context, method, path string, body io.Reader) (*http.Request, error) {
+	url := fmt.Sprintf("%v%v", s.BaseURL, path)
 	return http.NewRequestWithContext(ctx, method, url, body)
 }
 
-func (s Service) refreshToken(ctx context.Context, userTokens StravaUserTokens) error {
-	form := url.Values{}
-	form.Add("client_id", "62161")
-	form.Add("client_secret", "c07e278cd4ca90dca169e66606b5ed942c8db334")
-	form.Add("grant_type", "refresh_token")
-	form.Add("refresh_token", userTokens.RefreshToken)
+// token posts to strava token endpoint and decodes returned tokens.
+func (s *Service) token(ctx context.Context, form url.Values) (Tokens, error) {
+	tokens := Tokens{}
+
+	form.Set("client_id", s.ClientID)
+	form.Set("client_secret", s.ClientSecret)
 
 	req, err := s.request(ctx, "POST", "v3/oauth/token", strings.NewReader(form.Encode()))
 	if err != nil {
-		return err
+		return tokens, err
 	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := s.do(req)
 	if err != nil {
-		return err
+		return tokens, err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode/100 != 2 {
-		return errors.Errorf("strava error: %v", resp.Status)
+		return tokens, errors.Errorf("strava error: %v", resp.Status)
 	}
 
-	tokens := Tokens{}
 	dec := json.NewDecoder(resp.Body)
 	err = dec.Decode(&tokens)
 	if err != nil {
-		return err
+		return tokens, err
 	}
 
-	userTokens.AccessToken = tokens.AccessToken
-	userTokens.RefreshToken = tokens.RefreshToken
+	return tokens, nil
+}
+
+// maxAttempts limits requests of a single call when strava keeps rejecting
+// the access token.
+const maxAttempts = 2
 
-	err = s.DB.Save(&userTokens).Error
+func (s *Service) call(ctx context.Context, path string, response interface{}) error {
+	userID := ctx.Value("user").(authorization.User).ID
+	userTokens, err := s.userTokens(ctx, userID)
 	if err != nil {
-		return errors.Wrap(err, "user token db write")
+		return err
 	}
 
-	return nil
+	for attempt := 1; ; attempt++ {
+		status, err := s.get(ctx, path, userTokens.AccessToken, response)
+		if err != nil {
+			return err
+		}
+		if status != http.StatusUnauthorized {
+			return nil
+		}
+		if attempt >= maxAttempts {
+			return errors.Errorf("strava rejected access token after %d attempts", attempt)
+		}
+
+		userTokens, err = s.refresh(ctx, userID, userTokens.AccessToken)
+		if err != nil {
+			return err
+		}
+	}
 }
 
-func (s Service) call(ctx context.Context, path string, response interface{}) error {
+// get decodes response of an authorized GET request, unauthorized status
+// is returned without an error so the caller can refresh tokens.
+func (s *Service) get(ctx context.Context, path, accessToken string, response interface{}) (int, error) {
 	req, err := s.request(ctx, "GET", path, nil)
 	if err != nil {
-		return err
+		return 0, err
 	}
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %v", accessToken))
 
-	userId := ctx.Value("user").(authorization.User).ID
-	var userTokens StravaUserTokens
-	query := s.DB.First(&userTokens, "user_id = ?", userId)
-	if query.RecordNotFound() {
-		return NoTokenError
-	} else if query.Error != nil {
-		return query.Error
-	}
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %v", userTokens.AccessToken))
-
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := s.do(req)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode == http.StatusUnauthorized {
-		err := s.refreshToken(ctx, userTokens)
-		if err != nil {
-			return errors.Wrap(err, "refresh token")
-		} else {
-			return s.call(ctx, path, response)
-		}
+		return resp.StatusCode, nil
 	} else if resp.StatusCode/100 != 2 {
-		return errors.Errorf("strava error: %v", resp.Status)
+		return resp.StatusCode, errors.Errorf("strava error: %v", resp.Status)
 	}
 
 	dec := json.NewDecoder(resp.Body)
 	err = dec.Decode(response)
 	if err != nil {
-		return err
+		return resp.StatusCode, err
 	}
 
-	return nil
+	return resp.StatusCode, nil
 }
 
-func (s Service) RecentActivities(ctx context.Context) ([]Activity, error) {
+func (s *Service) RecentActivities(ctx context.Context) ([]Activity, error) {
+	activities, _, err := s.Activities(ctx, ActivitiesOptions{})
+	return activities, err
+}
+
+// DefaultPerPage is the strava default page size of activity lists.
+const DefaultPerPage = 30
+
+type ActivitiesOptions struct {
+	// Before and After limit activity start time, zero values are ignored
+	Before time.Time
+	After  time.Time
+
+	// Page starts with 1
+	Page    int
+	PerPage int
+
+	// Type keeps only activities of this type, strava api can not filter by
+	// type so pages can have less than PerPage activities
+	Type string
+}
+
+// Activities returns a page of activities of current user, more is true when
+// there could be activities on the next page.
+func (s *Service) Activities(ctx context.Context, options ActivitiesOptions) (activities []Activity, more bool, err error) {
+	if options.PerPage <= 0 {
+		options.PerPage = DefaultPerPage
+	}
+
+	query := url.Values{}
+	if !options.Before.IsZero() {
+		query.Set("before", strconv.FormatInt(options.Before.Unix(), 10))
+	}
+	if !options.After.IsZero() {
+		query.Set("after", strconv.FormatInt(options.After.Unix(), 10))
+	}
+	if options.Page > 0 {
+		query.Set("page", strconv.Itoa(options.Page))
+	}
+	query.Set("per_page", strconv.Itoa(options.PerPage))
+
 	var response []Activity
-	err := s.call(ctx, "v3/athlete/activities", &response)
+	err = s.call(ctx, "v3/athlete/activities?"+query.Encode(), &response)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
-	return response, nil
+	more = len(response) >= options.PerPage
+
+	if options.Type == "" {
+		return response, more, nil
+	}
+	for _, activity := range response {
+		if activity.Type == options.Type {
+			activities = append(activities, activity)
+		}
+	}
+	return activities, more, nil
 }
 
-func (s Service) Activity(ctx context.Context, id int) (Activity, error) {
+func (s *Service) Activity(ctx context.Context, id int) (Activity, error) {
 	var response Activity
 	err := s.call(ctx, fmt.Sprintf("v3/activities/%v", id), &response)
 	if err != nil {
@@ -140,17 +254,74 @@ func (s Service) Activity(ctx context.Context, id int) (Activity, error) {
 	return response, nil
 }
 
+// PhotoSize is the requested size of the longer photo edge in pixels.
+const PhotoSize = 2048
+
+func (s *Service) ActivityPhotos(ctx context.Context, id int) ([]Photo, error) {
+	var response []Photo
+	err := s.call(ctx, fmt.Sprintf("v3/activities/%v/photos?size=%d&photo_sources=true", id, PhotoSize), &response)
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// DownloadPhoto returns content of the largest available photo size.
+func (s *Service) DownloadPhoto(ctx context.Context, photo Photo) ([]byte, error) {
+	photoURL := ""
+	bestSize := -1
+	for sizeStr, u := range photo.URLs {
+		size, _ := strconv.Atoi(sizeStr)
+		if size > bestSize {
+			photoURL = u
+			bestSize = size
+		}
+	}
+	if photoURL == "" {
+		return nil, errors.Errorf("photo %v has no urls", photo.UniqueID)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", photoURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// photos are served from a cdn, they do not count towards api rate limit
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return nil, errors.Errorf("photo download error: %v", resp.Status)
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
+
 type Point struct {
 	TimeOffset int
 	Latitude   float64
 	Longitude  float64
 	Altitude   float64
 	Distance   float64
+
+	// HasAltitude is false when the altitude stream is missing or null
+	HasAltitude bool
+
+	// Optional streams, zero when not recorded
+	HeartRate float64
+	Cadence   float64
+	Watts     float64
+
+	// Temperature is set only with HasTemperature, 0 °C is a valid reading
+	Temperature    float64
+	HasTemperature bool
 }
 
-func (s Service) ActivityPoints(ctx context.Context, id int) ([]Point, error) {
+func (s *Service) ActivityPoints(ctx context.Context, id int) ([]Point, error) {
 	var streams []Stream
-	err := s.call(ctx, fmt.Sprintf("v3/activities/%v/streams?keys=time,distance,latlng,altitude", id), &streams)
+	err := s.call(ctx, fmt.Sprintf("v3/activities/%v/streams?keys=time,distance,latlng,altitude,heartrate,cadence,watts,temp", id), &streams)
 	if err != nil {
 		return nil, err
 	}
@@ -210,6 +381,37 @@ func (s Service) ActivityPoints(ctx context.Context, id int) ([]Point, error) {
 				points[i].Longitude = data[i][1]
 			}
 		case "altitude":
+			var data []*float64
+			err := json.Unmarshal(stream.Data, &data)
+			if err != nil {
+				return nil, err
+			}
+			if err := ensurePoints(len(data)); err != nil {
+				return nil, err
+			}
+			for i := range data {
+				if data[i] != nil {
+					points[i].Altitude = *data[i]
+					points[i].HasAltitude = true
+				}
+			}
+		case "temp":
+			var data []*float64
+			err := json.Unmarshal(stream.Data, &data)
+			if err != nil {
+				return nil, err
+			}
+			if err := ensurePoints(len(data)); err != nil {
+				return nil, err
+			}
+			for i := range data {
+				if data[i] != nil {
+					points[i].Temperature = *data[i]
+					points[i].HasTemperature = true
+				}
+			}
+		case "heartrate", "cadence", "watts":
+			// null values are left at zero
 			var data []float64
 			err := json.Unmarshal(stream.Data, &data)
 			if err != nil {
@@ -219,7 +421,14 @@ func (s Service) ActivityPoints(ctx context.Context, id int) ([]Point, error) {
 				return nil, err
 			}
 			for i := range data {
-				points[i].Altitude = data[i]
+				switch stream.Type {
+				case "heartrate":
+					points[i].HeartRate = data[i]
+				case "cadence":
+					points[i].Cadence = data[i]
+				case "watts":
+					points[i].Watts = data[i]
+				}
 			}
 		}
 	}
@@ -0,0 +1,562 @@
+package strava
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"github.com/matematik7/gongo/authorization"
+	"github.com/pkg/errors"
+)
+
+// fakeStrava is an in-process strava api serving a single activity with
+// streams, it issues new tokens on every refresh.
+type fakeStrava struct {
+	*httptest.Server
+
+	mu           sync.Mutex
+	accessToken  string
+	refreshToken string
+	refreshes    int
+	requests     map[string]int
+
+	// activitiesQuery is the query of last activities request
+	activitiesQuery url.Values
+
+	// rateLimitUsage is returned in X-RateLimit-Usage header
+	rateLimitUsage string
+	// unauthorized rejects all access tokens
+	unauthorized bool
+}
+
+func newFakeStrava(t *testing.T) *fakeStrava {
+	f := &fakeStrava{
+		accessToken:    "access",
+		refreshToken:   "refresh",
+		requests:       map[string]int{},
+		rateLimitUsage: "1,1",
+	}
+
+	authorized := func(handler http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			f.mu.Lock()
+			ok := !f.unauthorized && r.Header.Get("Authorization") == "Bearer "+f.accessToken
+			f.mu.Unlock()
+			if !ok {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			handler(w, r)
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v3/oauth/token", f.tokenHandler)
+	mux.HandleFunc("/v3/oauth/deauthorize", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if r.FormValue("access_token") != f.accessToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		f.accessToken = ""
+		fmt.Fprint(w, `{"access_token": ""}`)
+	})
+	mux.HandleFunc("/v3/athlete/activities", authorized(func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		f.activitiesQuery = r.URL.Query()
+		f.mu.Unlock()
+		fmt.Fprint(w, `[
+			{"id": 42, "name": "Morning Hike", "distance": 1500, "type": "Hike", "start_date": "2021-09-08T08:00:00Z"},
+			{"id": 43, "name": "Evening Ride", "distance": 20000, "type": "Ride", "start_date": "2021-09-07T18:00:00Z"}
+		]`)
+	}))
+	mux.HandleFunc("/v3/activities/42", authorized(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"id": 42, "name": "Morning Hike", "distance": 1500, "moving_time": 1200, "elapsed_time": 1300, "start_date": "2021-09-08T08:00:00Z"}`)
+	}))
+	mux.HandleFunc("/v3/activities/42/streams", authorized(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[
+			{"type": "time", "resolution": "high", "data": [0, 10]},
+			{"type": "latlng", "resolution": "high", "data": [[46.0, 14.5], [46.001, 14.501]]},
+			{"type": "distance", "resolution": "high", "data": [0, 130.5]},
+			{"type": "altitude", "resolution": "high", "data": [300, 310]},
+			{"type": "heartrate", "resolution": "high", "data": [95, 120]},
+			{"type": "temp", "resolution": "high", "data": [18, null]}
+		]`)
+	}))
+	mux.HandleFunc("/v3/activities/42/photos", authorized(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("size") != "2048" {
+			t.Errorf("expected photo size 2048, got %q", r.URL.Query().Get("size"))
+		}
+		fmt.Fprintf(w, `[{"unique_id": "abc", "caption": "Summit", "source": 1, "urls": {"2048": "http://%s/photos/abc.jpg"}}]`, r.Host)
+	}))
+	mux.HandleFunc("/photos/abc.jpg", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "jpeg")
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected request to %v", r.URL)
+		w.WriteHeader(http.StatusNotFound)
+	})
+
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		f.requests[r.URL.Path]++
+		w.Header().Set("X-RateLimit-Limit", "600,30000")
+		w.Header().Set("X-RateLimit-Usage", f.rateLimitUsage)
+		f.mu.Unlock()
+
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(f.Close)
+
+	return f
+}
+
+func (f *fakeStrava) tokenHandler(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.FormValue("client_id") != "client" || r.FormValue("client_secret") != "secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	athlete := ""
+	switch r.FormValue("grant_type") {
+	case "refresh_token":
+		if r.FormValue("refresh_token") != f.refreshToken {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		// give concurrent requests time to pile up
+		time.Sleep(10 * time.Millisecond)
+	case "authorization_code":
+		if r.FormValue("code") != "code" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		athlete = `, "athlete": {"id": 1234}`
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	f.refreshes++
+	f.accessToken = fmt.Sprintf("access-%d", f.refreshes)
+	f.refreshToken = fmt.Sprintf("refresh-%d", f.refreshes)
+	fmt.Fprintf(w, `{"access_token": %q, "refresh_token": %q, "expires_at": %d%s}`,
+		f.accessToken, f.refreshToken, time.Now().Add(6*time.Hour).Unix(), athlete)
+}
+
+func (f *fakeStrava) requestCount(path string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests[path]
+}
+
+// newTestService returns service with a sqlite database, user and its tokens
+// expiring at expiresAt.
+func newTestService(t *testing.T, baseURL string, expiresAt time.Time) (*Service, context.Context) {
+	DB, err := gorm.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// concurrent refreshes must share the database, a new connection would
+	// open an empty one
+	DB.DB().SetMaxOpenConns(1)
+	t.Cleanup(func() { DB.Close() })
+
+	err = DB.AutoMigrate(
+		&authorization.User{},
+		&authorization.Group{},
+		&authorization.Permission{},
+		&StravaUserTokens{},
+		&StravaSubscription{},
+	).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := authorization.User{Name: "Test"}
+	if err := DB.Save(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	tokens := StravaUserTokens{
+		UserID:       user.ID,
+		AthleteID:    1234,
+		AccessToken:  "access",
+		RefreshToken: "refresh",
+		ExpiresAt:    expiresAt,
+	}
+	if err := DB.Save(&tokens).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Service{
+		DB:           DB,
+		Client:       &http.Client{Timeout: time.Second},
+		BaseURL:      baseURL + "/",
+		ClientID:     "client",
+		ClientSecret: "secret",
+		VerifyToken:  "verify",
+	}
+
+	return s, context.WithValue(context.Background(), "user", user)
+}
+
+func storedTokens(t *testing.T, s *Service) StravaUserTokens {
+	var tokens StravaUserTokens
+	if err := s.DB.First(&tokens).Error; err != nil {
+		t.Fatal(err)
+	}
+	return tokens
+}
+
+func TestRecentActivities(t *testing.T) {
+	f := newFakeStrava(t)
+	s, ctx := newTestService(t, f.URL, time.Now().Add(time.Hour))
+
+	activities, err := s.RecentActivities(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(activities) != 2 || activities[0].ID != 42 || activities[0].Name != "Morning Hike" {
+		t.Errorf("unexpected activities %+v", activities)
+	}
+	if activities[1].Type != "Ride" {
+		t.Errorf("expected type Ride, got %q", activities[1].Type)
+	}
+}
+
+func TestActivitiesOptions(t *testing.T) {
+	f := newFakeStrava(t)
+	s, ctx := newTestService(t, f.URL, time.Now().Add(time.Hour))
+
+	activities, more, err := s.Activities(ctx, ActivitiesOptions{
+		Before:  time.Date(2021, 9, 10, 0, 0, 0, 0, time.UTC),
+		After:   time.Date(2021, 9, 1, 0, 0, 0, 0, time.UTC),
+		Page:    2,
+		PerPage: 2,
+		Type:    "Ride",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(activities) != 1 || activities[0].ID != 43 {
+		t.Errorf("expected only ride, got %+v", activities)
+	}
+	if !more {
+		t.Errorf("expected more activities for full page")
+	}
+
+	expected := url.Values{
+		"before":   {"1631232000"},
+		"after":    {"1630454400"},
+		"page":     {"2"},
+		"per_page": {"2"},
+	}
+	if f.activitiesQuery.Encode() != expected.Encode() {
+		t.Errorf("expected query %v, got %v", expected.Encode(), f.activitiesQuery.Encode())
+	}
+}
+
+func TestActivityPoints(t *testing.T) {
+	f := newFakeStrava(t)
+	s, ctx := newTestService(t, f.URL, time.Now().Add(time.Hour))
+
+	points, err := s.ActivityPoints(ctx, 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Point{
+		{TimeOffset: 0, Latitude: 46.0, Longitude: 14.5, Altitude: 300, Distance: 0, HasAltitude: true, HeartRate: 95, Temperature: 18, HasTemperature: true},
+		{TimeOffset: 10, Latitude: 46.001, Longitude: 14.501, Altitude: 310, Distance: 130.5, HasAltitude: true, HeartRate: 120},
+	}
+	if len(points) != len(expected) {
+		t.Fatalf("expected %d points, got %d", len(expected), len(points))
+	}
+	for i := range expected {
+		if points[i] != expected[i] {
+			t.Errorf("point %d: expected %+v, got %+v", i, expected[i], points[i])
+		}
+	}
+}
+
+func TestActivityPhotos(t *testing.T) {
+	f := newFakeStrava(t)
+	s, ctx := newTestService(t, f.URL, time.Now().Add(time.Hour))
+
+	photos, err := s.ActivityPhotos(ctx, 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(photos) != 1 || photos[0].UniqueID != "abc" || photos[0].Caption != "Summit" {
+		t.Fatalf("unexpected photos %+v", photos)
+	}
+
+	data, err := s.DownloadPhoto(ctx, photos[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "jpeg" {
+		t.Errorf("unexpected photo content %q", data)
+	}
+}
+
+func TestNoTokens(t *testing.T) {
+	f := newFakeStrava(t)
+	s, _ := newTestService(t, f.URL, time.Now().Add(time.Hour))
+
+	ctx := context.WithValue(context.Background(), "user", authorization.User{Name: "Other"})
+	if _, err := s.RecentActivities(ctx); err != NoTokenError {
+		t.Errorf("expected NoTokenError, got %v", err)
+	}
+}
+
+func TestRefreshExpiredToken(t *testing.T) {
+	f := newFakeStrava(t)
+	s, ctx := newTestService(t, f.URL, time.Now().Add(time.Minute))
+
+	if _, err := s.Activity(ctx, 42); err != nil {
+		t.Fatal(err)
+	}
+
+	if f.requestCount("/v3/activities/42") != 1 {
+		t.Errorf("expected token to be refreshed before request, got %d requests", f.requestCount("/v3/activities/42"))
+	}
+	tokens := storedTokens(t, s)
+	if tokens.AccessToken != "access-1" || tokens.RefreshToken != "refresh-1" {
+		t.Errorf("refreshed tokens not stored, got %+v", tokens)
+	}
+	if time.Until(tokens.ExpiresAt) < 5*time.Hour {
+		t.Errorf("expected expiry in 6 hours, got %v", tokens.ExpiresAt)
+	}
+}
+
+func TestRefreshOnUnauthorized(t *testing.T) {
+	f := newFakeStrava(t)
+	s, ctx := newTestService(t, f.URL, time.Now().Add(time.Hour))
+	f.accessToken = "revoked"
+
+	if _, err := s.Activity(ctx, 42); err != nil {
+		t.Fatal(err)
+	}
+
+	if f.refreshes != 1 {
+		t.Errorf("expected 1 refresh, got %d", f.refreshes)
+	}
+	if f.requestCount("/v3/activities/42") != 2 {
+		t.Errorf("expected 2 requests, got %d", f.requestCount("/v3/activities/42"))
+	}
+}
+
+func TestRetryLimit(t *testing.T) {
+	f := newFakeStrava(t)
+	s, ctx := newTestService(t, f.URL, time.Now().Add(time.Hour))
+	f.unauthorized = true
+
+	if _, err := s.Activity(ctx, 42); err == nil {
+		t.Fatal("expected error when strava rejects all tokens")
+	}
+
+	if f.requestCount("/v3/activities/42") != maxAttempts {
+		t.Errorf("expected %d requests, got %d", maxAttempts, f.requestCount("/v3/activities/42"))
+	}
+}
+
+func TestConcurrentRefresh(t *testing.T) {
+	f := newFakeStrava(t)
+	s, ctx := newTestService(t, f.URL, time.Now().Add(-time.Hour))
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := s.Activity(ctx, 42)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if f.refreshes != 1 {
+		t.Errorf("expected 1 refresh, got %d", f.refreshes)
+	}
+}
+
+func TestRefreshCanceledCaller(t *testing.T) {
+	f := newFakeStrava(t)
+	s, ctx := newTestService(t, f.URL, time.Now().Add(-time.Hour))
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := s.Activity(canceled, 42); errors.Cause(err) != context.Canceled {
+		t.Fatalf("expected context canceled, got %v", err)
+	}
+
+	// refresh started by the canceled caller is finished and shared
+	if _, err := s.Activity(ctx, 42); err != nil {
+		t.Fatal(err)
+	}
+	if f.refreshes != 1 {
+		t.Errorf("expected 1 refresh, got %d", f.refreshes)
+	}
+	if tokens := storedTokens(t, s); tokens.AccessToken != "access-1" {
+		t.Errorf("expected refreshed tokens to be stored, got %+v", tokens)
+	}
+}
+
+func TestRateLimited(t *testing.T) {
+	f := newFakeStrava(t)
+	s, ctx := newTestService(t, f.URL, time.Now().Add(time.Hour))
+	f.rateLimitUsage = "600,700"
+
+	if _, err := s.Activity(ctx, 42); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := s.Activity(ctx, 42)
+	rateLimitedErr, ok := errors.Cause(err).(*RateLimitedError)
+	if !ok {
+		t.Fatalf("expected RateLimitedError, got %v", err)
+	}
+	if !rateLimitedErr.Until.After(time.Now()) || rateLimitedErr.Until.Sub(time.Now()) > 15*time.Minute {
+		t.Errorf("expected back off until end of 15 minute window, got %v", rateLimitedErr.Until)
+	}
+	if f.requestCount("/v3/activities/42") != 1 {
+		t.Errorf("expected no requests while rate limited, got %d", f.requestCount("/v3/activities/42"))
+	}
+}
+
+func TestTooManyRequests(t *testing.T) {
+	s := &Service{Client: http.DefaultClient}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	req, err := http.NewRequest("GET", server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.do(req); err == nil {
+		t.Fatal("expected error")
+	} else if _, ok := err.(*RateLimitedError); !ok {
+		t.Fatalf("expected RateLimitedError, got %v", err)
+	}
+}
+
+func TestParseRateLimit(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected [2]int
+		ok       bool
+	}{
+		{"600,30000", [2]int{600, 30000}, true},
+		{"12, 345", [2]int{12, 345}, true},
+		{"", [2]int{}, false},
+		{"600", [2]int{}, false},
+		{"a,b", [2]int{}, false},
+	}
+
+	for _, test := range tests {
+		values, ok := parseRateLimit(test.value)
+		if ok != test.ok || values != test.expected {
+			t.Errorf("%q: expected %v %v, got %v %v", test.value, test.expected, test.ok, values, ok)
+		}
+	}
+}
+
+func TestConnectDisconnect(t *testing.T) {
+	f := newFakeStrava(t)
+	s, ctx := newTestService(t, f.URL, time.Now().Add(time.Hour))
+	user := ctx.Value("user").(authorization.User)
+
+	if err := s.DB.Unscoped().Delete(&StravaUserTokens{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Connect(ctx, user.ID, "code"); err != nil {
+		t.Fatal(err)
+	}
+	tokens := storedTokens(t, s)
+	if tokens.AthleteID != 1234 || tokens.AccessToken != "access-1" {
+		t.Errorf("unexpected tokens %+v", tokens)
+	}
+
+	if err := s.Disconnect(ctx, user.ID); err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	if err := s.DB.Unscoped().Model(&StravaUserTokens{}).Count(&count).Error; err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Errorf("expected tokens to be deleted, got %d rows", count)
+	}
+	if f.requestCount("/v3/oauth/deauthorize") != 1 {
+		t.Errorf("expected deauthorize request")
+	}
+}
+
+func TestDisconnectMethod(t *testing.T) {
+	s, _ := newTestService(t, "http://localhost", time.Now().Add(time.Hour))
+
+	w := httptest.NewRecorder()
+	s.ServeMux().ServeHTTP(w, httptest.NewRequest("GET", "/disconnect", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected status %d for GET, got %d", http.StatusMethodNotAllowed, w.Code)
+	}
+	// tokens are kept
+	storedTokens(t, s)
+}
+
+func TestSubscribeForm(t *testing.T) {
+	var form map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		form = map[string]string{}
+		for key := range r.PostForm {
+			form[key] = r.PostForm.Get(key)
+		}
+		json.NewEncoder(w).Encode(Subscription{ID: 7})
+	}))
+	defer server.Close()
+
+	s, _ := newTestService(t, server.URL, time.Now().Add(time.Hour))
+	subscription, err := s.Subscribe(context.Background(), "https://example.com/strava/webhook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subscription.ID != 7 {
+		t.Errorf("expected subscription 7, got %d", subscription.ID)
+	}
+	if !strings.HasSuffix(form["callback_url"], "/strava/webhook") || form["verify_token"] != "verify" || form["client_id"] != "client" {
+		t.Errorf("unexpected form %v", form)
+	}
+
+	var stored StravaSubscription
+	if err := s.DB.First(&stored).Error; err != nil {
+		t.Fatal(err)
+	}
+	if stored.SubscriptionID != 7 {
+		t.Errorf("expected stored subscription 7, got %d", stored.SubscriptionID)
+	}
+}
@@ -0,0 +1,91 @@
+package strava
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// expiryMargin is how long before expiry access tokens are refreshed.
+const expiryMargin = 5 * time.Minute
+
+// userTokens returns tokens of user, refreshing them when they are about to
+// expire.
+func (s *Service) userTokens(ctx context.Context, userID uint) (StravaUserTokens, error) {
+	var userTokens StravaUserTokens
+	query := s.DB.First(&userTokens, "user_id = ?", userID)
+	if query.RecordNotFound() {
+		return userTokens, NoTokenError
+	} else if query.Error != nil {
+		return userTokens, errors.Wrap(query.Error, "could not get user tokens")
+	}
+
+	if time.Until(userTokens.ExpiresAt) < expiryMargin {
+		return s.refresh(ctx, userID, userTokens.AccessToken)
+	}
+
+	return userTokens, nil
+}
+
+// refresh refreshes tokens of user unless they were already refreshed after
+// staleAccessToken was read. Concurrent refreshes of the same user are merged
+// so strava refresh token is used only once, the refresh is not canceled when
+// ctx of the caller that started it is done.
+func (s *Service) refresh(ctx context.Context, userID uint, staleAccessToken string) (StravaUserTokens, error) {
+	refreshed := s.refreshGroup.DoChan(strconv.FormatUint(uint64(userID), 10), func() (interface{}, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
+		defer cancel()
+
+		var userTokens StravaUserTokens
+		query := s.DB.First(&userTokens, "user_id = ?", userID)
+		if query.RecordNotFound() {
+			return nil, NoTokenError
+		} else if query.Error != nil {
+			return nil, errors.Wrap(query.Error, "could not get user tokens")
+		}
+
+		if userTokens.AccessToken != staleAccessToken && time.Until(userTokens.ExpiresAt) >= expiryMargin {
+			return userTokens, nil
+		}
+
+		if err := s.refreshToken(ctx, &userTokens); err != nil {
+			return nil, errors.Wrap(err, "refresh token")
+		}
+		return userTokens, nil
+	})
+
+	select {
+	case result := <-refreshed:
+		if result.Err != nil {
+			return StravaUserTokens{}, result.Err
+		}
+		return result.Val.(StravaUserTokens), nil
+	case <-ctx.Done():
+		return StravaUserTokens{}, ctx.Err()
+	}
+}
+
+func (s *Service) refreshToken(ctx context.Context, userTokens *StravaUserTokens) error {
+	form := url.Values{}
+	form.Add("grant_type", "refresh_token")
+	form.Add("refresh_token", userTokens.RefreshToken)
+
+	tokens, err := s.token(ctx, form)
+	if err != nil {
+		return err
+	}
+
+	userTokens.AccessToken = tokens.AccessToken
+	userTokens.RefreshToken = tokens.RefreshToken
+	userTokens.ExpiresAt = time.Unix(tokens.ExpiresAt, 0)
+
+	err = s.DB.Save(userTokens).Error
+	if err != nil {
+		return errors.Wrap(err, "user token db write")
+	}
+
+	return nil
+}
@@ -0,0 +1,139 @@
+package strava
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/matematik7/gongo/authorization"
+	"github.com/pkg/errors"
+)
+
+// WebhookHandler handles strava push subscription validation (GET) and
+// event callbacks (POST).
+func (s *Service) WebhookHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		query := r.URL.Query()
+		if query.Get("hub.mode") != "subscribe" || s.VerifyToken == "" || query.Get("hub.verify_token") != s.VerifyToken {
+			http.Error(w, "invalid verify token", http.StatusForbidden)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"hub.challenge": query.Get("hub.challenge"),
+		})
+	case "POST":
+		event := WebhookEvent{}
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			http.Error(w, "invalid event", http.StatusBadRequest)
+			return
+		}
+
+		var count int
+		query := s.DB.Model(&StravaSubscription{}).Where("subscription_id = ?", event.SubscriptionID).Count(&count)
+		if query.Error != nil {
+			s.log.Error(errors.Wrap(query.Error, "could not check strava subscription"))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if count == 0 {
+			http.Error(w, "unknown subscription", http.StatusForbidden)
+			return
+		}
+
+		// strava expects a response within two seconds, fetching the
+		// activity and creating the entry can take longer
+		go func() {
+			if err := s.HandleEvent(context.Background(), event); err != nil {
+				s.log.Error(errors.Wrapf(err, "could not handle strava event for activity %d", event.ObjectID))
+			}
+		}()
+
+		w.WriteHeader(http.StatusOK)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// HandleEvent calls OnActivityCreate callbacks for created activities of
+// athletes with stored tokens and deletes tokens of athletes that revoked
+// access, other events are ignored.
+func (s *Service) HandleEvent(ctx context.Context, event WebhookEvent) error {
+	if event.ObjectType == "athlete" && event.Updates["authorized"] == "false" {
+		query := s.DB.Unscoped().Where("athlete_id = ?", event.OwnerID).Delete(&StravaUserTokens{})
+		if query.Error != nil {
+			return errors.Wrap(query.Error, "could not delete user tokens")
+		}
+		return nil
+	}
+
+	if event.ObjectType != "activity" || event.AspectType != "create" {
+		return nil
+	}
+
+	var userTokens StravaUserTokens
+	query := s.DB.First(&userTokens, "athlete_id = ?", event.OwnerID)
+	if query.RecordNotFound() {
+		return nil
+	} else if query.Error != nil {
+		return errors.Wrap(query.Error, "could not get user tokens")
+	}
+
+	var user authorization.User
+	query = s.DB.
+		Preload("Permissions").
+		Preload("Groups.Permissions").
+		First(&user, userTokens.UserID)
+	if query.Error != nil {
+		return errors.Wrap(query.Error, "could not get user")
+	}
+
+	ctx = context.WithValue(ctx, "user", user)
+	ctx = context.WithValue(ctx, "activityID", event.ObjectID)
+	return s.OnActivityCreate.Call(ctx)
+}
+
+// Subscribe creates a push subscription that delivers events to callbackURL
+// and stores it, so WebhookHandler accepts its events.
+func (s *Service) Subscribe(ctx context.Context, callbackURL string) (Subscription, error) {
+	subscription := Subscription{}
+
+	if s.VerifyToken == "" {
+		return subscription, errors.New("strava_verify_token is not set")
+	}
+
+	form := url.Values{}
+	form.Add("client_id", s.ClientID)
+	form.Add("client_secret", s.ClientSecret)
+	form.Add("callback_url", callbackURL)
+	form.Add("verify_token", s.VerifyToken)
+
+	req, err := s.request(ctx, "POST", "v3/push_subscriptions", strings.NewReader(form.Encode()))
+	if err != nil {
+		return subscription, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := s.do(req)
+	if err != nil {
+		return subscription, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return subscription, errors.Errorf("strava error: %v", resp.Status)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&subscription); err != nil {
+		return subscription, err
+	}
+
+	if err := s.DB.Save(&StravaSubscription{SubscriptionID: subscription.ID}).Error; err != nil {
+		return subscription, errors.Wrap(err, "could not save subscription")
+	}
+
+	return subscription, nil
+}
@@ -0,0 +1,139 @@
+package strava
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebhookValidation(t *testing.T) {
+	s, _ := newTestService(t, "http://localhost", time.Now().Add(time.Hour))
+
+	tests := []struct {
+		query  string
+		status int
+	}{
+		{"hub.mode=subscribe&hub.verify_token=verify&hub.challenge=abc", http.StatusOK},
+		{"hub.mode=subscribe&hub.verify_token=wrong&hub.challenge=abc", http.StatusForbidden},
+		{"hub.verify_token=verify&hub.challenge=abc", http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		s.WebhookHandler(w, httptest.NewRequest("GET", "/strava/webhook?"+test.query, nil))
+		if w.Code != test.status {
+			t.Errorf("%s: expected status %d, got %d", test.query, test.status, w.Code)
+			continue
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+
+		response := map[string]string{}
+		if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		if response["hub.challenge"] != "abc" {
+			t.Errorf("expected challenge abc, got %q", response["hub.challenge"])
+		}
+	}
+}
+
+func TestWebhookSubscription(t *testing.T) {
+	s, _ := newTestService(t, "http://localhost", time.Now().Add(time.Hour))
+	if err := s.DB.Save(&StravaSubscription{SubscriptionID: 7}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		body   string
+		status int
+	}{
+		{`{"object_type": "activity", "aspect_type": "update", "subscription_id": 7}`, http.StatusOK},
+		{`{"object_type": "activity", "aspect_type": "update", "subscription_id": 8}`, http.StatusForbidden},
+		{`{"object_type": "activity", "aspect_type": "update"}`, http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		s.WebhookHandler(w, httptest.NewRequest("POST", "/strava/webhook", strings.NewReader(test.body)))
+		if w.Code != test.status {
+			t.Errorf("%s: expected status %d, got %d", test.body, test.status, w.Code)
+		}
+	}
+}
+
+func TestHandleEvent(t *testing.T) {
+	f := newFakeStrava(t)
+	s, _ := newTestService(t, f.URL, time.Now().Add(time.Hour))
+
+	var created []Activity
+	var points []Point
+	s.OnActivityCreate.Add(func(ctx context.Context) error {
+		activityID := ctx.Value("activityID").(int)
+		activity, err := s.Activity(ctx, activityID)
+		if err != nil {
+			return err
+		}
+		points, err = s.ActivityPoints(ctx, activityID)
+		if err != nil {
+			return err
+		}
+		created = append(created, activity)
+		return nil
+	})
+
+	events := []WebhookEvent{
+		{ObjectType: "activity", AspectType: "update", ObjectID: 42, OwnerID: 1234},
+		{ObjectType: "athlete", AspectType: "create", ObjectID: 1234, OwnerID: 1234},
+		{ObjectType: "activity", AspectType: "create", ObjectID: 42, OwnerID: 999},
+		{ObjectType: "activity", AspectType: "create", ObjectID: 42, OwnerID: 1234},
+	}
+	for _, event := range events {
+		if err := s.HandleEvent(context.Background(), event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(created) != 1 {
+		t.Fatalf("expected 1 created activity, got %d", len(created))
+	}
+	if created[0].Name != "Morning Hike" {
+		t.Errorf("expected name Morning Hike, got %q", created[0].Name)
+	}
+	if len(points) != 2 {
+		t.Fatalf("expected 2 points, got %d", len(points))
+	}
+	if points[1].Latitude != 46.001 || points[1].Distance != 130.5 || points[1].Altitude != 310 {
+		t.Errorf("unexpected point %+v", points[1])
+	}
+}
+
+func TestHandleDeauthorizeEvent(t *testing.T) {
+	s, _ := newTestService(t, "http://localhost", time.Now().Add(time.Hour))
+
+	event := WebhookEvent{
+		ObjectType: "athlete",
+		AspectType: "update",
+		ObjectID:   1234,
+		OwnerID:    1234,
+		Updates: map[string]interface{}{
+			"authorized": "false",
+		},
+	}
+	if err := s.HandleEvent(context.Background(), event); err != nil {
+		t.Fatal(err)
+	}
+
+	var count int
+	if err := s.DB.Unscoped().Model(&StravaUserTokens{}).Count(&count).Error; err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Errorf("expected tokens to be deleted, got %d rows", count)
+	}
+}
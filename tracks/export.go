@@ -0,0 +1,248 @@
+package tracks
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/matematik7/camino-go/diary/models"
+)
+
+// Waypoint is a named location exported alongside tracks.
+type Waypoint struct {
+	Name        string
+	Description string
+	Latitude    float64
+	Longitude   float64
+}
+
+// Track is a named series of data entries for export.
+type Track struct {
+	Name    string
+	Entries []models.DataEntry
+}
+
+type gpxExport struct {
+	XMLName   xml.Name         `xml:"gpx"`
+	Xmlns     string           `xml:"xmlns,attr"`
+	Version   string           `xml:"version,attr"`
+	Creator   string           `xml:"creator,attr"`
+	Name      string           `xml:"metadata>name,omitempty"`
+	Waypoints []gpxExportPoint `xml:"wpt"`
+	Tracks    []gpxExportTrack `xml:"trk"`
+}
+
+type gpxExportTrack struct {
+	Name   string           `xml:"name,omitempty"`
+	Points []gpxExportPoint `xml:"trkseg>trkpt"`
+}
+
+type gpxExportPoint struct {
+	Latitude    float64  `xml:"lat,attr"`
+	Longitude   float64  `xml:"lon,attr"`
+	Elevation   *float64 `xml:"ele,omitempty"`
+	Time        string   `xml:"time,omitempty"`
+	Name        string   `xml:"name,omitempty"`
+	Description string   `xml:"desc,omitempty"`
+}
+
+// WriteGPX writes waypoints and tracks as a GPX 1.1 document.
+func WriteGPX(w io.Writer, name string, waypoints []Waypoint, tracks []Track) error {
+	gpx := gpxExport{
+		Xmlns:   "http://www.topografix.com/GPX/1/1",
+		Version: "1.1",
+		Creator: "camino-go",
+		Name:    name,
+	}
+
+	for _, waypoint := range waypoints {
+		gpx.Waypoints = append(gpx.Waypoints, gpxExportPoint{
+			Latitude:    waypoint.Latitude,
+			Longitude:   waypoint.Longitude,
+			Name:        waypoint.Name,
+			Description: waypoint.Description,
+		})
+	}
+
+	for _, track := range tracks {
+		if len(track.Entries) == 0 {
+			continue
+		}
+
+		gpxTrack := gpxExportTrack{
+			Name:   track.Name,
+			Points: make([]gpxExportPoint, 0, len(track.Entries)),
+		}
+		for _, entry := range track.Entries {
+			p := gpxExportPoint{
+				Latitude:  float64(entry.Latitude),
+				Longitude: float64(entry.Longitude),
+			}
+			if entry.Elevation != nil {
+				elevation := float64(*entry.Elevation)
+				p.Elevation = &elevation
+			}
+			if !entry.Time.IsZero() {
+				p.Time = entry.Time.UTC().Format(time.RFC3339)
+			}
+			gpxTrack.Points = append(gpxTrack.Points, p)
+		}
+		gpx.Tracks = append(gpx.Tracks, gpxTrack)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	return xml.NewEncoder(w).Encode(gpx)
+}
+
+type kmlExport struct {
+	XMLName  xml.Name `xml:"kml"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Document struct {
+		Name       string               `xml:"name,omitempty"`
+		Placemarks []kmlExportPlacemark `xml:"Placemark"`
+	} `xml:"Document"`
+}
+
+type kmlExportPlacemark struct {
+	Name        string               `xml:"name,omitempty"`
+	Description string               `xml:"description,omitempty"`
+	Point       *kmlExportPoint      `xml:"Point"`
+	LineString  *kmlExportLineString `xml:"LineString"`
+}
+
+type kmlExportPoint struct {
+	Coordinates string `xml:"coordinates"`
+}
+
+type kmlExportLineString struct {
+	Tessellate  int    `xml:"tessellate"`
+	Coordinates string `xml:"coordinates"`
+}
+
+// WriteKML writes waypoints and tracks as a KML document.
+func WriteKML(w io.Writer, name string, waypoints []Waypoint, tracks []Track) error {
+	kml := kmlExport{
+		Xmlns: "http://www.opengis.net/kml/2.2",
+	}
+	kml.Document.Name = name
+
+	for _, waypoint := range waypoints {
+		kml.Document.Placemarks = append(kml.Document.Placemarks, kmlExportPlacemark{
+			Name:        waypoint.Name,
+			Description: waypoint.Description,
+			Point: &kmlExportPoint{
+				Coordinates: fmt.Sprintf("%v,%v", waypoint.Longitude, waypoint.Latitude),
+			},
+		})
+	}
+
+	for _, track := range tracks {
+		// line string needs at least two points
+		if len(track.Entries) < 2 {
+			continue
+		}
+
+		coordinates := make([]string, 0, len(track.Entries))
+		for _, entry := range track.Entries {
+			if entry.Elevation != nil {
+				coordinates = append(coordinates, fmt.Sprintf("%v,%v,%v", entry.Longitude, entry.Latitude, *entry.Elevation))
+			} else {
+				coordinates = append(coordinates, fmt.Sprintf("%v,%v", entry.Longitude, entry.Latitude))
+			}
+		}
+
+		kml.Document.Placemarks = append(kml.Document.Placemarks, kmlExportPlacemark{
+			Name: track.Name,
+			LineString: &kmlExportLineString{
+				Tessellate:  1,
+				Coordinates: strings.Join(coordinates, " "),
+			},
+		})
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	return xml.NewEncoder(w).Encode(kml)
+}
+
+type geoJSONFeatureCollection struct {
+	Type     string           `json:"type"`
+	Features []geoJSONFeature `json:"features"`
+}
+
+type geoJSONFeature struct {
+	Type       string                 `json:"type"`
+	Geometry   geoJSONGeometry        `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type geoJSONGeometry struct {
+	Type        string      `json:"type"`
+	Coordinates interface{} `json:"coordinates"`
+}
+
+// WriteGeoJSON writes waypoints as points and tracks as line strings in a feature collection.
+func WriteGeoJSON(w io.Writer, waypoints []Waypoint, tracks []Track) error {
+	collection := geoJSONFeatureCollection{
+		Type:     "FeatureCollection",
+		Features: []geoJSONFeature{},
+	}
+
+	for _, waypoint := range waypoints {
+		collection.Features = append(collection.Features, geoJSONFeature{
+			Type: "Feature",
+			Geometry: geoJSONGeometry{
+				Type:        "Point",
+				Coordinates: []float64{waypoint.Longitude, waypoint.Latitude},
+			},
+			Properties: map[string]interface{}{
+				"name":        waypoint.Name,
+				"description": waypoint.Description,
+			},
+		})
+	}
+
+	for _, track := range tracks {
+		// line string needs at least two positions
+		if len(track.Entries) < 2 {
+			continue
+		}
+
+		coordinates := make([][]float64, 0, len(track.Entries))
+		times := make([]string, 0, len(track.Entries))
+		for _, entry := range track.Entries {
+			position := []float64{float64(entry.Longitude), float64(entry.Latitude)}
+			if entry.Elevation != nil {
+				position = append(position, float64(*entry.Elevation))
+			}
+			coordinates = append(coordinates, position)
+			if !entry.Time.IsZero() {
+				times = append(times, entry.Time.UTC().Format(time.RFC3339))
+			}
+		}
+
+		properties := map[string]interface{}{
+			"name": track.Name,
+		}
+		if len(times) == len(coordinates) {
+			properties["coordTimes"] = times
+		}
+
+		collection.Features = append(collection.Features, geoJSONFeature{
+			Type: "Feature",
+			Geometry: geoJSONGeometry{
+				Type:        "LineString",
+				Coordinates: coordinates,
+			},
+			Properties: properties,
+		})
+	}
+
+	return json.NewEncoder(w).Encode(collection)
+}
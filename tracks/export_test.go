@@ -0,0 +1,120 @@
+package tracks
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matematik7/camino-go/diary/models"
+)
+
+var exportWaypoints = []Waypoint{
+	{Name: "Leon", Description: "Katedrala", Latitude: 42.5987, Longitude: -5.5671},
+}
+
+var exportTracks = []Track{
+	{
+		Name: "Leon - Mazarife",
+		Entries: []models.DataEntry{
+			{Time: time.Date(2021, time.September, 9, 8, 0, 0, 0, time.UTC), Latitude: 42.5987, Longitude: -5.5671, Elevation: models.NewFloat(840)},
+			{Time: time.Date(2021, time.September, 9, 8, 30, 0, 0, time.UTC), Latitude: 42.5800, Longitude: -5.6000, Elevation: models.NewFloat(870)},
+		},
+	},
+	{Name: "empty"},
+	{
+		Name:    "single",
+		Entries: []models.DataEntry{{Latitude: 42.5, Longitude: -5.7}},
+	},
+}
+
+func TestWriteGPX(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteGPX(&buf, "Camino", exportWaypoints, exportTracks); err != nil {
+		t.Fatal(err)
+	}
+
+	var gpx gpxExport
+	if err := xml.Unmarshal(buf.Bytes(), &gpx); err != nil {
+		t.Fatalf("invalid xml: %v", err)
+	}
+	if gpx.Name != "Camino" || len(gpx.Waypoints) != 1 || gpx.Waypoints[0].Name != "Leon" {
+		t.Errorf("unexpected metadata or waypoints %+v", gpx)
+	}
+	// empty track is skipped, single point track is valid in gpx
+	if len(gpx.Tracks) != 2 {
+		t.Fatalf("expected 2 tracks, got %d", len(gpx.Tracks))
+	}
+
+	entries, err := ParseGPX(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 parsed points, got %d", len(entries))
+	}
+	if entries[1].Elevation == nil || *entries[1].Elevation != 870 || !entries[1].Time.Equal(exportTracks[0].Entries[1].Time) {
+		t.Errorf("unexpected second point %+v", entries[1])
+	}
+}
+
+func TestWriteKML(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteKML(&buf, "Camino", exportWaypoints, exportTracks); err != nil {
+		t.Fatal(err)
+	}
+
+	var kml kmlExport
+	if err := xml.Unmarshal(buf.Bytes(), &kml); err != nil {
+		t.Fatalf("invalid xml: %v", err)
+	}
+	placemarks := kml.Document.Placemarks
+	if len(placemarks) != 2 {
+		t.Fatalf("expected waypoint and one track, got %d placemarks", len(placemarks))
+	}
+	if placemarks[0].Point == nil || placemarks[0].Point.Coordinates != "-5.5671,42.5987" {
+		t.Errorf("unexpected waypoint %+v", placemarks[0].Point)
+	}
+	if placemarks[1].LineString == nil || placemarks[1].LineString.Coordinates != "-5.5671,42.5987,840 -5.6,42.58,870" {
+		t.Errorf("unexpected line string %+v", placemarks[1].LineString)
+	}
+}
+
+func TestWriteGeoJSON(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteGeoJSON(&buf, exportWaypoints, exportTracks); err != nil {
+		t.Fatal(err)
+	}
+
+	var collection struct {
+		Type     string
+		Features []struct {
+			Geometry struct {
+				Type        string
+				Coordinates json.RawMessage
+			}
+			Properties map[string]interface{}
+		}
+	}
+	if err := json.Unmarshal(buf.Bytes(), &collection); err != nil {
+		t.Fatalf("invalid json: %v", err)
+	}
+	if collection.Type != "FeatureCollection" || len(collection.Features) != 2 {
+		t.Fatalf("expected collection with 2 features, got %s", buf.String())
+	}
+
+	line := collection.Features[1]
+	var coordinates [][]float64
+	if err := json.Unmarshal(line.Geometry.Coordinates, &coordinates); err != nil {
+		t.Fatal(err)
+	}
+	if line.Geometry.Type != "LineString" || len(coordinates) != 2 {
+		t.Errorf("unexpected line string %s %v", line.Geometry.Type, coordinates)
+	}
+	times, ok := line.Properties["coordTimes"].([]interface{})
+	if !ok || len(times) != 2 || !strings.HasPrefix(times[0].(string), "2021-09-09T08:00:00") {
+		t.Errorf("unexpected coordinate times %v", line.Properties["coordTimes"])
+	}
+}
@@ -0,0 +1,223 @@
+package tracks
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/matematik7/camino-go/diary/models"
+)
+
+const (
+	fitRecordMessage = 20
+
+	fitFieldTimestamp        = 253
+	fitFieldLatitude         = 0
+	fitFieldLongitude        = 1
+	fitFieldAltitude         = 2
+	fitFieldDistance         = 5
+	fitFieldEnhancedAltitude = 78
+
+	fitSemicircles = 180.0 / (1 << 31)
+)
+
+// fitEpoch is the FIT timestamp origin (1989-12-31 00:00:00 UTC).
+var fitEpoch = time.Date(1989, time.December, 31, 0, 0, 0, 0, time.UTC)
+
+var fitCRCTable = [16]uint16{
+	0x0000, 0xCC01, 0xD801, 0x1400, 0xF001, 0x3C00, 0x2800, 0xE401,
+	0xA001, 0x6C00, 0x7800, 0xB401, 0x5000, 0x9C01, 0x8801, 0x4400,
+}
+
+func fitCRC(data []byte) uint16 {
+	var crc uint16
+	for _, b := range data {
+		tmp := fitCRCTable[crc&0xF]
+		crc = (crc >> 4) & 0x0FFF
+		crc = crc ^ tmp ^ fitCRCTable[b&0xF]
+
+		tmp = fitCRCTable[crc&0xF]
+		crc = (crc >> 4) & 0x0FFF
+		crc = crc ^ tmp ^ fitCRCTable[(b>>4)&0xF]
+	}
+	return crc
+}
+
+type fitField struct {
+	Num  byte
+	Size byte
+}
+
+type fitDefinition struct {
+	ByteOrder     binary.ByteOrder
+	GlobalMessage uint16
+	Fields        []fitField
+	DevDataSize   int
+}
+
+// ParseFIT reads record messages with a position from a Garmin FIT file.
+func ParseFIT(r io.Reader) ([]models.DataEntry, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read fit")
+	}
+
+	if len(data) < 12 {
+		return nil, errors.New("fit file too short")
+	}
+	headerSize := int(data[0])
+	if headerSize != 12 && headerSize != 14 {
+		return nil, errors.Errorf("invalid fit header size %d", headerSize)
+	}
+	if len(data) < headerSize || string(data[8:12]) != ".FIT" {
+		return nil, errors.New("missing fit signature")
+	}
+	dataSize := int(binary.LittleEndian.Uint32(data[4:8]))
+	if len(data) < headerSize+dataSize+2 {
+		return nil, errors.Errorf("fit file truncated, expected %d data bytes", dataSize)
+	}
+	if fitCRC(data[:headerSize+dataSize+2]) != 0 {
+		return nil, errors.New("invalid fit crc")
+	}
+
+	definitions := map[byte]fitDefinition{}
+	var lastTimestamp uint32
+	points := []point{}
+
+	records := bytes.NewReader(data[headerSize : headerSize+dataSize])
+	for records.Len() > 0 {
+		header, _ := records.ReadByte()
+
+		var localMessage byte
+		compressedTimestamp := header&0x80 != 0
+		if compressedTimestamp {
+			localMessage = (header >> 5) & 0x03
+			offset := uint32(header & 0x1F)
+			if offset >= lastTimestamp&0x1F {
+				lastTimestamp = lastTimestamp&^0x1F + offset
+			} else {
+				lastTimestamp = lastTimestamp&^0x1F + offset + 0x20
+			}
+		} else {
+			localMessage = header & 0x0F
+		}
+
+		if !compressedTimestamp && header&0x40 != 0 {
+			definition, err := readFitDefinition(records, header&0x20 != 0)
+			if err != nil {
+				return nil, err
+			}
+			definitions[localMessage] = definition
+			continue
+		}
+
+		definition, ok := definitions[localMessage]
+		if !ok {
+			return nil, errors.Errorf("fit data message for undefined local message %d", localMessage)
+		}
+
+		var p point
+		hasLatitude, hasLongitude, hasEnhancedAltitude := false, false, false
+		for _, field := range definition.Fields {
+			value := make([]byte, field.Size)
+			if _, err := io.ReadFull(records, value); err != nil {
+				return nil, errors.Wrap(err, "could not read fit field")
+			}
+
+			switch {
+			case field.Num == fitFieldTimestamp && field.Size == 4:
+				if v := definition.ByteOrder.Uint32(value); v != 0xFFFFFFFF {
+					lastTimestamp = v
+				}
+			case definition.GlobalMessage != fitRecordMessage:
+			case field.Num == fitFieldLatitude && field.Size == 4:
+				if v := int32(definition.ByteOrder.Uint32(value)); v != 0x7FFFFFFF {
+					p.Latitude = float64(v) * fitSemicircles
+					hasLatitude = true
+				}
+			case field.Num == fitFieldLongitude && field.Size == 4:
+				if v := int32(definition.ByteOrder.Uint32(value)); v != 0x7FFFFFFF {
+					p.Longitude = float64(v) * fitSemicircles
+					hasLongitude = true
+				}
+			case field.Num == fitFieldAltitude && field.Size == 2:
+				if v := definition.ByteOrder.Uint16(value); v != 0xFFFF && !hasEnhancedAltitude {
+					p.Elevation = float64(v)/5 - 500
+					p.HasElevation = true
+				}
+			case field.Num == fitFieldEnhancedAltitude && field.Size == 4:
+				if v := definition.ByteOrder.Uint32(value); v != 0xFFFFFFFF {
+					p.Elevation = float64(v)/5 - 500
+					p.HasElevation = true
+					hasEnhancedAltitude = true
+				}
+			case field.Num == fitFieldDistance && field.Size == 4:
+				if v := definition.ByteOrder.Uint32(value); v != 0xFFFFFFFF {
+					p.Distance = float64(v) / 100 / 1000
+					p.HasDistance = true
+				}
+			}
+		}
+		if records.Len() < definition.DevDataSize {
+			return nil, errors.New("could not read fit developer data")
+		}
+		records.Seek(int64(definition.DevDataSize), io.SeekCurrent)
+
+		if definition.GlobalMessage == fitRecordMessage && hasLatitude && hasLongitude {
+			p.Time = fitEpoch.Add(time.Duration(lastTimestamp) * time.Second)
+			points = append(points, p)
+		}
+	}
+
+	return dataEntries(points)
+}
+
+func readFitDefinition(r *bytes.Reader, hasDevData bool) (fitDefinition, error) {
+	definition := fitDefinition{}
+
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return definition, errors.Wrap(err, "could not read fit definition")
+	}
+
+	switch header[1] {
+	case 0:
+		definition.ByteOrder = binary.LittleEndian
+	case 1:
+		definition.ByteOrder = binary.BigEndian
+	default:
+		return definition, errors.Errorf("invalid fit architecture %d", header[1])
+	}
+	definition.GlobalMessage = definition.ByteOrder.Uint16(header[2:4])
+
+	fields := make([]byte, int(header[4])*3)
+	if _, err := io.ReadFull(r, fields); err != nil {
+		return definition, errors.Wrap(err, "could not read fit field definitions")
+	}
+	for i := 0; i < len(fields); i += 3 {
+		definition.Fields = append(definition.Fields, fitField{
+			Num:  fields[i],
+			Size: fields[i+1],
+		})
+	}
+
+	if hasDevData {
+		numDevFields, err := r.ReadByte()
+		if err != nil {
+			return definition, errors.Wrap(err, "could not read fit developer field count")
+		}
+		devFields := make([]byte, int(numDevFields)*3)
+		if _, err := io.ReadFull(r, devFields); err != nil {
+			return definition, errors.Wrap(err, "could not read fit developer field definitions")
+		}
+		for i := 0; i < len(devFields); i += 3 {
+			definition.DevDataSize += int(devFields[i+1])
+		}
+	}
+
+	return definition, nil
+}
@@ -0,0 +1,87 @@
+package tracks
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestParseFIT(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/sample.fit")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := ParseFIT(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(entries) != 4 {
+		t.Fatalf("expected 4 entries, got %d", len(entries))
+	}
+
+	start := time.Date(2021, time.September, 8, 1, 46, 40, 0, time.UTC)
+	expected := []struct {
+		offset    time.Duration
+		lat, lon  float64
+		elevation float64
+		distance  float64
+	}{
+		{0, 46.05, 14.5, 300, 0},
+		{10 * time.Second, 46.051, 14.501, 305, 0.135},
+		{20 * time.Second, 46.052, 14.502, 310, 0.27},
+		{30 * time.Second, 46.053, 14.503, 315, 0.405},
+	}
+	for i, e := range expected {
+		entry := entries[i]
+		if !entry.Time.Equal(start.Add(e.offset)) {
+			t.Errorf("entry %d: expected time %v, got %v", i, start.Add(e.offset), entry.Time)
+		}
+		if math.Abs(float64(entry.Latitude)-e.lat) > 1e-6 || math.Abs(float64(entry.Longitude)-e.lon) > 1e-6 {
+			t.Errorf("entry %d: expected position %v, %v, got %v, %v", i, e.lat, e.lon, entry.Latitude, entry.Longitude)
+		}
+		if entry.Elevation == nil || math.Abs(float64(*entry.Elevation)-e.elevation) > 1e-6 {
+			t.Errorf("entry %d: expected elevation %v, got %v", i, e.elevation, entry.Elevation)
+		}
+		if math.Abs(float64(entry.Distance)-e.distance) > 1e-6 {
+			t.Errorf("entry %d: expected distance %v, got %v", i, e.distance, entry.Distance)
+		}
+	}
+}
+
+func TestParseFITErrors(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/sample.fit")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	corrupted := append([]byte{}, data...)
+	corrupted[40] ^= 0xFF
+
+	noRecords := append([]byte{}, data[:14]...)
+	noRecords[4], noRecords[5], noRecords[6], noRecords[7] = 0, 0, 0, 0
+	noRecords[12], noRecords[13] = 0, 0
+	crc := fitCRC(noRecords)
+	noRecords = append(noRecords, byte(crc), byte(crc>>8))
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", []byte{}},
+		{"not fit", []byte("<gpx></gpx> definitely not a fit file")},
+		{"truncated", data[:len(data)-10]},
+		{"bad crc", corrupted},
+		{"no records", noRecords},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := ParseFIT(bytes.NewReader(test.data)); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package tracks
+
+import (
+	"encoding/xml"
+	"io"
+
+	"github.com/pkg/errors"
+
+	"github.com/matematik7/camino-go/diary/models"
+)
+
+type gpxFile struct {
+	XMLName xml.Name   `xml:"gpx"`
+	Tracks  []gpxTrack `xml:"trk"`
+}
+
+type gpxTrack struct {
+	Segments []gpxSegment `xml:"trkseg"`
+}
+
+type gpxSegment struct {
+	Points []gpxPoint `xml:"trkpt"`
+}
+
+type gpxPoint struct {
+	Latitude  float64  `xml:"lat,attr"`
+	Longitude float64  `xml:"lon,attr"`
+	Elevation *float64 `xml:"ele"`
+	Time      string   `xml:"time"`
+}
+
+// ParseGPX reads all track points of a GPX 1.1 file in order.
+func ParseGPX(r io.Reader) ([]models.DataEntry, error) {
+	var gpx gpxFile
+	if err := xml.NewDecoder(r).Decode(&gpx); err != nil {
+		return nil, errors.Wrap(err, "could not decode gpx")
+	}
+
+	points := []point{}
+	for _, track := range gpx.Tracks {
+		for _, segment := range track.Segments {
+			for _, p := range segment.Points {
+				t, err := parseTime(p.Time)
+				if err != nil {
+					return nil, errors.Wrap(err, "could not parse gpx time")
+				}
+				trackPoint := point{
+					Time:      t,
+					Latitude:  p.Latitude,
+					Longitude: p.Longitude,
+				}
+				if p.Elevation != nil {
+					trackPoint.Elevation = *p.Elevation
+					trackPoint.HasElevation = true
+				}
+				points = append(points, trackPoint)
+			}
+		}
+	}
+
+	return dataEntries(points)
+}
@@ -0,0 +1,102 @@
+package tracks
+
+import (
+	"math"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseGPX(t *testing.T) {
+	f, err := os.Open("testdata/sample.gpx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	entries, err := ParseGPX(f)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// points of all segments are joined
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries, got %d", len(entries))
+	}
+
+	first := entries[0]
+	if first.Elevation == nil || *first.Elevation != 0 {
+		t.Errorf("expected sea level elevation, got %v", first.Elevation)
+	}
+	if first.Distance != 0 {
+		t.Errorf("expected distance 0, got %v", first.Distance)
+	}
+
+	last := entries[len(entries)-1]
+	if !last.Time.Equal(time.Date(2021, time.September, 9, 8, 5, 0, 0, time.UTC)) {
+		t.Errorf("unexpected last time %v", last.Time)
+	}
+	if math.Abs(float64(last.Latitude)-42.909) > 1e-9 || math.Abs(float64(last.Longitude)+9.263) > 1e-9 {
+		t.Errorf("unexpected last position %v, %v", last.Latitude, last.Longitude)
+	}
+	if last.Elevation == nil || *last.Elevation != 25 {
+		t.Errorf("expected elevation 25, got %v", last.Elevation)
+	}
+	if last.Distance <= entries[1].Distance {
+		t.Errorf("expected increasing distance, got %v and %v", entries[1].Distance, last.Distance)
+	}
+}
+
+func TestParseGPXWithoutElevation(t *testing.T) {
+	f, err := os.Open("testdata/no-elevation.gpx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	entries, err := ParseGPX(f)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(entries))
+	}
+	for i, entry := range entries {
+		if entry.Elevation != nil {
+			t.Errorf("entry %d: expected no elevation, got %v", i, *entry.Elevation)
+		}
+		if !entry.Time.IsZero() {
+			t.Errorf("entry %d: expected zero time, got %v", i, entry.Time)
+		}
+	}
+	if math.Abs(float64(entries[1].Distance)-0.1354) > 1e-3 {
+		t.Errorf("expected distance 0.135, got %v", entries[1].Distance)
+	}
+}
+
+func TestParseGPXErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		err  error
+	}{
+		{"empty", "", nil},
+		{"malformed", `<gpx><trk><trkseg><trkpt lat="46" lon="14">`, nil},
+		{"empty track", `<gpx><trk><trkseg></trkseg></trk></gpx>`, EmptyTrackError},
+		{"bad time", `<gpx><trk><trkseg><trkpt lat="46" lon="14"><time>yesterday</time></trkpt></trkseg></trk></gpx>`, nil},
+		{"bad coordinates", `<gpx><trk><trkseg><trkpt lat="146" lon="14"></trkpt></trkseg></trk></gpx>`, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := ParseGPX(strings.NewReader(test.data))
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			if test.err != nil && err != test.err {
+				t.Errorf("expected %v, got %v", test.err, err)
+			}
+		})
+	}
+}
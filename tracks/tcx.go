@@ -0,0 +1,80 @@
+package tracks
+
+import (
+	"encoding/xml"
+	"io"
+
+	"github.com/pkg/errors"
+
+	"github.com/matematik7/camino-go/diary/models"
+)
+
+type tcxFile struct {
+	XMLName    xml.Name      `xml:"TrainingCenterDatabase"`
+	Activities []tcxActivity `xml:"Activities>Activity"`
+}
+
+type tcxActivity struct {
+	Laps []tcxLap `xml:"Lap"`
+}
+
+type tcxLap struct {
+	Tracks []tcxTrack `xml:"Track"`
+}
+
+type tcxTrack struct {
+	Points []tcxPoint `xml:"Trackpoint"`
+}
+
+type tcxPoint struct {
+	Time           string       `xml:"Time"`
+	Position       *tcxPosition `xml:"Position"`
+	AltitudeMeters *float64     `xml:"AltitudeMeters"`
+	DistanceMeters *float64     `xml:"DistanceMeters"`
+}
+
+type tcxPosition struct {
+	LatitudeDegrees  float64 `xml:"LatitudeDegrees"`
+	LongitudeDegrees float64 `xml:"LongitudeDegrees"`
+}
+
+// ParseTCX reads trackpoints with a position from a Garmin TCX file.
+func ParseTCX(r io.Reader) ([]models.DataEntry, error) {
+	var tcx tcxFile
+	if err := xml.NewDecoder(r).Decode(&tcx); err != nil {
+		return nil, errors.Wrap(err, "could not decode tcx")
+	}
+
+	points := []point{}
+	for _, activity := range tcx.Activities {
+		for _, lap := range activity.Laps {
+			for _, track := range lap.Tracks {
+				for _, p := range track.Points {
+					if p.Position == nil {
+						continue
+					}
+					t, err := parseTime(p.Time)
+					if err != nil {
+						return nil, errors.Wrap(err, "could not parse tcx time")
+					}
+					trackPoint := point{
+						Time:      t,
+						Latitude:  p.Position.LatitudeDegrees,
+						Longitude: p.Position.LongitudeDegrees,
+					}
+					if p.AltitudeMeters != nil {
+						trackPoint.Elevation = *p.AltitudeMeters
+						trackPoint.HasElevation = true
+					}
+					if p.DistanceMeters != nil {
+						trackPoint.Distance = *p.DistanceMeters / 1000
+						trackPoint.HasDistance = true
+					}
+					points = append(points, trackPoint)
+				}
+			}
+		}
+	}
+
+	return dataEntries(points)
+}
@@ -0,0 +1,63 @@
+package tracks
+
+import (
+	"math"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTCX(t *testing.T) {
+	f, err := os.Open("testdata/sample.tcx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	entries, err := ParseTCX(f)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// trackpoint without position is skipped
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries, got %d", len(entries))
+	}
+
+	last := entries[len(entries)-1]
+	if !last.Time.Equal(time.Date(2021, time.September, 9, 8, 0, 40, 0, time.UTC)) {
+		t.Errorf("unexpected last time %v", last.Time)
+	}
+	if math.Abs(float64(last.Latitude)-46.052) > 1e-9 || math.Abs(float64(last.Longitude)-14.502) > 1e-9 {
+		t.Errorf("unexpected last position %v, %v", last.Latitude, last.Longitude)
+	}
+	if last.Elevation == nil || *last.Elevation != 310 {
+		t.Errorf("expected elevation 310, got %v", last.Elevation)
+	}
+	if math.Abs(float64(last.Distance)-0.27) > 1e-9 {
+		t.Errorf("expected distance 0.27, got %v", last.Distance)
+	}
+}
+
+func TestParseTCXErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"empty", ""},
+		{"malformed", "<TrainingCenterDatabase><Activities>"},
+		{"no points", "<TrainingCenterDatabase><Activities><Activity></Activity></Activities></TrainingCenterDatabase>"},
+		{"bad time", `<TrainingCenterDatabase><Activities><Activity><Lap><Track><Trackpoint>
+			<Time>yesterday</Time>
+			<Position><LatitudeDegrees>46</LatitudeDegrees><LongitudeDegrees>14</LongitudeDegrees></Position>
+		</Trackpoint></Track></Lap></Activity></Activities></TrainingCenterDatabase>`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := ParseTCX(strings.NewReader(test.data)); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+}
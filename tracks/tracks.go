@@ -0,0 +1,113 @@
+package tracks
+
+import (
+	"io"
+	"math"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/matematik7/camino-go/diary/models"
+)
+
+var EmptyTrackError = errors.New("track has no points")
+
+const earthRadius = 6371.0
+
+// Parse decodes a track file, format is chosen by file name extension.
+func Parse(name string, r io.Reader) ([]models.DataEntry, error) {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".gpx":
+		return ParseGPX(r)
+	case ".fit":
+		return ParseFIT(r)
+	case ".tcx":
+		return ParseTCX(r)
+	default:
+		return nil, errors.Errorf("unsupported track format %q", path.Ext(name))
+	}
+}
+
+// point is a single recorded position, elevation and distance in km are optional.
+type point struct {
+	Time         time.Time
+	Latitude     float64
+	Longitude    float64
+	Elevation    float64
+	HasElevation bool
+	Distance     float64
+	HasDistance  bool
+}
+
+// parseTime parses an optional RFC3339 timestamp, empty string is zero time.
+func parseTime(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// distance returns great-circle distance between two points in km.
+func distance(lat1, lon1, lat2, lon2 float64) float64 {
+	rad := math.Pi / 180
+	dLat := (lat2 - lat1) * rad
+	dLon := (lon2 - lon1) * rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(a))
+}
+
+func dataEntries(points []point) ([]models.DataEntry, error) {
+	dataEntries := make([]models.DataEntry, 0, len(points))
+	total := 0.0
+	for i, p := range points {
+		if p.Latitude < -90 || p.Latitude > 90 || p.Longitude < -180 || p.Longitude > 180 {
+			return nil, errors.Errorf("invalid coordinates %v, %v", p.Latitude, p.Longitude)
+		}
+		if p.HasDistance {
+			total = p.Distance
+		} else if i > 0 {
+			prev := points[i-1]
+			total += distance(prev.Latitude, prev.Longitude, p.Latitude, p.Longitude)
+		}
+		dataEntry := models.DataEntry{
+			Time:      p.Time,
+			Latitude:  models.Float(p.Latitude),
+			Longitude: models.Float(p.Longitude),
+			Distance:  models.Float(total),
+		}
+		if p.HasElevation {
+			dataEntry.Elevation = models.NewFloat(p.Elevation)
+		}
+		dataEntries = append(dataEntries, dataEntry)
+	}
+
+	if len(dataEntries) == 0 {
+		return nil, EmptyTrackError
+	}
+
+	return dataEntries, nil
+}
+
+// Summary computes length in km, duration in seconds and average speed in km/h.
+func Summary(dataEntries []models.DataEntry) (length, duration, avgSpeed float64) {
+	if len(dataEntries) == 0 {
+		return 0, 0, 0
+	}
+
+	first := dataEntries[0]
+	last := dataEntries[len(dataEntries)-1]
+
+	length = float64(last.Distance - first.Distance)
+	if !first.Time.IsZero() && !last.Time.IsZero() {
+		duration = last.Time.Sub(first.Time).Seconds()
+	}
+	if duration > 0 {
+		avgSpeed = length / (duration / 3600)
+	}
+
+	return length, duration, avgSpeed
+}